@@ -1,6 +1,10 @@
 package main
 
 import (
+	"context"
+	"os/signal"
+	"syscall"
+
 	"github.com/fedoroko/practicum_go/internal/agent"
 	"github.com/fedoroko/practicum_go/internal/config"
 )
@@ -9,10 +13,18 @@ func main() {
 	cfg := config.NewAgentConfig().Flags().Env()
 	logger := cfg.GetLogger()
 
+	// SIGQUIT не перехватывается, чтобы рантайм по-прежнему печатал стеки
+	ctx, stop := signal.NotifyContext(context.Background(),
+		syscall.SIGTERM,
+		syscall.SIGINT,
+	)
+	defer stop()
+
 	logger.Debug().Interface("Config", cfg).Send()
 	logger.Info().Msg("Agent start")
 	defer logger.Info().Msg("Agent closed")
 	agent.Run(
+		ctx,
 		cfg,
 		logger,
 		agent.WithContentType(agent.ContentTypeJSON),
@@ -1,9 +1,12 @@
 package agent
 
 import (
+	"context"
+	"strings"
 	"time"
 
 	"github.com/fedoroko/practicum_go/internal/config"
+	"github.com/fedoroko/practicum_go/internal/encryption"
 )
 
 type option func(cfg *config.AgentConfig)
@@ -32,6 +35,122 @@ func WithEndpoint(addr string) option {
 	}
 }
 
+// WithEndpoints задает несколько серверов, порядок важен для режима failover
+func WithEndpoints(addrs ...string) option {
+	return func(cfg *config.AgentConfig) {
+		cfg.Address = strings.Join(addrs, ",")
+	}
+}
+
+func WithEndpointMode(mode string) option {
+	return func(cfg *config.AgentConfig) {
+		cfg.EndpointMode = mode
+	}
+}
+
+func WithCompress(method string) option {
+	return func(cfg *config.AgentConfig) {
+		cfg.Compress = method
+	}
+}
+
+func WithCryptoKey(path string) option {
+	return func(cfg *config.AgentConfig) {
+		cfg.CryptoKey = path
+	}
+}
+
+func WithToken(token string) option {
+	return func(cfg *config.AgentConfig) {
+		cfg.Token = token
+	}
+}
+
+// WithKey подписывает метрики ключом id, заданным на сервере в KEYS;
+// пустой id соответствует ключу KEY сервера
+func WithKey(id, key string) option {
+	return func(cfg *config.AgentConfig) {
+		cfg.KeyID = id
+		cfg.Key = key
+	}
+}
+
+// WithTLS включает HTTPS; ca, cert и key можно оставить пустыми
+func WithTLS(ca, cert, key, serverName string) option {
+	return func(cfg *config.AgentConfig) {
+		cfg.TLS = true
+		cfg.TLSCA = ca
+		cfg.TLSCert = cert
+		cfg.TLSKey = key
+		cfg.TLSServerName = serverName
+	}
+}
+
+func WithExecCommands(commands ...string) option {
+	return func(cfg *config.AgentConfig) {
+		cfg.ExecCommands = append(cfg.ExecCommands, commands...)
+	}
+}
+
+func WithRuntimeMetrics(names ...string) option {
+	return func(cfg *config.AgentConfig) {
+		cfg.RuntimeMetrics = true
+		cfg.RuntimeMetricsNames = append(cfg.RuntimeMetricsNames, names...)
+	}
+}
+
+func WithCgroupMetrics(paths ...string) option {
+	return func(cfg *config.AgentConfig) {
+		cfg.CgroupMetrics = true
+		cfg.CgroupPaths = append(cfg.CgroupPaths, paths...)
+	}
+}
+
+func WithTail(files []string, rules []string) option {
+	return func(cfg *config.AgentConfig) {
+		cfg.TailFiles = append(cfg.TailFiles, files...)
+		cfg.TailRules = append(cfg.TailRules, rules...)
+	}
+}
+
+func WithQueue(dir string) option {
+	return func(cfg *config.AgentConfig) {
+		cfg.QueueDir = dir
+	}
+}
+
+func WithCounterMode(mode string) option {
+	return func(cfg *config.AgentConfig) {
+		cfg.CounterMode = mode
+	}
+}
+
+func WithCounterStateFile(file string) option {
+	return func(cfg *config.AgentConfig) {
+		cfg.CounterStateFile = file
+	}
+}
+
+func WithAggregates(rules ...string) option {
+	return func(cfg *config.AgentConfig) {
+		cfg.Aggregates = append(cfg.Aggregates, rules...)
+	}
+}
+
+func WithRateLimit(limit int) option {
+	return func(cfg *config.AgentConfig) {
+		cfg.RateLimit = limit
+	}
+}
+
+// WithSingleRequests отправляет каждую метрику отдельным запросом
+// в формате, заданном WithContentType
+func WithSingleRequests() option {
+	return func(cfg *config.AgentConfig) {
+		cfg.Batch = false
+	}
+}
+
 const (
 	ContentTypeJSON  = "application/json"
 	ContentTypePlain = "text.plain"
@@ -43,12 +162,93 @@ func WithContentType(contentType string) option {
 	}
 }
 
-func Run(cfg *config.AgentConfig, logger *config.Logger, opts ...option) {
+// Run работает до отмены ctx, после чего отправляет
+// последний батч не дольше ShutdownInterval
+func Run(ctx context.Context, cfg *config.AgentConfig, logger *config.Logger, opts ...option) {
 	for _, o := range opts {
 		o(cfg)
 	}
+	if cfg.CounterMode != CounterModeDelta && cfg.CounterMode != CounterModeCumulative {
+		logger.Fatal().Str("mode", cfg.CounterMode).Msg("unknown counter mode")
+	}
+	// старая подпись не покрывает key_id и cumulative, сервер их отклонит
+	if cfg.LegacyHash && (cfg.KeyID != "" || cfg.CounterMode == CounterModeCumulative) {
+		logger.Fatal().Msg("legacy hash requires delta counters and no key id")
+	}
+	if cfg.EndpointMode != EndpointModeFailover && cfg.EndpointMode != EndpointModeFanout {
+		logger.Fatal().Str("mode", cfg.EndpointMode).Msg("unknown endpoint mode")
+	}
+	if _, _, err := compressBody(cfg.Compress, nil); err != nil {
+		logger.Fatal().Err(err).Msg("")
+	}
+	if len(parseAddresses(cfg.Address)) == 0 {
+		logger.Fatal().Msg("no server address")
+	}
+
 	s := newStats(cfg, logger)
+	if err := s.gauges.addRules(cfg.Aggregates); err != nil {
+		logger.Fatal().Err(err).Msg("")
+	}
+	if cfg.CryptoKey != "" {
+		e, err := encryption.NewEncrypter(cfg.CryptoKey)
+		if err != nil {
+			logger.Fatal().Err(err).Msg("crypto key")
+		}
+		s.encrypter = e
+	}
+	t, err := newTLSConfig(cfg)
+	if err != nil {
+		logger.Fatal().Err(err).Msg("tls")
+	}
+	s.tls = t
+	s.prepare(s.endpoints.probe)
+	if cfg.CounterStateFile != "" {
+		if err := s.counters.load(cfg.CounterStateFile); err != nil {
+			logger.Error().Err(err).Msg("counters state not restored")
+		}
+	}
+
+	if len(cfg.ExecCommands) > 0 {
+		e := newExecCollector(cfg, logger)
+		go e.listen(s.done)
+		s.collectors = append(s.collectors, e.collect)
+	}
+
+	if cfg.CgroupMetrics {
+		c, err := newCgroupCollector(cfg, logger)
+		if err != nil {
+			logger.Error().Err(err).Msg("cgroup collector disabled")
+		} else {
+			s.collectors = append(s.collectors, c.collect)
+		}
+	}
+
+	if len(cfg.TailFiles) > 0 {
+		t, err := newTailCollector(cfg, logger)
+		if err != nil {
+			logger.Error().Err(err).Msg("tail collector disabled")
+		} else {
+			go t.listen(s.done)
+			s.collectors = append(s.collectors, t.collect)
+		}
+	}
+
+	if cfg.QueueDir != "" {
+		q, err := newDiskQueue(cfg.QueueDir, cfg.QueueMaxSize, cfg.QueueMaxAge)
+		if err != nil {
+			logger.Error().Err(err).Msg("send queue disabled")
+		} else {
+			s.queue = q
+		}
+	}
+
+	go func() {
+		<-ctx.Done()
+		logger.Info().Msg("Agent shutting down")
+		close(s.done)
+	}()
 
 	go s.collect()
-	s.send()
+	s.send(ctx)
+	s.shutdown()
 }
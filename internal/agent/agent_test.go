@@ -0,0 +1,149 @@
+package agent
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/fedoroko/practicum_go/internal/config"
+	"github.com/fedoroko/practicum_go/internal/metrics"
+)
+
+func Test_run_shutdown(t *testing.T) {
+	var (
+		mtx     sync.Mutex
+		batches [][]metrics.Metric
+	)
+	ts := newTestServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ms, err := metrics.ArrFromJSON(r.Body)
+		if err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		mtx.Lock()
+		defer mtx.Unlock()
+		batches = append(batches, ms)
+	}))
+	defer ts.Close()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	finished := make(chan struct{})
+	go func() {
+		defer close(finished)
+		Run(ctx, config.NewAgentConfig(), config.TestLogger(),
+			WithEndpoint(strings.TrimPrefix(ts.URL, "http://")),
+			WithPollInterval(time.Hour),
+			WithReportInterval(time.Hour),
+			WithShutdownInterval(time.Second*5),
+		)
+	}()
+
+	time.Sleep(time.Millisecond * 50)
+	cancel()
+
+	select {
+	case <-finished:
+	case <-time.After(time.Second * 5):
+		t.Fatal("agent did not stop")
+	}
+
+	// до остановки не было ни одного тика, весь батч - из финальной отправки
+	mtx.Lock()
+	defer mtx.Unlock()
+	require.Len(t, batches, 1)
+	got := batchValues(batches[0])
+	assert.Contains(t, got, "PollCount")
+	assert.Contains(t, got, "Alloc")
+}
+
+func Test_run_shutdown_timeout(t *testing.T) {
+	release := make(chan struct{})
+	ts := newTestServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		<-release
+	}))
+	defer ts.Close()
+	defer close(release)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	start := time.Now()
+	Run(ctx, config.NewAgentConfig(), config.TestLogger(),
+		WithEndpoint(strings.TrimPrefix(ts.URL, "http://")),
+		WithPollInterval(time.Hour),
+		WithReportInterval(time.Hour),
+		WithShutdownInterval(time.Millisecond*200),
+	)
+
+	assert.Less(t, time.Since(start), time.Second*2)
+}
+
+// отмена прерывает зависшую отправку, и финальный батч успевает уйти
+func Test_run_shutdown_inflight(t *testing.T) {
+	var (
+		mtx      sync.Mutex
+		requests int
+	)
+	hung := make(chan struct{})
+	final := make(chan []metrics.Metric, 1)
+	ts := newTestServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mtx.Lock()
+		requests++
+		n := requests
+		mtx.Unlock()
+
+		if n == 1 {
+			// без чтения тела сервер не заметит, что клиент ушел
+			io.ReadAll(r.Body)
+			close(hung)
+			<-r.Context().Done()
+			return
+		}
+		ms, err := metrics.ArrFromJSON(r.Body)
+		if err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		final <- ms
+	}))
+	defer ts.Close()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	finished := make(chan struct{})
+	go func() {
+		defer close(finished)
+		Run(ctx, config.NewAgentConfig(), config.TestLogger(),
+			WithEndpoint(strings.TrimPrefix(ts.URL, "http://")),
+			WithPollInterval(time.Hour),
+			WithReportInterval(time.Millisecond*50),
+			WithShutdownInterval(time.Second*5),
+		)
+	}()
+
+	select {
+	case <-hung:
+	case <-time.After(time.Second * 5):
+		t.Fatal("no report")
+	}
+	cancel()
+
+	select {
+	case <-finished:
+	case <-time.After(time.Second * 5):
+		t.Fatal("agent did not stop")
+	}
+
+	select {
+	case ms := <-final:
+		assert.Contains(t, batchValues(ms), "PollCount")
+	default:
+		t.Fatal("final report was not sent")
+	}
+}
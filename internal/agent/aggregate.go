@@ -0,0 +1,220 @@
+package agent
+
+import (
+	"fmt"
+	"math"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/fedoroko/practicum_go/internal/metrics"
+)
+
+const aggregateLast = "last"
+
+// aggregateRule задается строкой вида "pattern=agg,agg", где pattern -
+// имя метрики или шаблон path.Match, а agg - last, min, max, avg, sum,
+// count или перцентиль pNN (например p95).
+// last отправляется под исходным именем, остальные - с суффиксом:
+// AllocMax, AllocP95.
+type aggregateRule struct {
+	pattern string
+	aggs    []string
+}
+
+func parseAggregateRule(rule string) (aggregateRule, error) {
+	kv := strings.SplitN(rule, "=", 2)
+	if len(kv) != 2 || kv[0] == "" || kv[1] == "" {
+		return aggregateRule{}, fmt.Errorf("invalid aggregate rule %q, want pattern=agg,agg", rule)
+	}
+
+	if _, err := path.Match(kv[0], ""); err != nil {
+		return aggregateRule{}, err
+	}
+
+	r := aggregateRule{pattern: kv[0]}
+	for _, a := range strings.Split(kv[1], ",") {
+		a = strings.ToLower(strings.TrimSpace(a))
+		switch a {
+		case aggregateLast, "min", "max", "avg", "sum", "count":
+		default:
+			if _, err := percentileOf(a); err != nil {
+				return aggregateRule{}, fmt.Errorf("unknown aggregate %q", a)
+			}
+		}
+		r.aggs = append(r.aggs, a)
+	}
+
+	return r, nil
+}
+
+func percentileOf(agg string) (float64, error) {
+	if !strings.HasPrefix(agg, "p") {
+		return 0, fmt.Errorf("not a percentile: %s", agg)
+	}
+
+	p, err := strconv.ParseFloat(agg[1:], 64)
+	if err != nil || p <= 0 || p > 100 {
+		return 0, fmt.Errorf("invalid percentile: %s", agg)
+	}
+
+	return p, nil
+}
+
+type gaugeWindow struct {
+	aggs    []string
+	min     float64
+	max     float64
+	sum     float64
+	count   int
+	last    float64
+	samples []float64
+	keep    bool
+}
+
+func (w *gaugeWindow) add(v float64) {
+	if w.count == 0 || v < w.min {
+		w.min = v
+	}
+	if w.count == 0 || v > w.max {
+		w.max = v
+	}
+	w.sum += v
+	w.count++
+	w.last = v
+	if w.keep {
+		w.samples = append(w.samples, v)
+	}
+}
+
+func (w *gaugeWindow) value(agg string) float64 {
+	switch agg {
+	case "min":
+		return w.min
+	case "max":
+		return w.max
+	case "avg":
+		return w.sum / float64(w.count)
+	case "sum":
+		return w.sum
+	case "count":
+		return float64(w.count)
+	case aggregateLast:
+		return w.last
+	}
+
+	p, _ := percentileOf(agg)
+	sort.Float64s(w.samples)
+	rank := int(math.Ceil(p/100*float64(len(w.samples)))) - 1
+	if rank < 0 {
+		rank = 0
+	}
+	return w.samples[rank]
+}
+
+func (w *gaugeWindow) reset() {
+	w.count = 0
+	w.sum = 0
+	w.samples = w.samples[:0]
+}
+
+// aggregator копит значения gauge за окно отправки
+// и отдает настроенные агрегаты по каждой метрике.
+// Без правил поведение прежнее - отправляется последнее значение.
+type aggregator struct {
+	rules   []aggregateRule
+	windows map[string]*gaugeWindow
+	mtx     sync.Mutex
+}
+
+func newAggregator() *aggregator {
+	return &aggregator{
+		windows: make(map[string]*gaugeWindow),
+		mtx:     sync.Mutex{},
+	}
+}
+
+// addRules добавляет правила, первое совпавшее правило побеждает
+func (a *aggregator) addRules(rules []string) error {
+	a.mtx.Lock()
+	defer a.mtx.Unlock()
+
+	for _, r := range rules {
+		rule, err := parseAggregateRule(r)
+		if err != nil {
+			return err
+		}
+		a.rules = append(a.rules, rule)
+	}
+
+	return nil
+}
+
+func (a *aggregator) aggsFor(name string) []string {
+	for _, r := range a.rules {
+		if ok, _ := path.Match(r.pattern, name); ok {
+			return r.aggs
+		}
+	}
+
+	return []string{aggregateLast}
+}
+
+func (a *aggregator) add(ms []metrics.Metric) {
+	a.mtx.Lock()
+	defer a.mtx.Unlock()
+
+	for _, m := range ms {
+		w, ok := a.windows[m.Name()]
+		if !ok {
+			w = &gaugeWindow{aggs: a.aggsFor(m.Name())}
+			for _, agg := range w.aggs {
+				if _, err := percentileOf(agg); err == nil {
+					w.keep = true
+				}
+			}
+			a.windows[m.Name()] = w
+		}
+		w.add(m.Float64Value())
+	}
+}
+
+// flush отдает агрегаты за окно и начинает новое.
+// Метрики без значений в окне не отправляются.
+func (a *aggregator) flush() []metrics.Metric {
+	a.mtx.Lock()
+	defer a.mtx.Unlock()
+
+	names := make([]string, 0, len(a.windows))
+	for n := range a.windows {
+		names = append(names, n)
+	}
+	sort.Strings(names)
+
+	var ms []metrics.Metric
+	for _, n := range names {
+		w := a.windows[n]
+		if w.count == 0 {
+			continue
+		}
+
+		for _, agg := range w.aggs {
+			name := n
+			if agg != aggregateLast {
+				name += strings.ToUpper(agg[:1]) + agg[1:]
+			}
+			ms = append(ms, newGauge(name, w.value(agg)))
+		}
+		w.reset()
+	}
+
+	return ms
+}
+
+func (a *aggregator) len() int {
+	a.mtx.Lock()
+	defer a.mtx.Unlock()
+	return len(a.windows)
+}
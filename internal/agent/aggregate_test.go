@@ -0,0 +1,107 @@
+package agent
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/fedoroko/practicum_go/internal/metrics"
+)
+
+func Test_parseAggregateRule(t *testing.T) {
+	tests := []struct {
+		name    string
+		rule    string
+		want    aggregateRule
+		wantErr bool
+	}{
+		{
+			name: "exact name",
+			rule: "Alloc=min,max,avg",
+			want: aggregateRule{pattern: "Alloc", aggs: []string{"min", "max", "avg"}},
+		},
+		{
+			name: "glob and percentile",
+			rule: "CPUutilization*=last, P95",
+			want: aggregateRule{pattern: "CPUutilization*", aggs: []string{"last", "p95"}},
+		},
+		{
+			name:    "unknown aggregate",
+			rule:    "Alloc=median",
+			wantErr: true,
+		},
+		{
+			name:    "bad percentile",
+			rule:    "Alloc=p101",
+			wantErr: true,
+		},
+		{
+			name:    "bad pattern",
+			rule:    "Alloc[=max",
+			wantErr: true,
+		},
+		{
+			name:    "no aggregates",
+			rule:    "Alloc",
+			wantErr: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := parseAggregateRule(tt.rule)
+			if tt.wantErr {
+				assert.Error(t, err)
+				return
+			}
+			assert.NoError(t, err)
+			assert.Equal(t, tt.want, got)
+		})
+	}
+}
+
+func Test_aggregator_flush(t *testing.T) {
+	a := newAggregator()
+	require.NoError(t, a.addRules([]string{
+		"Alloc=min,max,avg,last",
+		"CPU*=p50,p90,count",
+	}))
+
+	for i := 1; i <= 10; i++ {
+		a.add([]metrics.Metric{
+			newGauge("Alloc", float64(i)),
+			newGauge("CPU1", float64(i*10)),
+			newGauge("RandomValue", float64(i)),
+		})
+	}
+
+	got := map[string]float64{}
+	for _, m := range a.flush() {
+		got[m.Name()] = m.Float64Value()
+	}
+	assert.Equal(t, map[string]float64{
+		"AllocMin":    1,
+		"AllocMax":    10,
+		"AllocAvg":    5.5,
+		"Alloc":       10,
+		"CPU1P50":     50,
+		"CPU1P90":     90,
+		"CPU1Count":   10,
+		"RandomValue": 10,
+	}, got)
+
+	// новое окно: без новых значений ничего не отправляется
+	assert.Empty(t, a.flush())
+
+	a.add([]metrics.Metric{newGauge("Alloc", 42)})
+	got = map[string]float64{}
+	for _, m := range a.flush() {
+		got[m.Name()] = m.Float64Value()
+	}
+	assert.Equal(t, map[string]float64{
+		"AllocMin": 42,
+		"AllocMax": 42,
+		"AllocAvg": 42,
+		"Alloc":    42,
+	}, got)
+}
@@ -0,0 +1,212 @@
+package agent
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/fedoroko/practicum_go/internal/config"
+	"github.com/fedoroko/practicum_go/internal/metrics"
+)
+
+const (
+	cgroupPrefix   = "Cgroup"
+	cgroupSelfFile = "/proc/self/cgroup"
+)
+
+type cgroupTarget struct {
+	label string
+	dir   string
+}
+
+// cgroupCollector читает файлы cgroup v2 своей или заданных групп.
+// memory.current, memory.max и pids.current отдаются как gauge,
+// cpu.stat и io.stat (сумма по устройствам) - как counter
+// с приростом относительно прошлого чтения.
+// Первое чтение только запоминает значения и отдает нулевые дельты,
+// чтобы перезапуск агента не удваивал счетчики на сервере.
+type cgroupCollector struct {
+	targets []cgroupTarget
+	prev    map[string]int64
+	mtx     sync.Mutex
+	logger  *config.Logger
+}
+
+// newCgroupCollector принимает пути вида "path" или "Label=path"
+// относительно CgroupRoot. Если путей нет, используется группа агента.
+func newCgroupCollector(cfg *config.AgentConfig, logger *config.Logger) (*cgroupCollector, error) {
+	subLogger := logger.With().Str("Component", "CGROUP").Logger()
+	c := &cgroupCollector{
+		prev:   make(map[string]int64),
+		mtx:    sync.Mutex{},
+		logger: config.NewLogger(&subLogger),
+	}
+
+	if len(cfg.CgroupPaths) == 0 {
+		self, err := selfCgroup(cgroupSelfFile)
+		if err != nil {
+			return nil, err
+		}
+		c.targets = append(c.targets, cgroupTarget{dir: filepath.Join(cfg.CgroupRoot, self)})
+		return c, nil
+	}
+
+	for _, p := range cfg.CgroupPaths {
+		t := cgroupTarget{dir: p}
+		if kv := strings.SplitN(p, "=", 2); len(kv) == 2 {
+			t.label, t.dir = kv[0], kv[1]
+		} else {
+			t.label = metricName("", filepath.Base(p))
+		}
+		t.dir = filepath.Join(cfg.CgroupRoot, t.dir)
+		c.targets = append(c.targets, t)
+	}
+
+	return c, nil
+}
+
+// selfCgroup ищет в /proc/self/cgroup запись единой иерархии "0::/path"
+func selfCgroup(procFile string) (string, error) {
+	data, err := os.ReadFile(procFile)
+	if err != nil {
+		return "", err
+	}
+
+	scanner := bufio.NewScanner(bytes.NewReader(data))
+	for scanner.Scan() {
+		if p := strings.TrimPrefix(scanner.Text(), "0::"); p != scanner.Text() {
+			return p, nil
+		}
+	}
+
+	return "", errors.New("cgroup v2 hierarchy not found")
+}
+
+func (c *cgroupCollector) collect(metricsCh chan<- []metrics.Metric) {
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+
+	var ms []metrics.Metric
+	for _, t := range c.targets {
+		prefix := cgroupPrefix + t.label
+		for _, f := range []string{"memory.current", "memory.max", "pids.current"} {
+			v, err := readCgroupValue(filepath.Join(t.dir, f))
+			if err != nil {
+				c.logger.Debug().Err(err).Send()
+				continue
+			}
+			ms = append(ms, newGauge(metricName(prefix, f), float64(v)))
+		}
+
+		if stat, err := readCgroupKeyValues(filepath.Join(t.dir, "cpu.stat")); err == nil {
+			ms = append(ms, c.counters(metricName(prefix, "cpu"), stat)...)
+		} else {
+			c.logger.Debug().Err(err).Send()
+		}
+
+		if stat, err := readCgroupIOStat(filepath.Join(t.dir, "io.stat")); err == nil {
+			ms = append(ms, c.counters(metricName(prefix, "io"), stat)...)
+		} else {
+			c.logger.Debug().Err(err).Send()
+		}
+	}
+
+	metricsCh <- ms
+}
+
+func (c *cgroupCollector) counters(prefix string, values map[string]int64) []metrics.Metric {
+	ms := make([]metrics.Metric, 0, len(values))
+	for k, v := range values {
+		name := metricName(prefix, k)
+
+		var delta int64
+		if prev, ok := c.prev[name]; ok {
+			delta = v - prev
+			// счетчик сбросился, например группа была пересоздана
+			if delta < 0 {
+				delta = v
+			}
+		}
+		c.prev[name] = v
+
+		ms = append(ms, metrics.NewOmitEmpty(
+			name,
+			metrics.CounterType,
+			nil,
+			metrics.PointerFromInt64(delta),
+		))
+	}
+
+	return ms
+}
+
+// readCgroupValue читает файл с одним числом.
+// Значение "max" (лимит не задан) считается ошибкой и пропускается.
+func readCgroupValue(path string) (int64, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return 0, err
+	}
+
+	return strconv.ParseInt(strings.TrimSpace(string(data)), 10, 64)
+}
+
+// readCgroupKeyValues читает файлы вида "key value" по строке на ключ
+func readCgroupKeyValues(path string) (map[string]int64, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	ret := make(map[string]int64)
+	scanner := bufio.NewScanner(bytes.NewReader(data))
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) != 2 {
+			continue
+		}
+		v, err := strconv.ParseInt(fields[1], 10, 64)
+		if err != nil {
+			return nil, err
+		}
+		ret[fields[0]] = v
+	}
+
+	return ret, scanner.Err()
+}
+
+// readCgroupIOStat суммирует по всем устройствам строки вида
+// "8:0 rbytes=1 wbytes=2 rios=3 wios=4 dbytes=0 dios=0"
+func readCgroupIOStat(path string) (map[string]int64, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	ret := make(map[string]int64)
+	scanner := bufio.NewScanner(bytes.NewReader(data))
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) < 2 {
+			continue
+		}
+		for _, f := range fields[1:] {
+			kv := strings.SplitN(f, "=", 2)
+			if len(kv) != 2 {
+				continue
+			}
+			v, err := strconv.ParseInt(kv[1], 10, 64)
+			if err != nil {
+				return nil, err
+			}
+			ret[kv[0]] += v
+		}
+	}
+
+	return ret, scanner.Err()
+}
@@ -0,0 +1,136 @@
+package agent
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/fedoroko/practicum_go/internal/config"
+	"github.com/fedoroko/practicum_go/internal/metrics"
+)
+
+func writeCgroupFiles(t *testing.T, dir string, files map[string]string) {
+	require.NoError(t, os.MkdirAll(dir, 0755))
+	for name, data := range files {
+		require.NoError(t, os.WriteFile(filepath.Join(dir, name), []byte(data), 0644))
+	}
+}
+
+func collectCgroup(c *cgroupCollector) map[string]metrics.Metric {
+	metricsCh := make(chan []metrics.Metric, 1)
+	c.collect(metricsCh)
+
+	ret := map[string]metrics.Metric{}
+	for _, m := range <-metricsCh {
+		ret[m.Name()] = m
+	}
+	return ret
+}
+
+func Test_cgroupCollector(t *testing.T) {
+	root := t.TempDir()
+	dir := filepath.Join(root, "system.slice", "app.service")
+	writeCgroupFiles(t, dir, map[string]string{
+		"memory.current": "1048576\n",
+		"memory.max":     "max\n",
+		"pids.current":   "7\n",
+		"cpu.stat":       "usage_usec 1000\nuser_usec 600\nsystem_usec 400\n",
+		"io.stat":        "8:0 rbytes=100 wbytes=200 rios=1 wios=2\n8:16 rbytes=10 wbytes=20 rios=1 wios=1\n",
+	})
+
+	cfg := config.NewAgentConfig()
+	cfg.CgroupRoot = root
+	cfg.CgroupPaths = []string{"system.slice/app.service"}
+	c, err := newCgroupCollector(cfg, config.TestLogger())
+	require.NoError(t, err)
+
+	got := collectCgroup(c)
+	require.Contains(t, got, "CgroupAppServiceMemoryCurrent")
+	assert.Equal(t, metrics.GaugeType, got["CgroupAppServiceMemoryCurrent"].Type())
+	assert.Equal(t, float64(1048576), got["CgroupAppServiceMemoryCurrent"].Float64Value())
+	assert.Equal(t, float64(7), got["CgroupAppServicePidsCurrent"].Float64Value())
+	assert.NotContains(t, got, "CgroupAppServiceMemoryMax", "unlimited memory.max is skipped")
+
+	require.Contains(t, got, "CgroupAppServiceCpuUsageUsec")
+	assert.Equal(t, metrics.CounterType, got["CgroupAppServiceCpuUsageUsec"].Type())
+	assert.Equal(t, int64(0), got["CgroupAppServiceCpuUsageUsec"].Int64Value(), "first read is a baseline")
+
+	writeCgroupFiles(t, dir, map[string]string{
+		"memory.max": "2097152\n",
+		"cpu.stat":   "usage_usec 1500\nuser_usec 900\nsystem_usec 600\n",
+		"io.stat":    "8:0 rbytes=150 wbytes=200 rios=2 wios=2\n8:16 rbytes=10 wbytes=25 rios=1 wios=2\n",
+	})
+
+	got = collectCgroup(c)
+	assert.Equal(t, float64(2097152), got["CgroupAppServiceMemoryMax"].Float64Value())
+	assert.Equal(t, int64(500), got["CgroupAppServiceCpuUsageUsec"].Int64Value())
+	assert.Equal(t, int64(300), got["CgroupAppServiceCpuUserUsec"].Int64Value())
+	assert.Equal(t, int64(50), got["CgroupAppServiceIoRbytes"].Int64Value())
+	assert.Equal(t, int64(5), got["CgroupAppServiceIoWbytes"].Int64Value())
+	assert.Equal(t, int64(1), got["CgroupAppServiceIoWios"].Int64Value())
+
+	writeCgroupFiles(t, dir, map[string]string{
+		"cpu.stat": "usage_usec 100\nuser_usec 900\nsystem_usec 600\n",
+	})
+	got = collectCgroup(c)
+	assert.Equal(t, int64(100), got["CgroupAppServiceCpuUsageUsec"].Int64Value(), "reset counter")
+}
+
+func Test_cgroupCollector_label(t *testing.T) {
+	root := t.TempDir()
+	writeCgroupFiles(t, filepath.Join(root, "db"), map[string]string{
+		"memory.current": "10",
+	})
+
+	cfg := config.NewAgentConfig()
+	cfg.CgroupRoot = root
+	cfg.CgroupPaths = []string{"Postgres=db", "missing"}
+	c, err := newCgroupCollector(cfg, config.TestLogger())
+	require.NoError(t, err)
+
+	got := collectCgroup(c)
+	assert.Len(t, got, 1)
+	assert.Contains(t, got, "CgroupPostgresMemoryCurrent")
+}
+
+func Test_selfCgroup(t *testing.T) {
+	tests := []struct {
+		name    string
+		data    string
+		want    string
+		wantErr bool
+	}{
+		{
+			name: "v2",
+			data: "0::/user.slice/user-1000.slice/session-1.scope\n",
+			want: "/user.slice/user-1000.slice/session-1.scope",
+		},
+		{
+			name: "hybrid",
+			data: "12:memory:/user.slice\n1:name=systemd:/user.slice\n0::/user.slice\n",
+			want: "/user.slice",
+		},
+		{
+			name:    "v1 only",
+			data:    "12:memory:/user.slice\n",
+			wantErr: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			f := filepath.Join(t.TempDir(), "cgroup")
+			require.NoError(t, os.WriteFile(f, []byte(tt.data), 0644))
+
+			got, err := selfCgroup(f)
+			if tt.wantErr {
+				assert.Error(t, err)
+				return
+			}
+			assert.NoError(t, err)
+			assert.Equal(t, tt.want, got)
+		})
+	}
+}
@@ -0,0 +1,33 @@
+package agent
+
+import (
+	"bytes"
+	"compress/gzip"
+	"fmt"
+)
+
+const (
+	CompressNone = "none"
+	CompressGzip = "gzip"
+)
+
+// compressBody сжимает тело запроса и возвращает значение Content-Encoding,
+// пустое, если сжатие выключено
+func compressBody(method string, data []byte) ([]byte, string, error) {
+	switch method {
+	case "", CompressNone:
+		return data, "", nil
+	case CompressGzip:
+		var buf bytes.Buffer
+		gz := gzip.NewWriter(&buf)
+		if _, err := gz.Write(data); err != nil {
+			return nil, "", err
+		}
+		if err := gz.Close(); err != nil {
+			return nil, "", err
+		}
+		return buf.Bytes(), CompressGzip, nil
+	default:
+		return nil, "", fmt.Errorf("unknown compression %q", method)
+	}
+}
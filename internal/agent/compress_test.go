@@ -0,0 +1,81 @@
+package agent
+
+import (
+	"bytes"
+	"compress/gzip"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// newTestServer поднимает сервер, который как настоящий
+// распаковывает тела запросов агента
+func newTestServer(h http.Handler) *httptest.Server {
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Content-Encoding") == CompressGzip {
+			gz, err := gzip.NewReader(r.Body)
+			if err != nil {
+				w.WriteHeader(http.StatusBadRequest)
+				return
+			}
+			defer gz.Close()
+			r.Body = gz
+		}
+		h.ServeHTTP(w, r)
+	}))
+}
+
+func Test_compressBody(t *testing.T) {
+	data := []byte("[{\"id\":\"Alloc\",\"type\":\"gauge\",\"value\":1}]")
+
+	tests := []struct {
+		name         string
+		method       string
+		wantEncoding string
+		wantErr      bool
+	}{
+		{
+			name:   "default",
+			method: "",
+		},
+		{
+			name:   "none",
+			method: CompressNone,
+		},
+		{
+			name:         "gzip",
+			method:       CompressGzip,
+			wantEncoding: "gzip",
+		},
+		{
+			name:    "unknown",
+			method:  "zstd",
+			wantErr: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			body, encoding, err := compressBody(tt.method, data)
+			if tt.wantErr {
+				assert.Error(t, err)
+				return
+			}
+			require.NoError(t, err)
+			assert.Equal(t, tt.wantEncoding, encoding)
+
+			if encoding == "" {
+				assert.Equal(t, data, body)
+				return
+			}
+			gz, err := gzip.NewReader(bytes.NewReader(body))
+			require.NoError(t, err)
+			got, err := io.ReadAll(gz)
+			require.NoError(t, err)
+			assert.Equal(t, data, got)
+		})
+	}
+}
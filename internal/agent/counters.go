@@ -0,0 +1,144 @@
+package agent
+
+import (
+	"encoding/json"
+	"os"
+	"sort"
+	"sync"
+
+	"github.com/fedoroko/practicum_go/internal/metrics"
+)
+
+const (
+	CounterModeDelta      = "delta"
+	CounterModeCumulative = "cumulative"
+)
+
+type counterState struct {
+	Total map[string]int64 `json:"total"`
+	Acked map[string]int64 `json:"acked"`
+}
+
+// counterTracker считает накопленные агентом значения счетчиков
+// и значения, подтвержденные сервером.
+// В режиме delta отправляется разница total - acked, поэтому повторная
+// отправка после ошибки не теряет и не удваивает приращения.
+// В режиме cumulative отправляется total с признаком cumulative,
+// и сервер записывает значение вместо прибавления.
+// Если задан файл состояния, счетчики переживают перезапуск агента.
+type counterTracker struct {
+	mode  string
+	state counterState
+	file  string
+	mtx   sync.Mutex
+}
+
+func newCounterTracker(mode string) *counterTracker {
+	return &counterTracker{
+		mode: mode,
+		state: counterState{
+			Total: make(map[string]int64),
+			Acked: make(map[string]int64),
+		},
+		mtx: sync.Mutex{},
+	}
+}
+
+// load подключает файл состояния и восстанавливает из него счетчики
+func (c *counterTracker) load(file string) error {
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+
+	c.file = file
+	data, err := os.ReadFile(file)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	state := counterState{}
+	if err = json.Unmarshal(data, &state); err != nil {
+		return err
+	}
+	for n, v := range state.Total {
+		c.state.Total[n] += v
+	}
+	for n, v := range state.Acked {
+		c.state.Acked[n] = v
+	}
+
+	return nil
+}
+
+func (c *counterTracker) add(name string, delta int64) {
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+	c.state.Total[name] += delta
+}
+
+// pending возвращает метрики к отправке и значения total на момент
+// формирования батча, которые нужно передать в ack после успеха
+func (c *counterTracker) pending() ([]metrics.Metric, map[string]int64) {
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+
+	names := make([]string, 0, len(c.state.Total))
+	for n := range c.state.Total {
+		names = append(names, n)
+	}
+	sort.Strings(names)
+
+	ms := make([]metrics.Metric, 0, len(names))
+	sent := make(map[string]int64, len(names))
+	for _, n := range names {
+		total := c.state.Total[n]
+		sent[n] = total
+
+		v := total
+		if c.mode == CounterModeDelta {
+			v = total - c.state.Acked[n]
+			if v == 0 {
+				continue
+			}
+		}
+
+		m := metrics.NewOmitEmpty(n, metrics.CounterType, nil, metrics.PointerFromInt64(v))
+		m.SetCumulative(c.mode == CounterModeCumulative)
+		ms = append(ms, m)
+	}
+
+	return ms, sent
+}
+
+// ack отмечает значения, которые сервер принял (или забрала дисковая очередь),
+// и сохраняет состояние в файл, даже если подтверждать нечего
+func (c *counterTracker) ack(sent map[string]int64) error {
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+
+	for n, v := range sent {
+		c.state.Acked[n] = v
+	}
+
+	return c.save()
+}
+
+func (c *counterTracker) save() error {
+	if c.file == "" {
+		return nil
+	}
+
+	data, err := json.Marshal(c.state)
+	if err != nil {
+		return err
+	}
+
+	tmp := c.file + ".tmp"
+	if err = os.WriteFile(tmp, data, 0644); err != nil {
+		return err
+	}
+
+	return os.Rename(tmp, c.file)
+}
@@ -0,0 +1,158 @@
+package agent
+
+import (
+	"context"
+	"net/http"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/go-resty/resty/v2"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/fedoroko/practicum_go/internal/config"
+	"github.com/fedoroko/practicum_go/internal/metrics"
+)
+
+// counterServer повторяет семантику repo.Set для счетчиков
+type counterServer struct {
+	values map[string]int64
+	down   bool
+	mtx    sync.Mutex
+}
+
+func (c *counterServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+
+	if c.down {
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	ms, err := metrics.ArrFromJSON(r.Body)
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+
+	for _, m := range ms {
+		if m.Type() != metrics.CounterType {
+			continue
+		}
+		if m.IsCumulative() {
+			c.values[m.Name()] = m.Int64Value()
+		} else {
+			c.values[m.Name()] += m.Int64Value()
+		}
+	}
+}
+
+func (c *counterServer) setDown(down bool) {
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+	c.down = down
+}
+
+func (c *counterServer) value(name string) int64 {
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+	return c.values[name]
+}
+
+func Test_counterTracker_pending(t *testing.T) {
+	tests := []struct {
+		name string
+		mode string
+		want []string
+	}{
+		{
+			name: "delta",
+			mode: CounterModeDelta,
+			want: []string{
+				"{\"id\":\"Jobs\",\"type\":\"counter\",\"delta\":2}",
+			},
+		},
+		{
+			name: "cumulative",
+			mode: CounterModeCumulative,
+			want: []string{
+				"{\"id\":\"Jobs\",\"type\":\"counter\",\"delta\":5,\"cumulative\":true}",
+				"{\"id\":\"PollCount\",\"type\":\"counter\",\"delta\":10,\"cumulative\":true}",
+			},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c := newCounterTracker(tt.mode)
+			c.add("PollCount", 10)
+			c.add("Jobs", 3)
+			_, sent := c.pending()
+			require.NoError(t, c.ack(sent))
+			c.add("Jobs", 2)
+
+			ms, _ := c.pending()
+			var got []string
+			for _, m := range ms {
+				got = append(got, string(m.ToJSON()))
+			}
+			assert.Equal(t, tt.want, got)
+		})
+	}
+}
+
+func Test_stats_flush_counters(t *testing.T) {
+	for _, mode := range []string{CounterModeDelta, CounterModeCumulative} {
+		t.Run(mode, func(t *testing.T) {
+			srv := &counterServer{values: map[string]int64{}}
+			ts := newTestServer(srv)
+			defer ts.Close()
+
+			stateFile := filepath.Join(t.TempDir(), "counters.json")
+			cfg := config.NewAgentConfig()
+			cfg.Address = strings.TrimPrefix(ts.URL, "http://")
+			cfg.CounterMode = mode
+			newAgent := func() *stats {
+				s := newStats(cfg, config.TestLogger())
+				s.collectors = nil
+				require.NoError(t, s.counters.load(stateFile))
+				return s
+			}
+			c := resty.New()
+
+			s := newAgent()
+			s.counters.add("Jobs", 3)
+			s.flush(context.Background(), c)
+			assert.Equal(t, int64(3), srv.value("Jobs"))
+
+			// повторная отправка без новых данных ничего не добавляет
+			s.flush(context.Background(), c)
+			assert.Equal(t, int64(3), srv.value("Jobs"))
+
+			// ошибки: приращения копятся и уходят одним батчем
+			srv.setDown(true)
+			s.counters.add("Jobs", 2)
+			s.flush(context.Background(), c)
+			s.counters.add("Jobs", 1)
+			s.flush(context.Background(), c)
+			assert.Equal(t, int64(3), srv.value("Jobs"))
+
+			srv.setDown(false)
+			s.flush(context.Background(), c)
+			assert.Equal(t, int64(6), srv.value("Jobs"))
+
+			// перезапуск с неподтвержденными данными
+			srv.setDown(true)
+			s.counters.add("Jobs", 4)
+			s.flush(context.Background(), c)
+
+			s = newAgent()
+			srv.setDown(false)
+			s.counters.add("Jobs", 1)
+			s.flush(context.Background(), c)
+			assert.Equal(t, int64(11), srv.value("Jobs"))
+		})
+	}
+}
@@ -0,0 +1,102 @@
+package agent
+
+import (
+	"bytes"
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"encoding/pem"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+
+	"github.com/go-resty/resty/v2"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/fedoroko/practicum_go/internal/config"
+	"github.com/fedoroko/practicum_go/internal/encryption"
+	"github.com/fedoroko/practicum_go/internal/metrics"
+)
+
+func Test_stats_encrypt(t *testing.T) {
+	k, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.NoError(t, err)
+	dir := t.TempDir()
+	pub, err := x509.MarshalPKIXPublicKey(&k.PublicKey)
+	require.NoError(t, err)
+	priv, err := x509.MarshalECPrivateKey(k)
+	require.NoError(t, err)
+	pubPath, privPath := filepath.Join(dir, "pub.pem"), filepath.Join(dir, "priv.pem")
+	require.NoError(t, os.WriteFile(pubPath, pem.EncodeToMemory(&pem.Block{Type: "PUBLIC KEY", Bytes: pub}), 0600))
+	require.NoError(t, os.WriteFile(privPath, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: priv}), 0600))
+
+	d, err := encryption.NewDecrypter(privPath)
+	require.NoError(t, err)
+
+	var (
+		mtx      sync.Mutex
+		attempts int
+		got      map[string]string
+	)
+	// расшифровка идет раньше распаковки, как на сервере
+	srv := newTestServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ms, err := metrics.ArrFromJSON(r.Body)
+		require.NoError(t, err)
+		mtx.Lock()
+		defer mtx.Unlock()
+		got = batchValues(ms)
+	}))
+	defer srv.Close()
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mtx.Lock()
+		attempts++
+		first := attempts == 1
+		mtx.Unlock()
+		// первая попытка падает, повтор не должен шифровать тело второй раз
+		if first {
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+
+		data, err := io.ReadAll(r.Body)
+		require.NoError(t, err)
+		plain, err := d.Decrypt(r.Header.Get(encryption.Header), data)
+		if err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+
+		req, err := http.NewRequest(http.MethodPost, srv.URL+r.URL.Path, bytes.NewReader(plain))
+		require.NoError(t, err)
+		req.Header.Set("Content-Encoding", r.Header.Get("Content-Encoding"))
+		resp, err := http.DefaultClient.Do(req)
+		require.NoError(t, err)
+		resp.Body.Close()
+		w.WriteHeader(resp.StatusCode)
+	}))
+	defer ts.Close()
+
+	cfg := config.NewAgentConfig()
+	cfg.Address = ts.Listener.Addr().String()
+	s := newStats(cfg, config.TestLogger())
+	s.encrypter, err = encryption.NewEncrypter(pubPath)
+	require.NoError(t, err)
+
+	c := resty.New().
+		SetRetryCount(1).
+		AddRetryCondition(func(r *resty.Response, err error) bool {
+			return r.StatusCode() == http.StatusInternalServerError
+		})
+	s.encrypt(c)
+
+	require.True(t, s.report(context.Background(), c, testBatch(1, 1)))
+	assert.Equal(t, 2, attempts)
+	assert.Equal(t, map[string]string{"PollCount": "1", "Alloc": "1"}, got)
+}
@@ -0,0 +1,224 @@
+package agent
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/go-resty/resty/v2"
+
+	"github.com/fedoroko/practicum_go/internal/config"
+	"github.com/fedoroko/practicum_go/internal/metrics"
+)
+
+const (
+	EndpointModeFailover = "failover"
+	EndpointModeFanout   = "fanout"
+)
+
+// endpointBacklog - сколько батчей копится для недоступного сервера в режиме fanout
+const endpointBacklog = 100
+
+type sendFunc func(addr string, ms []metrics.Metric) error
+
+// parseAddresses разбирает список серверов вида "host:port,host:port"
+func parseAddresses(s string) []string {
+	var ret []string
+	for _, a := range strings.Split(s, ",") {
+		if a = strings.TrimSpace(a); a != "" {
+			ret = append(ret, a)
+		}
+	}
+
+	return ret
+}
+
+// endpoint хранит батчи, которые не дошли до сервера в режиме fanout,
+// они досылаются перед следующим батчем
+type endpoint struct {
+	addr    string
+	backlog [][]metrics.Metric
+	mtx     sync.Mutex
+	logger  *config.Logger
+}
+
+// deliver досылает накопленные батчи и отправляет новый.
+// Отклоненный сервером батч из очереди отбрасывается, чтобы не держать остальные.
+func (e *endpoint) deliver(ms []metrics.Metric, send sendFunc) error {
+	e.mtx.Lock()
+	backlog := e.backlog
+	e.backlog = nil
+	e.mtx.Unlock()
+
+	for i, b := range backlog {
+		err := send(e.addr, b)
+		if errors.Is(err, errRejected) {
+			e.logger.Error().Err(err).Str("endpoint", e.addr).Int("metrics", len(b)).Msg("postponed batch rejected, dropped")
+			continue
+		}
+		if err != nil {
+			e.mtx.Lock()
+			e.backlog = append(backlog[i:], e.backlog...)
+			e.mtx.Unlock()
+			return err
+		}
+	}
+
+	return send(e.addr, ms)
+}
+
+// push откладывает батч, при переполнении самый старый батч
+// вытесняется, а его счетчики переходят в следующий
+func (e *endpoint) push(ms []metrics.Metric) {
+	e.mtx.Lock()
+	defer e.mtx.Unlock()
+
+	e.backlog = append(e.backlog, ms)
+	if len(e.backlog) > endpointBacklog {
+		e.backlog[1] = mergeCounters(e.backlog[1], e.backlog[0])
+		e.backlog = e.backlog[1:]
+	}
+}
+
+func (e *endpoint) len() int {
+	e.mtx.Lock()
+	defer e.mtx.Unlock()
+	return len(e.backlog)
+}
+
+// endpoints распределяет отправку между серверами.
+// failover: батч уходит первому живому серверу по порядку списка,
+// более приоритетные серверы раз в probeEvery проверяются через /ping.
+// fanout: батч уходит всем серверам; если хотя бы один принял,
+// для остальных он откладывается и досылается позже.
+type endpoints struct {
+	mode       string
+	list       []*endpoint
+	active     int
+	probe      *resty.Client
+	probeEvery time.Duration
+	probedAt   time.Time
+	mtx        sync.Mutex
+	cfg        *config.AgentConfig
+	logger     *config.Logger
+}
+
+func newEndpoints(cfg *config.AgentConfig, logger *config.Logger) *endpoints {
+	e := &endpoints{
+		mode: cfg.EndpointMode,
+		// у основного клиента долгие ретраи, проверка должна быть быстрой
+		probe:      resty.New().SetTimeout(time.Second * 5),
+		probeEvery: cfg.ReportInterval,
+		mtx:        sync.Mutex{},
+		cfg:        cfg,
+		logger:     logger,
+	}
+	for _, a := range parseAddresses(cfg.Address) {
+		e.list = append(e.list, &endpoint{addr: a, logger: logger})
+	}
+
+	return e
+}
+
+func (e *endpoints) send(ctx context.Context, ms []metrics.Metric, send sendFunc) error {
+	if e.mode == EndpointModeFanout {
+		return e.fanout(ms, send)
+	}
+	return e.failover(ctx, ms, send)
+}
+
+func (e *endpoints) failover(ctx context.Context, ms []metrics.Metric, send sendFunc) error {
+	e.switchBack(ctx)
+
+	e.mtx.Lock()
+	start := e.active
+	e.mtx.Unlock()
+
+	var err error
+	for i := range e.list {
+		idx := (start + i) % len(e.list)
+		addr := e.list[idx].addr
+		if err = send(addr, ms); err == nil {
+			e.setActive(idx)
+			return nil
+		}
+		e.logger.Warn().Err(err).Str("endpoint", addr).Msg("endpoint failed")
+	}
+
+	return err
+}
+
+// switchBack возвращается на более приоритетный сервер, если он ожил
+func (e *endpoints) switchBack(ctx context.Context) {
+	e.mtx.Lock()
+	active := e.active
+	due := time.Since(e.probedAt) >= e.probeEvery
+	if active == 0 || !due {
+		e.mtx.Unlock()
+		return
+	}
+	e.probedAt = time.Now()
+	e.mtx.Unlock()
+
+	for i := 0; i < active; i++ {
+		if e.ping(ctx, e.list[i].addr) {
+			e.setActive(i)
+			return
+		}
+	}
+}
+
+func (e *endpoints) ping(ctx context.Context, addr string) bool {
+	resp, err := e.probe.R().SetContext(ctx).Get(baseURL(e.cfg, addr) + "/ping")
+	return err == nil && resp.StatusCode() == http.StatusOK
+}
+
+func (e *endpoints) setActive(idx int) {
+	e.mtx.Lock()
+	defer e.mtx.Unlock()
+
+	if e.active != idx {
+		e.logger.Info().Str("endpoint", e.list[idx].addr).Msg("switched endpoint")
+		e.active = idx
+		e.probedAt = time.Now()
+	}
+}
+
+// fanout отправляет серверам по очереди, чтобы RATE_LIMIT
+// ограничивал и общее число запросов
+func (e *endpoints) fanout(ms []metrics.Metric, send sendFunc) error {
+	errs := make([]error, len(e.list))
+	delivered := false
+	for i, ep := range e.list {
+		if errs[i] = ep.deliver(ms, send); errs[i] == nil {
+			delivered = true
+		}
+	}
+
+	if !delivered {
+		// батч отбрасывается, только если его отклонили все серверы
+		for _, err := range errs {
+			if !errors.Is(err, errRejected) {
+				return err
+			}
+		}
+		return errs[0]
+	}
+
+	for i, err := range errs {
+		if errors.Is(err, errRejected) {
+			e.logger.Error().Err(err).Str("endpoint", e.list[i].addr).Msg("batch rejected, dropped")
+			continue
+		}
+		if err != nil {
+			e.logger.Warn().Err(err).Str("endpoint", e.list[i].addr).Msg("batch postponed")
+			// у каждой очереди своя копия: вытеснение склеивает счетчики
+			e.list[i].push(copyBatch(ms))
+		}
+	}
+
+	return nil
+}
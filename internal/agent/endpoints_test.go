@@ -0,0 +1,300 @@
+package agent
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/go-resty/resty/v2"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/fedoroko/practicum_go/internal/config"
+	"github.com/fedoroko/practicum_go/internal/metrics"
+)
+
+// fakeServer принимает батчи на /updates и отвечает на /ping,
+// пока не переведен в down
+type fakeServer struct {
+	*httptest.Server
+	batches []map[string]string
+	down    bool
+	reject  bool
+	mtx     sync.Mutex
+}
+
+func newFakeServer(t *testing.T) *fakeServer {
+	f := &fakeServer{}
+	f.Server = newTestServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		f.mtx.Lock()
+		defer f.mtx.Unlock()
+		if f.down {
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+		if r.URL.Path == "/ping" {
+			return
+		}
+		if f.reject {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		ms, err := metrics.ArrFromJSON(r.Body)
+		if err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		f.batches = append(f.batches, batchValues(ms))
+	}))
+	t.Cleanup(f.Close)
+
+	return f
+}
+
+func (f *fakeServer) addr() string {
+	return strings.TrimPrefix(f.URL, "http://")
+}
+
+func (f *fakeServer) setDown(down bool) {
+	f.mtx.Lock()
+	defer f.mtx.Unlock()
+	f.down = down
+}
+
+func (f *fakeServer) setReject(reject bool) {
+	f.mtx.Lock()
+	defer f.mtx.Unlock()
+	f.reject = reject
+}
+
+func (f *fakeServer) received() []map[string]string {
+	f.mtx.Lock()
+	defer f.mtx.Unlock()
+	return f.batches
+}
+
+func newTestEndpoints(mode string, servers ...*fakeServer) (*endpoints, sendFunc) {
+	cfg := config.NewAgentConfig()
+	cfg.EndpointMode = mode
+	cfg.ReportInterval = 0
+	var addrs []string
+	for _, s := range servers {
+		addrs = append(addrs, s.addr())
+	}
+	cfg.Address = strings.Join(addrs, ", ")
+
+	c := resty.New()
+	send := func(addr string, ms []metrics.Metric) error {
+		return batchRequest(context.Background(), c, cfg, addr, config.TestLogger(), ms)
+	}
+
+	return newEndpoints(cfg, config.TestLogger()), send
+}
+
+func Test_parseAddresses(t *testing.T) {
+	tests := []struct {
+		name string
+		s    string
+		want []string
+	}{
+		{
+			name: "single",
+			s:    "127.0.0.1:8080",
+			want: []string{"127.0.0.1:8080"},
+		},
+		{
+			name: "list",
+			s:    "a:1, b:2,,c:3 ",
+			want: []string{"a:1", "b:2", "c:3"},
+		},
+		{
+			name: "empty",
+			s:    " ",
+			want: nil,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			assert.Equal(t, tt.want, parseAddresses(tt.s))
+		})
+	}
+}
+
+func Test_endpoints_failover(t *testing.T) {
+	primary, secondary := newFakeServer(t), newFakeServer(t)
+	e, send := newTestEndpoints(EndpointModeFailover, primary, secondary)
+
+	require.NoError(t, e.send(context.Background(), testBatch(1, 1), send))
+
+	primary.setDown(true)
+	require.NoError(t, e.send(context.Background(), testBatch(2, 2), send))
+	require.NoError(t, e.send(context.Background(), testBatch(3, 3), send))
+
+	// основной сервер ожил, агент возвращается на него после /ping
+	primary.setDown(false)
+	require.NoError(t, e.send(context.Background(), testBatch(4, 4), send))
+
+	assert.Equal(t, []map[string]string{
+		{"PollCount": "1", "Alloc": "1"},
+		{"PollCount": "4", "Alloc": "4"},
+	}, primary.received())
+	assert.Equal(t, []map[string]string{
+		{"PollCount": "2", "Alloc": "2"},
+		{"PollCount": "3", "Alloc": "3"},
+	}, secondary.received())
+
+	primary.setDown(true)
+	secondary.setDown(true)
+	assert.Error(t, e.send(context.Background(), testBatch(5, 5), send))
+}
+
+func Test_endpoints_failover_probe_interval(t *testing.T) {
+	primary, secondary := newFakeServer(t), newFakeServer(t)
+	e, send := newTestEndpoints(EndpointModeFailover, primary, secondary)
+	e.probeEvery = time.Hour
+
+	primary.setDown(true)
+	require.NoError(t, e.send(context.Background(), testBatch(1, 1), send))
+	primary.setDown(false)
+	require.NoError(t, e.send(context.Background(), testBatch(2, 2), send))
+
+	// до следующей проверки агент остается на резервном сервере
+	assert.Empty(t, primary.received())
+	assert.Len(t, secondary.received(), 2)
+}
+
+func Test_endpoints_fanout(t *testing.T) {
+	first, second := newFakeServer(t), newFakeServer(t)
+	e, send := newTestEndpoints(EndpointModeFanout, first, second)
+
+	second.setDown(true)
+	require.NoError(t, e.send(context.Background(), testBatch(1, 1), send))
+	require.NoError(t, e.send(context.Background(), testBatch(2, 2), send))
+	assert.Equal(t, 2, e.list[1].len())
+
+	// никто не принял - батч остается на совести вызывающего
+	first.setDown(true)
+	assert.Error(t, e.send(context.Background(), testBatch(3, 3), send))
+	assert.Equal(t, 2, e.list[1].len())
+
+	first.setDown(false)
+	second.setDown(false)
+	require.NoError(t, e.send(context.Background(), testBatch(4, 4), send))
+
+	assert.Equal(t, []map[string]string{
+		{"PollCount": "1", "Alloc": "1"},
+		{"PollCount": "2", "Alloc": "2"},
+		{"PollCount": "4", "Alloc": "4"},
+	}, first.received())
+	assert.Equal(t, first.received(), second.received())
+	assert.Equal(t, 0, e.list[1].len())
+}
+
+// отклоненный батч не откладывается и не держит очередь сервера
+func Test_endpoints_fanout_rejected(t *testing.T) {
+	first, second := newFakeServer(t), newFakeServer(t)
+	e, send := newTestEndpoints(EndpointModeFanout, first, second)
+
+	second.setDown(true)
+	require.NoError(t, e.send(context.Background(), testBatch(1, 1), send))
+	assert.Equal(t, 1, e.list[1].len())
+
+	second.setDown(false)
+	second.setReject(true)
+	require.NoError(t, e.send(context.Background(), testBatch(2, 2), send))
+	assert.Equal(t, 0, e.list[1].len())
+
+	// отклонили все - батч отбрасывается вызывающим
+	first.setReject(true)
+	assert.ErrorIs(t, e.send(context.Background(), testBatch(3, 3), send), errRejected)
+
+	first.setReject(false)
+	second.setReject(false)
+	require.NoError(t, e.send(context.Background(), testBatch(4, 4), send))
+	assert.Equal(t, []map[string]string{
+		{"PollCount": "1", "Alloc": "1"},
+		{"PollCount": "2", "Alloc": "2"},
+		{"PollCount": "4", "Alloc": "4"},
+	}, first.received())
+	assert.Equal(t, []map[string]string{
+		{"PollCount": "4", "Alloc": "4"},
+	}, second.received())
+}
+
+func Test_endpoint_push_overflow(t *testing.T) {
+	e := &endpoint{addr: "127.0.0.1:1"}
+	for i := 1; i <= endpointBacklog+2; i++ {
+		e.push(testBatch(1, float64(i)))
+	}
+
+	require.Equal(t, endpointBacklog, e.len())
+	assert.Equal(t, map[string]string{"PollCount": "3", "Alloc": "3"}, batchValues(e.backlog[0]))
+	assert.Equal(t, map[string]string{"PollCount": "1", "Alloc": "4"}, batchValues(e.backlog[1]))
+}
+
+// Отложенные батчи разных серверов не должны делить метрики:
+// вытеснение в одной очереди не меняет остальные
+func Test_endpoints_fanout_overflow(t *testing.T) {
+	servers := []*fakeServer{newFakeServer(t), newFakeServer(t), newFakeServer(t), newFakeServer(t)}
+	e, send := newTestEndpoints(EndpointModeFanout, servers...)
+
+	for _, s := range servers[1:] {
+		s.setDown(true)
+	}
+	for i := 1; i <= endpointBacklog+1; i++ {
+		require.NoError(t, e.send(context.Background(), testBatch(1, float64(i)), send))
+	}
+
+	for _, ep := range e.list[1:] {
+		require.Equal(t, endpointBacklog, ep.len())
+		assert.Equal(t, map[string]string{"PollCount": "2", "Alloc": "2"}, batchValues(ep.backlog[0]))
+		assert.Equal(t, map[string]string{"PollCount": "1", "Alloc": "3"}, batchValues(ep.backlog[1]))
+	}
+	assert.NotSame(t, e.list[1].backlog[1][0], e.list[2].backlog[1][0])
+}
+
+func Test_mergeCounters(t *testing.T) {
+	counter := func(name string, v int64, cumulative bool) metrics.Metric {
+		m := metrics.NewOmitEmpty(name, metrics.CounterType, nil, metrics.PointerFromInt64(v))
+		m.SetCumulative(cumulative)
+		return m
+	}
+
+	tests := []struct {
+		name string
+		dst  []metrics.Metric
+		src  []metrics.Metric
+		want map[string]string
+	}{
+		{
+			name: "delta",
+			dst:  []metrics.Metric{counter("Jobs", 2, false)},
+			src:  []metrics.Metric{counter("Jobs", 3, false), counter("Errors", 1, false)},
+			want: map[string]string{"Jobs": "5", "Errors": "1"},
+		},
+		{
+			name: "cumulative",
+			dst:  []metrics.Metric{counter("Jobs", 5, true)},
+			src:  []metrics.Metric{counter("Jobs", 3, true), counter("Errors", 1, true)},
+			want: map[string]string{"Jobs": "5", "Errors": "1"},
+		},
+		{
+			name: "gauges dropped",
+			dst:  testBatch(1, 2),
+			src:  testBatch(1, 1),
+			want: map[string]string{"PollCount": "2", "Alloc": "2"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			dst, src := batchValues(tt.dst), batchValues(tt.src)
+			assert.Equal(t, tt.want, batchValues(mergeCounters(tt.dst, tt.src)))
+			assert.Equal(t, dst, batchValues(tt.dst), "dst is not modified")
+			assert.Equal(t, src, batchValues(tt.src), "src is not modified")
+		})
+	}
+}
@@ -0,0 +1,273 @@
+package agent
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"os/exec"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/fedoroko/practicum_go/internal/config"
+	"github.com/fedoroko/practicum_go/internal/metrics"
+)
+
+// execCollector периодически запускает внешние команды
+// и превращает их stdout в метрики.
+// Поддерживаются два формата строк:
+//
+//	name type value                       - например "QueueSize gauge 12"
+//	measurement[,tags] field=value [ts]   - InfluxDB line protocol
+//
+// Значения counter считаются дельтами и отдаются агенту один раз.
+type execCollector struct {
+	commands []string
+	interval time.Duration
+	timeout  time.Duration
+	pending  *pendingMetrics
+	logger   *config.Logger
+}
+
+func newExecCollector(cfg *config.AgentConfig, logger *config.Logger) *execCollector {
+	subLogger := logger.With().Str("Component", "EXEC").Logger()
+	return &execCollector{
+		commands: cfg.ExecCommands,
+		interval: cfg.ExecInterval,
+		timeout:  cfg.ExecTimeout,
+		pending:  newPendingMetrics(),
+		logger:   config.NewLogger(&subLogger),
+	}
+}
+
+func (e *execCollector) listen(done <-chan struct{}) {
+	e.run()
+
+	t := time.NewTicker(e.interval)
+	defer t.Stop()
+	for {
+		select {
+		case <-done:
+			return
+		case <-t.C:
+			e.run()
+		}
+	}
+}
+
+func (e *execCollector) run() {
+	for _, c := range e.commands {
+		out, err := e.exec(c)
+		if err != nil {
+			e.logger.Error().Err(err).Str("command", c).Msg("")
+			continue
+		}
+
+		ms, err := parseExecOutput(bytes.NewReader(out))
+		if err != nil {
+			e.logger.Error().Err(err).Str("command", c).Msg("")
+		}
+		e.pending.add(ms)
+	}
+}
+
+func (e *execCollector) exec(command string) ([]byte, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), e.timeout)
+	defer cancel()
+
+	cmd := exec.Command("sh", "-c", command)
+	// своя группа процессов, чтобы по таймауту убить и потомков оболочки
+	setProcessGroup(cmd)
+	stdout, err := cmd.StdoutPipe()
+	if err != nil {
+		return nil, err
+	}
+	if err = cmd.Start(); err != nil {
+		return nil, err
+	}
+
+	// чтение и Wait в одной горутине, чтобы таймаут ограничивал оба:
+	// команда может закрыть stdout и продолжить работу
+	type result struct {
+		out []byte
+		err error
+	}
+	done := make(chan result, 1)
+	go func() {
+		out, err := io.ReadAll(stdout)
+		if werr := cmd.Wait(); werr != nil {
+			err = werr
+		}
+		done <- result{out, err}
+	}()
+
+	select {
+	case r := <-done:
+		if r.err != nil {
+			return nil, r.err
+		}
+		return r.out, nil
+	case <-ctx.Done():
+		if err = killProcessGroup(cmd); err != nil {
+			e.logger.Error().Err(err).Str("command", command).Msg("kill failed")
+		}
+		// потомок, ушедший из группы, может держать pipe открытым:
+		// закрытие прерывает чтение, и горутина завершится после Wait
+		stdout.Close()
+		<-done
+		return nil, fmt.Errorf("timeout %s exceeded", e.timeout)
+	}
+}
+
+func (e *execCollector) collect(metricsCh chan<- []metrics.Metric) {
+	e.pending.collect(metricsCh)
+}
+
+// parseExecOutput разбирает вывод команды построчно.
+// Ошибочные строки пропускаются, первая ошибка возвращается вместе с
+// успешно разобранными метриками.
+func parseExecOutput(r io.Reader) ([]metrics.Metric, error) {
+	var (
+		ret      []metrics.Metric
+		firstErr error
+	)
+
+	scanner := bufio.NewScanner(r)
+	for n := 1; scanner.Scan(); n++ {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+
+		ms, err := parseExecLine(line)
+		if err != nil {
+			if firstErr == nil {
+				firstErr = fmt.Errorf("line %d: %w", n, err)
+			}
+			continue
+		}
+		ret = append(ret, ms...)
+	}
+
+	if err := scanner.Err(); err != nil && firstErr == nil {
+		firstErr = err
+	}
+
+	return ret, firstErr
+}
+
+func parseExecLine(line string) ([]metrics.Metric, error) {
+	fields := strings.Fields(line)
+	if len(fields) == 3 && (fields[1] == metrics.GaugeType || fields[1] == metrics.CounterType) {
+		m, err := metrics.RawWithValue(fields[1], fields[0], fields[2])
+		if err != nil {
+			return nil, err
+		}
+		return []metrics.Metric{m}, nil
+	}
+
+	return parseLineProtocol(line)
+}
+
+// parseLineProtocol поддерживает подмножество InfluxDB line protocol:
+// теги игнорируются, числовые и bool поля становятся gauge, строковые
+// пропускаются. Поле - это текущее значение, а не дельта, поэтому целые
+// (суффиксы i и u) тоже gauge; counter задается только форматом name counter N.
+// Имя метрики - measurement_field, для поля value - просто measurement.
+func parseLineProtocol(line string) ([]metrics.Metric, error) {
+	parts := splitUnescaped(line, ' ')
+	if len(parts) < 2 || len(parts) > 3 {
+		return nil, errors.New("unknown line format")
+	}
+
+	measurement := unescape(splitUnescaped(parts[0], ',')[0])
+	if measurement == "" {
+		return nil, errors.New("empty measurement")
+	}
+
+	var ret []metrics.Metric
+	for _, f := range splitUnescaped(parts[1], ',') {
+		kv := splitUnescaped(f, '=')
+		if len(kv) != 2 || kv[0] == "" || kv[1] == "" {
+			return nil, fmt.Errorf("invalid field %q", f)
+		}
+
+		name := measurement
+		if key := unescape(kv[0]); key != "value" {
+			name += "_" + key
+		}
+
+		m, err := lineProtocolValue(name, kv[1])
+		if err != nil {
+			return nil, err
+		}
+		if m != nil {
+			ret = append(ret, m)
+		}
+	}
+
+	return ret, nil
+}
+
+func lineProtocolValue(name string, v string) (metrics.Metric, error) {
+	switch {
+	case strings.HasPrefix(v, "\""):
+		return nil, nil
+	case strings.HasSuffix(v, "i"):
+		i64, err := strconv.ParseInt(v[:len(v)-1], 10, 64)
+		if err != nil {
+			return nil, err
+		}
+		return metrics.NewOmitEmpty(name, metrics.GaugeType, metrics.PointerFromFloat64(float64(i64)), nil), nil
+	case strings.HasSuffix(v, "u"):
+		u64, err := strconv.ParseUint(v[:len(v)-1], 10, 64)
+		if err != nil {
+			return nil, err
+		}
+		return metrics.NewOmitEmpty(name, metrics.GaugeType, metrics.PointerFromFloat64(float64(u64)), nil), nil
+	}
+
+	switch v {
+	case "t", "T", "true", "True", "TRUE":
+		return metrics.NewOmitEmpty(name, metrics.GaugeType, metrics.PointerFromFloat64(1), nil), nil
+	case "f", "F", "false", "False", "FALSE":
+		return metrics.NewOmitEmpty(name, metrics.GaugeType, metrics.PointerFromFloat64(0), nil), nil
+	}
+
+	f64, err := strconv.ParseFloat(v, 64)
+	if err != nil {
+		return nil, err
+	}
+	return metrics.NewOmitEmpty(name, metrics.GaugeType, &f64, nil), nil
+}
+
+// splitUnescaped делит строку по sep, пропуская экранированные
+// обратным слэшем символы и содержимое двойных кавычек
+func splitUnescaped(s string, sep byte) []string {
+	var (
+		ret    []string
+		quoted bool
+		start  int
+	)
+
+	for i := 0; i < len(s); i++ {
+		switch {
+		case s[i] == '\\':
+			i++
+		case s[i] == '"':
+			quoted = !quoted
+		case s[i] == sep && !quoted:
+			ret = append(ret, s[start:i])
+			start = i + 1
+		}
+	}
+
+	return append(ret, s[start:])
+}
+
+func unescape(s string) string {
+	return strings.NewReplacer(`\ `, " ", `\,`, ",", `\=`, "=").Replace(s)
+}
@@ -0,0 +1,120 @@
+package agent
+
+import (
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/fedoroko/practicum_go/internal/config"
+	"github.com/fedoroko/practicum_go/internal/metrics"
+)
+
+func Test_parseExecOutput(t *testing.T) {
+	tests := []struct {
+		name    string
+		input   string
+		want    []string
+		wantErr bool
+	}{
+		{
+			name:  "simple format",
+			input: "QueueSize gauge 12.5\nJobs counter 3\n",
+			want: []string{
+				"{\"id\":\"QueueSize\",\"type\":\"gauge\",\"value\":12.5}",
+				"{\"id\":\"Jobs\",\"type\":\"counter\",\"delta\":3}",
+			},
+		},
+		{
+			name:  "comments and empty lines",
+			input: "# header\n\n  Temp gauge 36.6  \n",
+			want: []string{
+				"{\"id\":\"Temp\",\"type\":\"gauge\",\"value\":36.6}",
+			},
+		},
+		{
+			name:  "line protocol",
+			input: "disk,host=a used=10.5,inodes=7i,ok=true,label=\"a b\" 1465839830100400200\nqueue value=3",
+			want: []string{
+				"{\"id\":\"disk_used\",\"type\":\"gauge\",\"value\":10.5}",
+				"{\"id\":\"disk_inodes\",\"type\":\"gauge\",\"value\":7}",
+				"{\"id\":\"disk_ok\",\"type\":\"gauge\",\"value\":1}",
+				"{\"id\":\"queue\",\"type\":\"gauge\",\"value\":3}",
+			},
+		},
+		{
+			name:  "integer fields are gauges",
+			input: "mem,host=a free=1024u,swap=-1i",
+			want: []string{
+				"{\"id\":\"mem_free\",\"type\":\"gauge\",\"value\":1024}",
+				"{\"id\":\"mem_swap\",\"type\":\"gauge\",\"value\":-1}",
+			},
+		},
+		{
+			name:  "escaped measurement",
+			input: "my\\ app,x=1 value=2",
+			want: []string{
+				"{\"id\":\"my app\",\"type\":\"gauge\",\"value\":2}",
+			},
+		},
+		{
+			name:  "bad line is skipped",
+			input: "Temp gauge none\nOk gauge 1\n",
+			want: []string{
+				"{\"id\":\"Ok\",\"type\":\"gauge\",\"value\":1}",
+			},
+			wantErr: true,
+		},
+		{
+			name:    "unknown format",
+			input:   "just some text",
+			wantErr: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := parseExecOutput(strings.NewReader(tt.input))
+			if tt.wantErr {
+				assert.Error(t, err)
+			} else {
+				assert.NoError(t, err)
+			}
+
+			var gotJSON []string
+			for _, m := range got {
+				gotJSON = append(gotJSON, string(m.ToJSON()))
+			}
+			assert.Equal(t, tt.want, gotJSON)
+		})
+	}
+}
+
+func Test_execCollector(t *testing.T) {
+	cfg := config.NewAgentConfig()
+	cfg.ExecTimeout = time.Millisecond * 200
+	cfg.ExecCommands = []string{
+		"echo 'Temp gauge 1'; echo 'Jobs counter 2'",
+		"echo 'Jobs counter 3'",
+		"sleep 2; echo 'Slow gauge 1'",
+	}
+	e := newExecCollector(cfg, config.TestLogger())
+
+	e.run()
+	metricsCh := make(chan []metrics.Metric, 1)
+	e.collect(metricsCh)
+	got := <-metricsCh
+	require.Len(t, got, 2)
+
+	values := map[string]string{}
+	for _, m := range got {
+		values[m.Name()] = m.ToString()
+	}
+	assert.Equal(t, map[string]string{"Temp": "1", "Jobs": "5"}, values)
+
+	e.collect(metricsCh)
+	got = <-metricsCh
+	require.Len(t, got, 1, "counters must be sent only once")
+	assert.Equal(t, "Temp", got[0].Name())
+}
@@ -0,0 +1,58 @@
+//go:build !windows
+// +build !windows
+
+package agent
+
+import (
+	"os"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/fedoroko/practicum_go/internal/config"
+)
+
+// по таймауту убивается вся группа, а не только оболочка
+func Test_execCollector_timeoutKillsGroup(t *testing.T) {
+	pidFile := t.TempDir() + "/pid"
+	cfg := config.NewAgentConfig()
+	cfg.ExecTimeout = time.Millisecond * 200
+	e := newExecCollector(cfg, config.TestLogger())
+
+	start := time.Now()
+	_, err := e.exec("sleep 5 & echo $! > " + pidFile + "; wait")
+	require.Error(t, err)
+	assert.Less(t, time.Since(start), 2*time.Second)
+
+	raw, err := os.ReadFile(pidFile)
+	require.NoError(t, err)
+	pid := strings.TrimSpace(string(raw))
+	_, err = strconv.Atoi(pid)
+	require.NoError(t, err)
+
+	// осиротевший процесс может остаться зомби, пока его не подберет init
+	assert.Eventually(t, func() bool {
+		stat, err := os.ReadFile("/proc/" + pid + "/stat")
+		if err != nil {
+			return true
+		}
+		fields := strings.Fields(string(stat))
+		return len(fields) > 2 && fields[2] == "Z"
+	}, time.Second, 10*time.Millisecond)
+}
+
+// команда закрыла stdout, но не завершилась: Wait тоже ограничен таймаутом
+func Test_execCollector_timeoutAfterEOF(t *testing.T) {
+	cfg := config.NewAgentConfig()
+	cfg.ExecTimeout = time.Millisecond * 200
+	e := newExecCollector(cfg, config.TestLogger())
+
+	start := time.Now()
+	_, err := e.exec("echo 'Temp gauge 1'; exec >&-; sleep 5")
+	assert.Error(t, err)
+	assert.Less(t, time.Since(start), 2*time.Second)
+}
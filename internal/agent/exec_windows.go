@@ -0,0 +1,10 @@
+package agent
+
+import "os/exec"
+
+// на Windows групп процессов нет, убивается только оболочка
+func setProcessGroup(_ *exec.Cmd) {}
+
+func killProcessGroup(cmd *exec.Cmd) error {
+	return cmd.Process.Kill()
+}
@@ -2,6 +2,10 @@ package agent
 
 import (
 	"bytes"
+	"context"
+	crand "crypto/rand"
+	"crypto/tls"
+	"encoding/hex"
 	"encoding/json"
 	"errors"
 	"fmt"
@@ -12,6 +16,7 @@ import (
 	"time"
 
 	"github.com/fedoroko/practicum_go/internal/config"
+	"github.com/fedoroko/practicum_go/internal/encryption"
 	"github.com/fedoroko/practicum_go/internal/metrics"
 
 	"github.com/go-resty/resty/v2"
@@ -19,28 +24,114 @@ import (
 	"github.com/shirou/gopsutil/v3/mem"
 )
 
+// collector отдает в канал ровно одну порцию метрик за вызов
+type collector func(metricsCh chan<- []metrics.Metric)
+
+// pendingMetrics копит значения фоновых коллекторов между опросами:
+// для gauge хранится последнее значение, для counter - сумма дельт,
+// которая отдается один раз и обнуляется
+type pendingMetrics struct {
+	gauges   map[string]float64
+	counters map[string]int64
+	mtx      sync.Mutex
+}
+
+func newPendingMetrics() *pendingMetrics {
+	return &pendingMetrics{
+		gauges:   make(map[string]float64),
+		counters: make(map[string]int64),
+		mtx:      sync.Mutex{},
+	}
+}
+
+func (p *pendingMetrics) setGauge(name string, v float64) {
+	p.mtx.Lock()
+	defer p.mtx.Unlock()
+	p.gauges[name] = v
+}
+
+func (p *pendingMetrics) addCounter(name string, d int64) {
+	p.mtx.Lock()
+	defer p.mtx.Unlock()
+	p.counters[name] += d
+}
+
+func (p *pendingMetrics) add(ms []metrics.Metric) {
+	for _, m := range ms {
+		switch m.Type() {
+		case metrics.GaugeType:
+			p.setGauge(m.Name(), m.Float64Value())
+		case metrics.CounterType:
+			p.addCounter(m.Name(), m.Int64Value())
+		}
+	}
+}
+
+func (p *pendingMetrics) collect(metricsCh chan<- []metrics.Metric) {
+	p.mtx.Lock()
+	defer p.mtx.Unlock()
+
+	ms := make([]metrics.Metric, 0, len(p.gauges)+len(p.counters))
+	for n, v := range p.gauges {
+		ms = append(ms, metrics.NewOmitEmpty(
+			n,
+			metrics.GaugeType,
+			metrics.PointerFromFloat64(v),
+			nil,
+		))
+	}
+
+	for n, d := range p.counters {
+		ms = append(ms, metrics.NewOmitEmpty(
+			n,
+			metrics.CounterType,
+			nil,
+			metrics.PointerFromInt64(d),
+		))
+	}
+	p.counters = make(map[string]int64)
+
+	metricsCh <- ms
+}
+
+// stats копит gauge за окно отправки в gauges, а все counter
+// (PollCount и дельты коллекторов) - в counters до подтверждения сервером
 type stats struct {
-	metrics []metrics.Metric
-	count   int64
-	mtx     sync.RWMutex
-	done    chan struct{}
-	cfg     *config.AgentConfig
-	logger  *config.Logger
+	gauges     *aggregator
+	counters   *counterTracker
+	collectors []collector
+	queue      *diskQueue
+	endpoints  *endpoints
+	encrypter  *encryption.Encrypter
+	tls        *tls.Config
+	realIP     *realIP
+	pool       *workerPool
+	inflight   chan struct{}
+	done       chan struct{}
+	cfg        *config.AgentConfig
+	logger     *config.Logger
 }
 
 func newStats(cfg *config.AgentConfig, logger *config.Logger) *stats {
-	return &stats{
-		metrics: []metrics.Metric{},
-		count:   0,
-		mtx:     sync.RWMutex{},
-		done:    make(chan struct{}),
-		cfg:     cfg,
-		logger:  logger,
+	// ReadMemStats останавливает мир, с RuntimeMetrics те же имена
+	// собираются из runtime/metrics
+	basic := collector(getBasicMetrics)
+	if cfg.RuntimeMetrics {
+		basic = newRuntimeCollector(cfg, logger).collect
 	}
-}
 
-func (s *stats) updateCounter() {
-	s.count += int64(len(s.metrics))
+	return &stats{
+		gauges:     newAggregator(),
+		counters:   newCounterTracker(cfg.CounterMode),
+		collectors: []collector{basic, getAdvancedMetrics},
+		endpoints:  newEndpoints(cfg, logger),
+		realIP:     newRealIP(logger),
+		pool:       newWorkerPool(cfg.RateLimit),
+		inflight:   make(chan struct{}, 1),
+		done:       make(chan struct{}),
+		cfg:        cfg,
+		logger:     logger,
+	}
 }
 
 //сначала хотел использовать fan-in fan-out,
@@ -50,37 +141,50 @@ func (s *stats) collect() {
 	pollTicker := time.NewTicker(s.cfg.PollInterval)
 	defer pollTicker.Stop()
 
-	for range pollTicker.C {
-		s.getMetrics()
+	for {
+		select {
+		case <-s.done:
+			return
+		case <-pollTicker.C:
+			s.getMetrics()
+		}
 	}
 }
 
 //тут могу использовать for-select,
-//но ожидаю ровно два значения в канале,
+//но ожидаю ровно по одному значению от каждого коллектора,
 //поэтому for-select кажется избыточным
 
 func (s *stats) getMetrics() {
 	metricsCh := make(chan []metrics.Metric)
 	defer close(metricsCh)
-	go getBasicMetrics(metricsCh)
-	go getAdvancedMetrics(metricsCh)
+	for _, c := range s.collectors {
+		go c(metricsCh)
+	}
 
 	ms := make([]metrics.Metric, 0)
-	for i := 0; i < 2; i++ {
+	for i := 0; i < len(s.collectors); i++ {
 		m := <-metricsCh
 		ms = append(ms, m...)
 	}
-	s.metrics = ms
 
-	s.updateCounter()
-	s.metrics = append(
-		s.metrics, metrics.NewOmitEmpty(
-			"PollCount",
-			"counter",
-			nil,
-			metrics.PointerFromInt64(s.count),
-		),
-	)
+	gauges := make([]metrics.Metric, 0, len(ms))
+	for _, m := range ms {
+		if m.Type() == metrics.CounterType {
+			s.counters.add(m.Name(), m.Int64Value())
+			continue
+		}
+		gauges = append(gauges, m)
+	}
+	s.counters.add("PollCount", int64(len(ms)))
+	s.gauges.add(gauges)
+}
+
+// batch собирает батч к отправке: агрегаты gauge за окно
+// и неподтвержденные сервером счетчики
+func (s *stats) batch() ([]metrics.Metric, map[string]int64) {
+	counters, sent := s.counters.pending()
+	return append(s.gauges.flush(), counters...), sent
 }
 
 func getBasicMetrics(metricsCh chan<- []metrics.Metric) {
@@ -318,12 +422,15 @@ func getAdvancedMetrics(metricsCh chan<- []metrics.Metric) {
 	metricsCh <- m
 }
 
-func (s *stats) send() {
+// send отправляет метрики раз в ReportInterval. Отмена ctx прерывает
+// текущую отправку, чтобы shutdown не ждал ретраев клиента.
+func (s *stats) send(ctx context.Context) {
 	client := resty.New()
 	client.
 		SetRetryCount(3).
 		SetRetryWaitTime(20 * time.Second).
 		SetRetryMaxWaitTime(100 * time.Second)
+	s.prepare(client)
 
 	sendTicker := time.NewTicker(s.cfg.ReportInterval)
 	defer sendTicker.Stop()
@@ -332,73 +439,310 @@ func (s *stats) send() {
 		case <-s.done:
 			return
 		case <-sendTicker.C:
-			func() {
-				s.mtx.Lock()
-				defer s.mtx.Unlock()
-				if err := batchRequest(client, s.cfg, s.logger, s.metrics); err != nil {
-					s.logger.Error().Stack().Err(err).Msg("")
-				}
-			}()
+			// медленный сервер не должен копить отправки:
+			// пока предыдущая не завершилась, данные копятся в stats
+			select {
+			case s.inflight <- struct{}{}:
+				go func() {
+					defer func() { <-s.inflight }()
+					s.flush(ctx, client)
+				}()
+			default:
+				s.logger.Warn().Msg("previous report is still in progress, skipping")
+			}
+		}
+	}
+}
+
+// prepare добавляет клиенту общие для всех запросов заголовки и шифрование
+func (s *stats) prepare(c *resty.Client) {
+	if s.tls != nil {
+		c.SetTLSClientConfig(s.tls)
+	}
+	if s.cfg.Token != "" {
+		c.SetAuthToken(s.cfg.Token)
+	}
+	c.OnBeforeRequest(s.realIP.hook)
+	s.encrypt(c)
+}
+
+// encrypt шифрует тела запросов клиента открытым ключом сервера.
+// Хук вызывается на каждой попытке, заголовок защищает от повторного шифрования.
+func (s *stats) encrypt(c *resty.Client) {
+	if s.encrypter == nil {
+		return
+	}
+
+	c.OnBeforeRequest(func(_ *resty.Client, r *resty.Request) error {
+		body, ok := r.Body.([]byte)
+		if !ok || r.Header.Get(encryption.Header) != "" {
+			return nil
+		}
+
+		data, err := s.encrypter.Encrypt(body)
+		if err != nil {
+			return err
+		}
+		r.SetBody(data)
+		r.SetHeader(encryption.Header, s.encrypter.Alg())
+
+		return nil
+	})
+}
+
+// shutdown дожидается текущей отправки, снимает метрики последний раз
+// и отправляет их. Все вместе занимает не больше ShutdownInterval,
+// неподтвержденные счетчики остаются в файле состояния.
+func (s *stats) shutdown() {
+	ctx, cancel := context.WithTimeout(context.Background(), s.cfg.ShutdownInterval)
+	defer cancel()
+
+	// ретраи клиента с паузами в десятки секунд тут не уложатся в таймаут
+	client := resty.New()
+	s.prepare(client)
+
+	finished := make(chan struct{})
+	go func() {
+		defer close(finished)
+		s.inflight <- struct{}{}
+		defer func() { <-s.inflight }()
+
+		s.getMetrics()
+		s.flush(ctx, client)
+	}()
+
+	select {
+	case <-finished:
+		s.pool.stop()
+		s.logger.Info().Msg("final report done")
+	case <-ctx.Done():
+		s.logger.Warn().Dur("timeout", s.cfg.ShutdownInterval).Msg("final report timed out")
+	}
+}
+
+// flush отправляет текущий батч и подтверждает счетчики,
+// принятые сервером или сохраненные в очередь.
+// Остальные счетчики остаются неподтвержденными и уйдут со следующим батчем.
+func (s *stats) flush(ctx context.Context, c *resty.Client) {
+	ms, sent := s.batch()
+
+	var acked map[string]int64
+	if s.cfg.Batch {
+		if s.report(ctx, c, ms) {
+			acked = sent
+		}
+	} else {
+		acked = s.reportEach(ctx, c, ms, sent)
+	}
+
+	if err := s.counters.ack(acked); err != nil {
+		s.logger.Error().Stack().Err(err).Msg("counters state")
+	}
+}
+
+// reportEach отправляет метрики по одной через пул воркеров
+// и возвращает значения доставленных счетчиков
+func (s *stats) reportEach(ctx context.Context, c *resty.Client, ms []metrics.Metric, sent map[string]int64) map[string]int64 {
+	jobs := make([]func() error, len(ms))
+	for i, m := range ms {
+		m := m
+		jobs[i] = func() error {
+			return s.endpoints.send(ctx, []metrics.Metric{m}, func(addr string, ms []metrics.Metric) error {
+				return requestHandler(ctx, c, s.cfg, addr, ms[0])
+			})
 		}
 	}
+
+	acked := make(map[string]int64)
+	for i, err := range s.pool.run(jobs...) {
+		if err != nil {
+			s.logger.Error().Stack().Err(err).Str("metric", ms[i].Name()).Msg("")
+			continue
+		}
+		if v, ok := sent[ms[i].Name()]; ok && ms[i].Type() == metrics.CounterType {
+			acked[ms[i].Name()] = v
+		}
+	}
+
+	return acked
 }
 
-func requestHandler(c *resty.Client, cfg *config.AgentConfig, logger *config.Logger, m metrics.Metric) {
+// report отправляет батч, а при наличии очереди сначала досылает
+// накопленные в ней батчи; неотправленный батч попадает в очередь.
+// Отклоненный сервером батч отбрасывается, иначе он навсегда заблокирует
+// очередь, а его счетчики уйдут в следующий батч и испортят и его.
+// Возвращает false, если батч не доставлен и не сохранен.
+func (s *stats) report(ctx context.Context, c *resty.Client, ms []metrics.Metric) bool {
+	send := func(ms []metrics.Metric) error {
+		return s.pool.run(func() error {
+			return s.endpoints.send(ctx, ms, func(addr string, ms []metrics.Metric) error {
+				return batchRequest(ctx, c, s.cfg, addr, s.logger, ms)
+			})
+		})[0]
+	}
+
+	if s.queue == nil {
+		err := send(ms)
+		switch {
+		case errors.Is(err, errRejected):
+			s.reject(ms, err)
+		case err != nil:
+			s.logger.Error().Stack().Err(err).Msg("")
+			return false
+		}
+		return true
+	}
+
+	err := s.queue.replay(send, s.reject)
+	if err == nil {
+		err = send(ms)
+	}
+
+	if errors.Is(err, errRejected) {
+		s.reject(ms, err)
+		return true
+	}
+	if err != nil {
+		s.logger.Error().Stack().Err(err).Msg("")
+		if err = s.queue.push(ms); err != nil {
+			s.logger.Error().Stack().Err(err).Msg("queue push failed")
+			return false
+		}
+	}
+
+	return true
+}
+
+// errRejected - сервер отказался принять сами данные, повтор того же
+// запроса не поможет
+var errRejected = errors.New("rejected by server")
+
+// statusError отделяет отказ в данных от временных сбоев. 4xx - отказ,
+// кроме 401, 403, 408 и 429: они проходят без изменения данных.
+// 501 сервер отвечает на неизвестный тип метрики, это тоже отказ.
+func statusError(code int) error {
+	switch code {
+	case http.StatusOK:
+		return nil
+	case http.StatusUnauthorized, http.StatusForbidden, http.StatusRequestTimeout, http.StatusTooManyRequests:
+	case http.StatusNotImplemented:
+		return fmt.Errorf("%w: status code %d", errRejected, code)
+	default:
+		if code >= 400 && code < 500 {
+			return fmt.Errorf("%w: status code %d", errRejected, code)
+		}
+	}
+
+	return errors.New("wrong status code: " + fmt.Sprintf("%d", code))
+}
+
+// reject сообщает об отброшенном батче
+func (s *stats) reject(ms []metrics.Metric, err error) {
+	s.logger.Error().Err(err).Int("metrics", len(ms)).Msg("batch rejected, dropped")
+}
+
+func requestHandler(ctx context.Context, c *resty.Client, cfg *config.AgentConfig, addr string, m metrics.Metric) error {
 	switch cfg.ContentType {
 	case ContentTypeJSON:
-		jsonRequest(c, cfg, logger, m)
+		return jsonRequest(ctx, c, cfg, addr, m)
 	default:
-		plainRequest(c, cfg, logger, m)
+		return plainRequest(ctx, c, cfg, addr, m)
 	}
 }
 
-func jsonRequest(c *resty.Client, cfg *config.AgentConfig, logger *config.Logger, m metrics.Metric) {
-	url := "http://" + cfg.Address + "/update"
+// jsonBody готовит запрос с JSON телом, сжатым согласно cfg.Compress
+func jsonBody(ctx context.Context, c *resty.Client, cfg *config.AgentConfig, data []byte) (*resty.Request, error) {
+	body, encoding, err := compressBody(cfg.Compress, data)
+	if err != nil {
+		return nil, err
+	}
 
-	if err := m.SetHash(cfg.Key); err != nil {
-		logger.Error().Stack().Err(err).Msg("")
+	req := c.R().
+		SetContext(ctx).
+		SetHeader("Content-Type", ContentTypeJSON).
+		SetBody(body)
+	if encoding != "" {
+		req.SetHeader("Content-Encoding", encoding)
+	}
+
+	return req, nil
+}
+
+// sign подписывает метрику ключом агента и указывает его id для сервера.
+// Время и случайный nonce в подписи не дают повторить перехваченный запрос,
+// старый формат их не покрывает, поэтому для него не передаются.
+func sign(cfg *config.AgentConfig, m metrics.Metric) error {
+	if cfg.Key == "" {
+		return nil
+	}
+
+	if cfg.LegacyHash {
+		m.SetKeyID("")
+		m.SetStamp(0, "")
+		return m.SetLegacyHash(cfg.Key)
+	}
+	m.SetKeyID(cfg.KeyID)
+
+	nonce := make([]byte, 16)
+	if _, err := crand.Read(nonce); err != nil {
+		return err
+	}
+	m.SetStamp(time.Now().UnixMilli(), hex.EncodeToString(nonce))
+
+	return m.SetHash(cfg.Key)
+}
+
+func jsonRequest(ctx context.Context, c *resty.Client, cfg *config.AgentConfig, addr string, m metrics.Metric) error {
+	url := baseURL(cfg, addr) + "/update"
+
+	if err := sign(cfg, m); err != nil {
+		return err
 	}
 
 	data, err := json.Marshal(m)
 	if err != nil {
-		logger.Error().Stack().Err(err).Msg("")
+		return err
 	}
 
-	resp, err := c.R().
-		SetHeader("Content-Type", ContentTypeJSON).
-		SetBody(data).
-		Post(url)
-
+	req, err := jsonBody(ctx, c, cfg, data)
 	if err != nil {
-		logger.Error().Stack().Err(err).Msg("")
+		return err
 	}
 
-	if resp.StatusCode() != http.StatusOK {
-		logger.Fatal().Stack().Int("status code", resp.StatusCode()).Msg("response status code not 200")
+	resp, err := req.Post(url)
+
+	if err != nil {
+		return err
 	}
+
+	return statusError(resp.StatusCode())
 }
 
-func plainRequest(c *resty.Client, cfg *config.AgentConfig, logger *config.Logger, m metrics.Metric) {
-	url := "http://" + cfg.Address + "/update/" + m.Type() + "/" + m.Name() + "/" + m.ToString()
+func plainRequest(ctx context.Context, c *resty.Client, cfg *config.AgentConfig, addr string, m metrics.Metric) error {
+	// в текстовом формате нет признака cumulative, сервер прибавил бы значение
+	if m.IsCumulative() {
+		return errors.New("cumulative counters require JSON content type")
+	}
+
+	url := baseURL(cfg, addr) + "/update/" + m.Type() + "/" + m.Name() + "/" + m.ToString()
 
 	resp, err := c.R().
+		SetContext(ctx).
 		SetHeader("Content-Type", ContentTypePlain).
 		Post(url)
 	if err != nil {
-		logger.Error().Stack().Err(err).Msg("")
+		return err
 	}
 
-	if resp.StatusCode() != http.StatusOK {
-		logger.Fatal().Stack().Int("status code", resp.StatusCode()).Msg("response status code not 200")
-	}
+	return statusError(resp.StatusCode())
 }
 
-func batchRequest(c *resty.Client, cfg *config.AgentConfig, logger *config.Logger, metrics []metrics.Metric) error {
-	url := "http://" + cfg.Address + "/updates"
+func batchRequest(ctx context.Context, c *resty.Client, cfg *config.AgentConfig, addr string, logger *config.Logger, metrics []metrics.Metric) error {
+	url := baseURL(cfg, addr) + "/updates"
 	var data bytes.Buffer
 	encoder := json.NewEncoder(&data)
 	for _, m := range metrics {
-		if err := m.SetHash(cfg.Key); err != nil {
+		if err := sign(cfg, m); err != nil {
 			return err
 		}
 	}
@@ -407,18 +751,17 @@ func batchRequest(c *resty.Client, cfg *config.AgentConfig, logger *config.Logge
 		return err
 	}
 	logger.Debug().Str("Data:", data.String()).Send()
-	resp, err := c.R().
-		SetHeader("Content-Type", ContentTypeJSON).
-		SetBody(data.Bytes()).
-		Post(url)
-
+	req, err := jsonBody(ctx, c, cfg, data.Bytes())
 	if err != nil {
 		return err
 	}
 
-	if resp.StatusCode() != http.StatusOK {
-		return errors.New("wrong status code: " + fmt.Sprintf("%d", resp.StatusCode()))
+	// неуспешный атомарный батч не применен ни частично, его можно повторить
+	resp, err := req.SetQueryParam("atomic", "true").Post(url)
+
+	if err != nil {
+		return err
 	}
 
-	return nil
+	return statusError(resp.StatusCode())
 }
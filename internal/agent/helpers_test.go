@@ -1,11 +1,17 @@
 package agent
 
 import (
-	"sync"
+	"context"
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http"
 	"testing"
 	"time"
 
+	"github.com/go-resty/resty/v2"
 	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
 
 	"github.com/fedoroko/practicum_go/internal/config"
 	"github.com/fedoroko/practicum_go/internal/metrics"
@@ -41,11 +47,10 @@ func Test_stats_collect(t *testing.T) {
 	cfg := config.NewAgentConfig()
 	cfg.PollInterval = time.Second * 1
 	type fields struct {
-		metrics []metrics.Metric
-		count   int64
-		mtx     *sync.RWMutex
-		done    chan struct{}
-		cfg     *config.AgentConfig
+		gauges   *aggregator
+		counters *counterTracker
+		done     chan struct{}
+		cfg      *config.AgentConfig
 	}
 	tests := []struct {
 		name   string
@@ -54,27 +59,130 @@ func Test_stats_collect(t *testing.T) {
 		{
 			name: "positive",
 			fields: fields{
-				metrics: []metrics.Metric{},
-				cfg:     cfg,
+				gauges:   newAggregator(),
+				counters: newCounterTracker(CounterModeDelta),
+				cfg:      cfg,
 			},
 		},
 	}
 	for _, tt := range tests {
 		t.Run(tt.name, func(t *testing.T) {
 			s := &stats{
-				metrics: tt.fields.metrics,
-				count:   tt.fields.count,
-				mtx:     sync.RWMutex{},
-				done:    tt.fields.done,
-				cfg:     tt.fields.cfg,
+				gauges:     tt.fields.gauges,
+				counters:   tt.fields.counters,
+				collectors: []collector{getBasicMetrics, getAdvancedMetrics},
+				done:       tt.fields.done,
+				cfg:        tt.fields.cfg,
 			}
-			empty := &stats{
-				metrics: []metrics.Metric{},
-			}
-
 			go s.collect()
 			time.Sleep(s.cfg.PollInterval + time.Second*1)
-			assert.NotEqual(t, s.metrics, empty.metrics)
+			assert.NotEqual(t, 0, s.gauges.len())
+		})
+	}
+}
+
+func Test_stats_prepare(t *testing.T) {
+	headers := make(chan http.Header, 1)
+	ts := newTestServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		headers <- r.Header.Clone()
+	}))
+	defer ts.Close()
+
+	cfg := config.NewAgentConfig()
+	cfg.Address = ts.Listener.Addr().String()
+	cfg.Token = "secret"
+	s := newStats(cfg, config.TestLogger())
+	c := resty.New()
+	s.prepare(c)
+
+	require.True(t, s.report(context.Background(), c, testBatch(1, 1)))
+	header := <-headers
+	assert.Equal(t, "Bearer secret", header.Get("Authorization"))
+	assert.Equal(t, "127.0.0.1", header.Get("X-Real-IP"))
+}
+
+func Test_statusError(t *testing.T) {
+	tests := []struct {
+		code     int
+		wantErr  bool
+		rejected bool
+	}{
+		{code: http.StatusOK},
+		{code: http.StatusBadRequest, wantErr: true, rejected: true},
+		{code: http.StatusRequestEntityTooLarge, wantErr: true, rejected: true},
+		{code: http.StatusNotImplemented, wantErr: true, rejected: true},
+		{code: http.StatusUnauthorized, wantErr: true},
+		{code: http.StatusForbidden, wantErr: true},
+		{code: http.StatusRequestTimeout, wantErr: true},
+		{code: http.StatusTooManyRequests, wantErr: true},
+		{code: http.StatusInternalServerError, wantErr: true},
+		{code: http.StatusServiceUnavailable, wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(http.StatusText(tt.code), func(t *testing.T) {
+			err := statusError(tt.code)
+			if !tt.wantErr {
+				assert.NoError(t, err)
+				return
+			}
+			assert.Error(t, err)
+			assert.Equal(t, tt.rejected, errors.Is(err, errRejected))
 		})
 	}
 }
+
+func Test_batchRequest_sign(t *testing.T) {
+	// обработчик только пересылает запрос, проверки идут в горутине теста
+	type request struct {
+		atomic string
+		body   []byte
+		err    error
+	}
+	requests := make(chan request, 1)
+	ts := newTestServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		data, err := io.ReadAll(r.Body)
+		requests <- request{atomic: r.URL.Query().Get("atomic"), body: data, err: err}
+	}))
+	defer ts.Close()
+
+	received := func() []map[string]interface{} {
+		req := <-requests
+		require.NoError(t, req.err)
+		assert.Equal(t, "true", req.atomic)
+
+		var body []map[string]interface{}
+		require.NoError(t, json.Unmarshal(req.body, &body))
+		require.Len(t, body, 2)
+		return body
+	}
+
+	cfg := config.NewAgentConfig()
+	WithKey("k2", "new")(cfg)
+	ms := testBatch(1, 0)
+	require.NoError(t, batchRequest(context.Background(), resty.New(), cfg, ts.Listener.Addr().String(), config.TestLogger(), ms))
+
+	body := received()
+	assert.NotEqual(t, body[0]["nonce"], body[1]["nonce"])
+	for i, m := range ms {
+		assert.Equal(t, "k2", body[i]["key_id"])
+		assert.NotEmpty(t, body[i]["hash"])
+		assert.NotEmpty(t, body[i]["ts"])
+		assert.NotEmpty(t, body[i]["nonce"])
+		assert.EqualValues(t, metrics.HashV2, body[i]["hash_v"])
+		ok, err := m.CheckHash("new")
+		require.NoError(t, err)
+		assert.True(t, ok)
+	}
+
+	// старый сервер не знает hash_v, key_id, ts и nonce
+	cfg.LegacyHash = true
+	require.NoError(t, batchRequest(context.Background(), resty.New(), cfg, ts.Listener.Addr().String(), config.TestLogger(), ms))
+	body = received()
+	for i := range ms {
+		assert.NotContains(t, body[i], "hash_v")
+		assert.NotContains(t, body[i], "key_id")
+		assert.NotContains(t, body[i], "ts")
+		assert.NotContains(t, body[i], "nonce")
+		assert.Equal(t, metrics.HashLegacy, ms[i].HashVersion())
+	}
+}
@@ -0,0 +1,58 @@
+package agent
+
+import (
+	"sync"
+)
+
+// workerPool ограничивает число одновременных исходящих запросов:
+// задачи выполняют ровно size воркеров, остальные ждут в канале
+type workerPool struct {
+	jobs chan func()
+	wg   sync.WaitGroup
+}
+
+func newWorkerPool(size int) *workerPool {
+	if size < 1 {
+		size = 1
+	}
+
+	p := &workerPool{
+		jobs: make(chan func(), size),
+	}
+
+	p.wg.Add(size)
+	for i := 0; i < size; i++ {
+		go func() {
+			defer p.wg.Done()
+			for job := range p.jobs {
+				job()
+			}
+		}()
+	}
+
+	return p
+}
+
+// run выполняет задачи в пуле и ждет их завершения,
+// ошибки возвращаются в порядке задач
+func (p *workerPool) run(jobs ...func() error) []error {
+	errs := make([]error, len(jobs))
+
+	var wg sync.WaitGroup
+	wg.Add(len(jobs))
+	for i, job := range jobs {
+		i, job := i, job
+		p.jobs <- func() {
+			defer wg.Done()
+			errs[i] = job()
+		}
+	}
+	wg.Wait()
+
+	return errs
+}
+
+func (p *workerPool) stop() {
+	close(p.jobs)
+	p.wg.Wait()
+}
@@ -0,0 +1,135 @@
+package agent
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/go-resty/resty/v2"
+	"github.com/stretchr/testify/assert"
+
+	"github.com/fedoroko/practicum_go/internal/config"
+	"github.com/fedoroko/practicum_go/internal/metrics"
+)
+
+func Test_workerPool_run(t *testing.T) {
+	tests := []struct {
+		name string
+		size int
+		jobs int
+		want int32
+	}{
+		{
+			name: "limited",
+			size: 3,
+			jobs: 10,
+			want: 3,
+		},
+		{
+			name: "zero size",
+			size: 0,
+			jobs: 5,
+			want: 1,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			p := newWorkerPool(tt.size)
+			defer p.stop()
+
+			var cur, max int32
+			fail := errors.New("odd job")
+			jobs := make([]func() error, tt.jobs)
+			for i := range jobs {
+				i := i
+				jobs[i] = func() error {
+					n := atomic.AddInt32(&cur, 1)
+					for {
+						m := atomic.LoadInt32(&max)
+						if n <= m || atomic.CompareAndSwapInt32(&max, m, n) {
+							break
+						}
+					}
+					time.Sleep(time.Millisecond * 20)
+					atomic.AddInt32(&cur, -1)
+					if i%2 == 1 {
+						return fail
+					}
+					return nil
+				}
+			}
+
+			errs := p.run(jobs...)
+			assert.Equal(t, tt.want, max)
+			for i, err := range errs {
+				if i%2 == 1 {
+					assert.ErrorIs(t, err, fail)
+				} else {
+					assert.NoError(t, err)
+				}
+			}
+		})
+	}
+}
+
+func Test_stats_flush_single(t *testing.T) {
+	var (
+		mtx      sync.Mutex
+		cur, max int
+		got      = map[string]string{}
+	)
+	ts := newTestServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mtx.Lock()
+		cur++
+		if cur > max {
+			max = cur
+		}
+		mtx.Unlock()
+
+		time.Sleep(time.Millisecond * 20)
+		m, err := metrics.FromJSON(r.Body)
+
+		mtx.Lock()
+		defer mtx.Unlock()
+		cur--
+		if err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		// счетчик Fail сервер не принимает
+		if m.Name() == "Fail" {
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+		got[m.Name()] = m.ToString()
+	}))
+	defer ts.Close()
+
+	cfg := config.NewAgentConfig()
+	cfg.Address = strings.TrimPrefix(ts.URL, "http://")
+	cfg.ContentType = ContentTypeJSON
+	cfg.Batch = false
+	cfg.RateLimit = 2
+	s := newStats(cfg, config.TestLogger())
+	defer s.pool.stop()
+	c := resty.New()
+
+	s.gauges.add(testBatch(0, 1)[1:])
+	s.counters.add("Jobs", 3)
+	s.counters.add("Fail", 5)
+	s.counters.add("PollCount", 1)
+	s.flush(context.Background(), c)
+
+	assert.LessOrEqual(t, max, 2)
+	assert.Equal(t, map[string]string{"Alloc": "1", "Jobs": "3", "PollCount": "1"}, got)
+
+	// неподтвержденный счетчик уходит со следующей отправкой
+	ms, _ := s.counters.pending()
+	assert.Len(t, ms, 1)
+	assert.Equal(t, "Fail", ms[0].Name())
+}
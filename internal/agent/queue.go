@@ -0,0 +1,310 @@
+package agent
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/fedoroko/practicum_go/internal/metrics"
+)
+
+const queueFileExt = ".json"
+
+type queuedBatch struct {
+	Created time.Time       `json:"created"`
+	Metrics json.RawMessage `json:"metrics"`
+}
+
+type queueItem struct {
+	seq     uint64
+	size    int64
+	created time.Time
+}
+
+// diskQueue хранит неотправленные батчи на диске, по файлу на батч,
+// и отдает их в порядке поступления.
+// Очередь ограничена суммарным размером и возрастом батчей.
+// При вытеснении старого батча его gauge отбрасываются, а дельты counter
+// переносятся в следующий батч, поэтому сумма счетчиков не теряется.
+type diskQueue struct {
+	dir     string
+	maxSize int64
+	maxAge  time.Duration
+	items   []queueItem
+	size    int64
+	nextSeq uint64
+	mtx     sync.Mutex
+}
+
+// newDiskQueue открывает очередь в dir, подхватывая батчи,
+// оставшиеся от прошлого запуска агента
+func newDiskQueue(dir string, maxSize int64, maxAge time.Duration) (*diskQueue, error) {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, err
+	}
+
+	q := &diskQueue{
+		dir:     dir,
+		maxSize: maxSize,
+		maxAge:  maxAge,
+		mtx:     sync.Mutex{},
+	}
+
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+
+	for _, e := range entries {
+		name := e.Name()
+		if e.IsDir() || !strings.HasSuffix(name, queueFileExt) {
+			continue
+		}
+
+		seq, err := strconv.ParseUint(strings.TrimSuffix(name, queueFileExt), 10, 64)
+		if err != nil {
+			continue
+		}
+
+		b, size, err := q.readFile(seq)
+		if err != nil {
+			// поврежденный файл (например, агент упал во время записи)
+			os.Remove(q.path(seq))
+			continue
+		}
+
+		q.items = append(q.items, queueItem{seq: seq, size: size, created: b.Created})
+		q.size += size
+		if seq >= q.nextSeq {
+			q.nextSeq = seq + 1
+		}
+	}
+	sort.Slice(q.items, func(i, j int) bool {
+		return q.items[i].seq < q.items[j].seq
+	})
+
+	return q, q.evict(time.Now())
+}
+
+func (q *diskQueue) len() int {
+	q.mtx.Lock()
+	defer q.mtx.Unlock()
+	return len(q.items)
+}
+
+func (q *diskQueue) push(ms []metrics.Metric) error {
+	q.mtx.Lock()
+	defer q.mtx.Unlock()
+
+	now := time.Now()
+	size, err := q.writeFile(q.nextSeq, now, ms)
+	if err != nil {
+		return err
+	}
+
+	q.items = append(q.items, queueItem{seq: q.nextSeq, size: size, created: now})
+	q.size += size
+	q.nextSeq++
+
+	return q.evict(now)
+}
+
+// replay отправляет батчи по порядку и удаляет успешно отправленные.
+// Отклоненный сервером батч удаляется и передается в drop, его счетчики
+// не переносятся дальше. На прочих ошибках replay останавливается,
+// оставляя батч в очереди.
+func (q *diskQueue) replay(send func([]metrics.Metric) error, drop func([]metrics.Metric, error)) error {
+	q.mtx.Lock()
+	defer q.mtx.Unlock()
+
+	if err := q.evict(time.Now()); err != nil {
+		return err
+	}
+
+	for len(q.items) > 0 {
+		item := q.items[0]
+		ms, err := q.read(item.seq)
+		if err != nil {
+			return err
+		}
+
+		err = send(ms)
+		switch {
+		case errors.Is(err, errRejected):
+			drop(ms, err)
+		case err != nil:
+			return err
+		}
+
+		if err = q.remove(); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// evict удаляет самые старые батчи, пока очередь не уложится в лимиты.
+// Последний батч не удаляется никогда.
+func (q *diskQueue) evict(now time.Time) error {
+	for len(q.items) > 1 {
+		oldest := q.items[0]
+		expired := q.maxAge > 0 && now.Sub(oldest.created) > q.maxAge
+		overflow := q.maxSize > 0 && q.size > q.maxSize
+		if !expired && !overflow {
+			return nil
+		}
+
+		ms, err := q.read(oldest.seq)
+		if err != nil {
+			return err
+		}
+		if err = q.remove(); err != nil {
+			return err
+		}
+		if err = q.mergeCounters(ms); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// mergeCounters добавляет дельты counter из вытесненного батча
+// в самый старый из оставшихся
+func (q *diskQueue) mergeCounters(evicted []metrics.Metric) error {
+	target := &q.items[0]
+	ms, err := q.read(target.seq)
+	if err != nil {
+		return err
+	}
+
+	size, err := q.writeFile(target.seq, target.created, mergeCounters(ms, evicted))
+	if err != nil {
+		return err
+	}
+	q.size += size - target.size
+	target.size = size
+
+	return nil
+}
+
+// mergeCounters переносит счетчики из более старого батча src в dst.
+// Дельты суммируются, а cumulative значение в dst и так новее.
+// Батчи могут быть общими с другими очередями, поэтому метрики
+// dst и src не меняются, измененные счетчики создаются заново.
+func mergeCounters(dst, src []metrics.Metric) []metrics.Metric {
+	deltas := make(map[string]metrics.Metric)
+	var order []string
+	for _, m := range src {
+		if m.Type() != metrics.CounterType {
+			continue
+		}
+		if d, ok := deltas[m.Name()]; ok {
+			d.SetInt64(d.Int64Value() + m.Int64Value())
+			continue
+		}
+		order = append(order, m.Name())
+		deltas[m.Name()] = metrics.Copy(m)
+	}
+
+	ret := make([]metrics.Metric, 0, len(dst)+len(order))
+	for _, m := range dst {
+		if d, ok := deltas[m.Name()]; ok && m.Type() == metrics.CounterType {
+			if !m.IsCumulative() {
+				m = metrics.Copy(m)
+				m.SetInt64(m.Int64Value() + d.Int64Value())
+			}
+			delete(deltas, m.Name())
+		}
+		ret = append(ret, m)
+	}
+	for _, n := range order {
+		if d, ok := deltas[n]; ok {
+			ret = append(ret, d)
+		}
+	}
+
+	return ret
+}
+
+// copyBatch нужен, когда один батч откладывается в несколько очередей
+func copyBatch(ms []metrics.Metric) []metrics.Metric {
+	ret := make([]metrics.Metric, len(ms))
+	for i, m := range ms {
+		ret[i] = metrics.Copy(m)
+	}
+
+	return ret
+}
+
+func (q *diskQueue) remove() error {
+	item := q.items[0]
+	if err := os.Remove(q.path(item.seq)); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+
+	q.items = q.items[1:]
+	q.size -= item.size
+	return nil
+}
+
+func (q *diskQueue) read(seq uint64) ([]metrics.Metric, error) {
+	b, _, err := q.readFile(seq)
+	if err != nil {
+		return nil, err
+	}
+
+	return metrics.ArrFromJSON(bytes.NewReader(b.Metrics))
+}
+
+func (q *diskQueue) readFile(seq uint64) (queuedBatch, int64, error) {
+	b := queuedBatch{}
+	data, err := os.ReadFile(q.path(seq))
+	if err != nil {
+		return b, 0, err
+	}
+
+	if err = json.Unmarshal(data, &b); err != nil {
+		return b, 0, err
+	}
+
+	return b, int64(len(data)), nil
+}
+
+// writeFile пишет батч во временный файл и переименовывает его,
+// чтобы при падении агента на диске не оставалось половины батча
+func (q *diskQueue) writeFile(seq uint64, created time.Time, ms []metrics.Metric) (int64, error) {
+	raw, err := json.Marshal(ms)
+	if err != nil {
+		return 0, err
+	}
+
+	data, err := json.Marshal(queuedBatch{Created: created, Metrics: raw})
+	if err != nil {
+		return 0, err
+	}
+
+	tmp := q.path(seq) + ".tmp"
+	if err = os.WriteFile(tmp, data, 0644); err != nil {
+		return 0, err
+	}
+
+	if err = os.Rename(tmp, q.path(seq)); err != nil {
+		return 0, err
+	}
+
+	return int64(len(data)), nil
+}
+
+func (q *diskQueue) path(seq uint64) string {
+	return filepath.Join(q.dir, fmt.Sprintf("%020d%s", seq, queueFileExt))
+}
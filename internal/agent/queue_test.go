@@ -0,0 +1,232 @@
+package agent
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/go-resty/resty/v2"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/fedoroko/practicum_go/internal/config"
+	"github.com/fedoroko/practicum_go/internal/metrics"
+)
+
+func testBatch(counter int64, gauge float64) []metrics.Metric {
+	return []metrics.Metric{
+		metrics.NewOmitEmpty("PollCount", metrics.CounterType, nil, metrics.PointerFromInt64(counter)),
+		metrics.NewOmitEmpty("Alloc", metrics.GaugeType, metrics.PointerFromFloat64(gauge), nil),
+	}
+}
+
+func batchValues(ms []metrics.Metric) map[string]string {
+	ret := map[string]string{}
+	for _, m := range ms {
+		ret[m.Name()] = m.ToString()
+	}
+	return ret
+}
+
+func Test_diskQueue_replay(t *testing.T) {
+	dir := t.TempDir()
+	q, err := newDiskQueue(dir, 0, 0)
+	require.NoError(t, err)
+
+	for i := 1; i <= 3; i++ {
+		require.NoError(t, q.push(testBatch(int64(i), float64(i))))
+	}
+	assert.Equal(t, 3, q.len())
+
+	var sent []map[string]string
+	fail := errors.New("server is down")
+	err = q.replay(func(ms []metrics.Metric) error {
+		if len(sent) == 1 {
+			return fail
+		}
+		sent = append(sent, batchValues(ms))
+		return nil
+	}, nil)
+	assert.ErrorIs(t, err, fail)
+	assert.Equal(t, []map[string]string{{"PollCount": "1", "Alloc": "1"}}, sent)
+	assert.Equal(t, 2, q.len())
+
+	// очередь переживает перезапуск агента
+	q, err = newDiskQueue(dir, 0, 0)
+	require.NoError(t, err)
+	assert.Equal(t, 2, q.len())
+	require.NoError(t, q.push(testBatch(4, 4)))
+
+	err = q.replay(func(ms []metrics.Metric) error {
+		sent = append(sent, batchValues(ms))
+		return nil
+	}, nil)
+	require.NoError(t, err)
+	assert.Equal(t, []map[string]string{
+		{"PollCount": "1", "Alloc": "1"},
+		{"PollCount": "2", "Alloc": "2"},
+		{"PollCount": "3", "Alloc": "3"},
+		{"PollCount": "4", "Alloc": "4"},
+	}, sent)
+	assert.Equal(t, 0, q.len())
+}
+
+// отклоненный батч не держит очередь и не передает счетчики следующему
+func Test_diskQueue_replay_rejected(t *testing.T) {
+	q, err := newDiskQueue(t.TempDir(), 0, 0)
+	require.NoError(t, err)
+	for i := 1; i <= 3; i++ {
+		require.NoError(t, q.push(testBatch(int64(i), float64(i))))
+	}
+
+	var sent, dropped []map[string]string
+	err = q.replay(func(ms []metrics.Metric) error {
+		if ms[0].Int64Value() == 2 {
+			return fmt.Errorf("%w: status code 400", errRejected)
+		}
+		sent = append(sent, batchValues(ms))
+		return nil
+	}, func(ms []metrics.Metric, err error) {
+		assert.ErrorIs(t, err, errRejected)
+		dropped = append(dropped, batchValues(ms))
+	})
+	require.NoError(t, err)
+	assert.Equal(t, []map[string]string{
+		{"PollCount": "1", "Alloc": "1"},
+		{"PollCount": "3", "Alloc": "3"},
+	}, sent)
+	assert.Equal(t, []map[string]string{{"PollCount": "2", "Alloc": "2"}}, dropped)
+	assert.Equal(t, 0, q.len())
+}
+
+func Test_diskQueue_evict(t *testing.T) {
+	tests := []struct {
+		name    string
+		maxSize int64
+		maxAge  time.Duration
+		sleep   time.Duration
+		want    []map[string]string
+	}{
+		{
+			name:    "by size",
+			maxSize: 1,
+			want: []map[string]string{
+				{"PollCount": "6", "Alloc": "3"},
+			},
+		},
+		{
+			name:   "by age",
+			maxAge: time.Millisecond * 50,
+			sleep:  time.Millisecond * 100,
+			want: []map[string]string{
+				{"PollCount": "6", "Alloc": "3"},
+			},
+		},
+		{
+			name: "unbounded",
+			want: []map[string]string{
+				{"PollCount": "1", "Alloc": "1"},
+				{"PollCount": "2", "Alloc": "2"},
+				{"PollCount": "3", "Alloc": "3"},
+			},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			q, err := newDiskQueue(t.TempDir(), tt.maxSize, tt.maxAge)
+			require.NoError(t, err)
+
+			for i := 1; i <= 3; i++ {
+				require.NoError(t, q.push(testBatch(int64(i), float64(i))))
+				time.Sleep(tt.sleep)
+			}
+
+			var sent []map[string]string
+			require.NoError(t, q.replay(func(ms []metrics.Metric) error {
+				sent = append(sent, batchValues(ms))
+				return nil
+			}, nil))
+			assert.Equal(t, tt.want, sent)
+		})
+	}
+}
+
+func Test_stats_report_queue(t *testing.T) {
+	var (
+		mtx    sync.Mutex
+		down   = true
+		bodies []string
+	)
+	ts := newTestServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mtx.Lock()
+		defer mtx.Unlock()
+		if down {
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+		body, _ := io.ReadAll(r.Body)
+		bodies = append(bodies, string(body))
+	}))
+	defer ts.Close()
+
+	cfg := config.NewAgentConfig()
+	cfg.Address = strings.TrimPrefix(ts.URL, "http://")
+	s := newStats(cfg, config.TestLogger())
+	s.queue, _ = newDiskQueue(t.TempDir(), 0, 0)
+	c := resty.New()
+
+	s.report(context.Background(), c, testBatch(1, 1))
+	s.report(context.Background(), c, testBatch(2, 2))
+	assert.Equal(t, 2, s.queue.len())
+
+	mtx.Lock()
+	down = false
+	mtx.Unlock()
+
+	s.report(context.Background(), c, testBatch(3, 3))
+	assert.Equal(t, 0, s.queue.len())
+	require.Len(t, bodies, 3)
+	assert.Contains(t, bodies[0], "\"delta\":1")
+	assert.Contains(t, bodies[1], "\"delta\":2")
+	assert.Contains(t, bodies[2], "\"delta\":3")
+}
+
+func Test_stats_report_rejected(t *testing.T) {
+	var (
+		mtx    sync.Mutex
+		bodies []string
+	)
+	ts := newTestServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mtx.Lock()
+		defer mtx.Unlock()
+		body, _ := io.ReadAll(r.Body)
+		if strings.Contains(string(body), "\"delta\":2") {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		bodies = append(bodies, string(body))
+	}))
+	defer ts.Close()
+
+	cfg := config.NewAgentConfig()
+	cfg.Address = strings.TrimPrefix(ts.URL, "http://")
+	s := newStats(cfg, config.TestLogger())
+	s.queue, _ = newDiskQueue(t.TempDir(), 0, 0)
+	c := resty.New()
+
+	assert.True(t, s.report(context.Background(), c, testBatch(1, 1)))
+	// отклоненный батч подтверждается и не попадает в очередь
+	assert.True(t, s.report(context.Background(), c, testBatch(2, 2)))
+	assert.Equal(t, 0, s.queue.len())
+	assert.True(t, s.report(context.Background(), c, testBatch(3, 3)))
+
+	require.Len(t, bodies, 2)
+	assert.Contains(t, bodies[0], "\"delta\":1")
+	assert.Contains(t, bodies[1], "\"delta\":3")
+}
@@ -0,0 +1,96 @@
+package agent
+
+import (
+	"net"
+	"net/url"
+	"sync"
+
+	"github.com/go-resty/resty/v2"
+
+	"github.com/fedoroko/practicum_go/internal/config"
+)
+
+// realIP определяет адрес интерфейса, через который агент ходит к серверу,
+// и подставляет его в X-Real-IP для проверки доверенной подсети.
+// Если адрес определить не удалось, запрос уходит без заголовка:
+// сервер без TRUSTED_SUBNET его не проверяет.
+type realIP struct {
+	hosts  map[string]string
+	failed map[string]bool
+	mtx    sync.Mutex
+	logger *config.Logger
+}
+
+func newRealIP(logger *config.Logger) *realIP {
+	return &realIP{
+		hosts:  make(map[string]string),
+		failed: make(map[string]bool),
+		mtx:    sync.Mutex{},
+		logger: logger,
+	}
+}
+
+// warn пишет в лог только первую ошибку по каждому адресу,
+// чтобы не засорять лог на каждой отправке
+func (r *realIP) warn(addr string, err error) {
+	r.mtx.Lock()
+	defer r.mtx.Unlock()
+
+	if r.failed[addr] {
+		return
+	}
+	r.failed[addr] = true
+	r.logger.Warn().Err(err).Str("address", addr).Msg("X-Real-IP not determined, sending without it")
+}
+
+// lookup возвращает исходящий адрес до host:port.
+// UDP "соединение" только выбирает маршрут и ничего не отправляет.
+func (r *realIP) lookup(addr string) (string, error) {
+	r.mtx.Lock()
+	defer r.mtx.Unlock()
+
+	if ip, ok := r.hosts[addr]; ok {
+		return ip, nil
+	}
+
+	conn, err := net.Dial("udp", addr)
+	if err != nil {
+		return "", err
+	}
+	defer conn.Close()
+
+	ip := conn.LocalAddr().(*net.UDPAddr).IP.String()
+	r.hosts[addr] = ip
+
+	return ip, nil
+}
+
+func (r *realIP) hook(_ *resty.Client, req *resty.Request) error {
+	if req.Header.Get("X-Real-IP") != "" {
+		return nil
+	}
+
+	u, err := url.Parse(req.URL)
+	if err != nil {
+		r.warn(req.URL, err)
+		return nil
+	}
+
+	host := u.Host
+	if u.Port() == "" {
+		port := "80"
+		if u.Scheme == "https" {
+			port = "443"
+		}
+		host = net.JoinHostPort(u.Hostname(), port)
+	}
+
+	ip, err := r.lookup(host)
+	if err != nil {
+		r.warn(host, err)
+		return nil
+	}
+	req.SetHeader("X-Real-IP", ip)
+
+	return nil
+}
@@ -0,0 +1,56 @@
+package agent
+
+import (
+	"net/http"
+	"sync"
+	"testing"
+
+	"github.com/go-resty/resty/v2"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/fedoroko/practicum_go/internal/config"
+)
+
+func Test_realIP_hook(t *testing.T) {
+	var (
+		mtx sync.Mutex
+		got []string
+	)
+	ts := newTestServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mtx.Lock()
+		defer mtx.Unlock()
+		got = append(got, r.Header.Get("X-Real-IP"))
+	}))
+	defer ts.Close()
+
+	ip := newRealIP(config.TestLogger())
+	c := resty.New()
+	c.OnBeforeRequest(ip.hook)
+
+	_, err := c.R().Post(ts.URL + "/updates")
+	require.NoError(t, err)
+	// явно заданный заголовок не перезаписывается
+	_, err = c.R().SetHeader("X-Real-IP", "10.0.0.1").Post(ts.URL + "/updates")
+	require.NoError(t, err)
+
+	assert.Equal(t, []string{"127.0.0.1", "10.0.0.1"}, got)
+	assert.Len(t, ip.hosts, 1)
+}
+
+func Test_realIP_hook_lookupFailed(t *testing.T) {
+	ip := newRealIP(config.TestLogger())
+	c := resty.New()
+
+	// адрес не определяется: запрос не прерывается, заголовок не ставится,
+	// ошибка пишется в лог один раз
+	for i := 0; i < 2; i++ {
+		req := c.R()
+		req.URL = "http://127.0.0.1:99999/updates"
+		require.NoError(t, ip.hook(c, req))
+		assert.Empty(t, req.Header.Get("X-Real-IP"))
+	}
+
+	assert.Empty(t, ip.hosts)
+	assert.Len(t, ip.failed, 1)
+}
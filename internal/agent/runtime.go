@@ -0,0 +1,281 @@
+package agent
+
+import (
+	"math"
+	"math/rand"
+	rtmetrics "runtime/metrics"
+	"strings"
+	"sync"
+	"unicode"
+
+	"github.com/fedoroko/practicum_go/internal/config"
+	"github.com/fedoroko/practicum_go/internal/metrics"
+)
+
+// runtimeSkip - имя в RuntimeMetricsNames, отключающее метрику.
+// Переименование задается парами вида /gc/heap/allocs:bytes=HeapAllocsTotal
+const runtimeSkip = "-"
+
+var runtimeQuantiles = []struct {
+	suffix string
+	q      float64
+}{
+	{"P50", 0.5},
+	{"P90", 0.9},
+	{"P99", 0.99},
+	{"Max", 1},
+}
+
+// runtimeLegacy - метрики getBasicMetrics, собранные из runtime/metrics:
+// значение - сумма sources, деленная на сумму per, если он задан.
+// LastGC, Lookups и PauseTotalNs так не получить, они не отправляются.
+var runtimeLegacy = []struct {
+	name    string
+	sources []string
+	per     []string
+}{
+	{name: "Alloc", sources: []string{"/memory/classes/heap/objects:bytes"}},
+	{name: "BuckHashSys", sources: []string{"/memory/classes/profiling/buckets:bytes"}},
+	{name: "Frees", sources: []string{"/gc/heap/frees:objects", "/gc/heap/tiny/allocs:objects"}},
+	{name: "GCCPUFraction", sources: []string{"/cpu/classes/gc/total:cpu-seconds"}, per: []string{"/cpu/classes/total:cpu-seconds"}},
+	{name: "GCSys", sources: []string{"/memory/classes/metadata/other:bytes"}},
+	{name: "HeapAlloc", sources: []string{"/memory/classes/heap/objects:bytes"}},
+	{name: "HeapIdle", sources: []string{"/memory/classes/heap/released:bytes", "/memory/classes/heap/free:bytes"}},
+	{name: "HeapInuse", sources: []string{"/memory/classes/heap/objects:bytes", "/memory/classes/heap/unused:bytes"}},
+	{name: "HeapObjects", sources: []string{"/gc/heap/objects:objects"}},
+	{name: "HeapReleased", sources: []string{"/memory/classes/heap/released:bytes"}},
+	{name: "HeapSys", sources: []string{
+		"/memory/classes/heap/objects:bytes",
+		"/memory/classes/heap/unused:bytes",
+		"/memory/classes/heap/free:bytes",
+		"/memory/classes/heap/released:bytes",
+	}},
+	{name: "MCacheInuse", sources: []string{"/memory/classes/metadata/mcache/inuse:bytes"}},
+	{name: "MCacheSys", sources: []string{"/memory/classes/metadata/mcache/inuse:bytes", "/memory/classes/metadata/mcache/free:bytes"}},
+	{name: "MSpanInuse", sources: []string{"/memory/classes/metadata/mspan/inuse:bytes"}},
+	{name: "MSpanSys", sources: []string{"/memory/classes/metadata/mspan/inuse:bytes", "/memory/classes/metadata/mspan/free:bytes"}},
+	{name: "Mallocs", sources: []string{"/gc/heap/allocs:objects", "/gc/heap/tiny/allocs:objects"}},
+	{name: "NextGC", sources: []string{"/gc/heap/goal:bytes"}},
+	{name: "NumForcedGC", sources: []string{"/gc/cycles/forced:gc-cycles"}},
+	{name: "NumGC", sources: []string{"/gc/cycles/total:gc-cycles"}},
+	{name: "OtherSys", sources: []string{"/memory/classes/other:bytes"}},
+	{name: "StackInuse", sources: []string{"/memory/classes/heap/stacks:bytes"}},
+	{name: "StackSys", sources: []string{"/memory/classes/heap/stacks:bytes", "/memory/classes/os-stacks:bytes"}},
+	{name: "Sys", sources: []string{"/memory/classes/total:bytes"}},
+	{name: "TotalAlloc", sources: []string{"/gc/heap/allocs:bytes"}},
+}
+
+// runtimeCollector читает все метрики пакета runtime/metrics.
+// В отличие от runtime.ReadMemStats не останавливает мир,
+// а буфер сэмплов выделяется один раз, поэтому подходит для
+// PollInterval меньше секунды.
+// Заменяет getBasicMetrics: старые имена считаются по runtimeLegacy.
+// Все значения отдаются как gauge (как и в getBasicMetrics).
+// Для гистограмм считаются квантили по наблюдениям с прошлого опроса
+// и общее число наблюдений с суффиксом Count.
+type runtimeCollector struct {
+	samples []rtmetrics.Sample
+	names   []string
+	// legacy читается отдельно: источники могут быть скрыты через "-"
+	legacy  []rtmetrics.Sample
+	indexes map[string]int
+	prev    map[string][]uint64
+	mtx     sync.Mutex
+}
+
+func newRuntimeCollector(cfg *config.AgentConfig, logger *config.Logger) *runtimeCollector {
+	mapping := make(map[string]string)
+	for _, pair := range cfg.RuntimeMetricsNames {
+		kv := strings.SplitN(pair, "=", 2)
+		if len(kv) != 2 || kv[0] == "" || kv[1] == "" {
+			logger.Error().Str("mapping", pair).Msg("invalid runtime metric name mapping")
+			continue
+		}
+		mapping[kv[0]] = kv[1]
+	}
+
+	r := &runtimeCollector{
+		indexes: make(map[string]int),
+		prev:    make(map[string][]uint64),
+		mtx:     sync.Mutex{},
+	}
+	for _, d := range rtmetrics.All() {
+		if d.Kind == rtmetrics.KindBad {
+			continue
+		}
+		if d.Kind != rtmetrics.KindFloat64Histogram {
+			r.indexes[d.Name] = len(r.legacy)
+			r.legacy = append(r.legacy, rtmetrics.Sample{Name: d.Name})
+		}
+
+		name, ok := mapping[d.Name]
+		if !ok {
+			name = metricName(cfg.RuntimeMetricsPrefix, d.Name)
+		}
+		if name == runtimeSkip {
+			continue
+		}
+
+		r.samples = append(r.samples, rtmetrics.Sample{Name: d.Name})
+		r.names = append(r.names, name)
+	}
+
+	return r
+}
+
+func (r *runtimeCollector) collect(metricsCh chan<- []metrics.Metric) {
+	r.mtx.Lock()
+	defer r.mtx.Unlock()
+
+	rtmetrics.Read(r.samples)
+	rtmetrics.Read(r.legacy)
+
+	ms := make([]metrics.Metric, 0, len(r.samples)+len(runtimeLegacy)+1)
+	ms = append(ms, r.legacyMetrics()...)
+	ms = append(ms, newGauge("RandomValue", rand.Float64()))
+	for i, s := range r.samples {
+		name := r.names[i]
+		switch s.Value.Kind() {
+		case rtmetrics.KindUint64:
+			ms = append(ms, newGauge(name, float64(s.Value.Uint64())))
+		case rtmetrics.KindFloat64:
+			ms = append(ms, newGauge(name, s.Value.Float64()))
+		case rtmetrics.KindFloat64Histogram:
+			ms = append(ms, r.histogram(name, s.Value.Float64Histogram())...)
+		}
+	}
+
+	metricsCh <- ms
+}
+
+// legacyMetrics пропускает метрики, источников которых нет в этой версии Go
+func (r *runtimeCollector) legacyMetrics() []metrics.Metric {
+	ms := make([]metrics.Metric, 0, len(runtimeLegacy))
+	for _, l := range runtimeLegacy {
+		v, ok := r.sum(l.sources)
+		if !ok {
+			continue
+		}
+		if len(l.per) > 0 {
+			per, ok := r.sum(l.per)
+			if !ok {
+				continue
+			}
+			if per != 0 {
+				v /= per
+			}
+		}
+		ms = append(ms, newGauge(l.name, v))
+	}
+
+	return ms
+}
+
+func (r *runtimeCollector) sum(names []string) (float64, bool) {
+	var ret float64
+	for _, n := range names {
+		i, ok := r.indexes[n]
+		if !ok {
+			return 0, false
+		}
+		switch v := r.legacy[i].Value; v.Kind() {
+		case rtmetrics.KindUint64:
+			ret += float64(v.Uint64())
+		case rtmetrics.KindFloat64:
+			ret += v.Float64()
+		default:
+			return 0, false
+		}
+	}
+
+	return ret, true
+}
+
+func (r *runtimeCollector) histogram(name string, h *rtmetrics.Float64Histogram) []metrics.Metric {
+	prev, ok := r.prev[name]
+	if !ok || len(prev) != len(h.Counts) {
+		prev = make([]uint64, len(h.Counts))
+	}
+
+	var total uint64
+	delta := make([]uint64, len(h.Counts))
+	for i, c := range h.Counts {
+		delta[i] = c - prev[i]
+		total += c
+	}
+	r.prev[name] = append(prev[:0], h.Counts...)
+
+	ms := make([]metrics.Metric, 0, len(runtimeQuantiles)+1)
+	for _, q := range runtimeQuantiles {
+		ms = append(ms, newGauge(name+q.suffix, histogramQuantile(delta, h.Buckets, q.q)))
+	}
+
+	return append(ms, newGauge(name+"Count", float64(total)))
+}
+
+// histogramQuantile возвращает верхнюю границу корзины, в которую попал
+// квантиль q. Для крайних бесконечных границ берется ближайшая конечная.
+func histogramQuantile(counts []uint64, buckets []float64, q float64) float64 {
+	var total uint64
+	for _, c := range counts {
+		total += c
+	}
+	if total == 0 {
+		return 0
+	}
+
+	target := uint64(math.Ceil(q * float64(total)))
+	if target == 0 {
+		target = 1
+	}
+
+	var acc uint64
+	for i, c := range counts {
+		acc += c
+		if acc < target {
+			continue
+		}
+
+		if upper := buckets[i+1]; !math.IsInf(upper, 0) {
+			return upper
+		}
+		if lower := buckets[i]; !math.IsInf(lower, 0) {
+			return lower
+		}
+		return 0
+	}
+
+	return 0
+}
+
+// metricName переводит имя вида /gc/heap/allocs:bytes
+// в CamelCase с префиксом: GoGcHeapAllocsBytes.
+// Все символы кроме букв и цифр считаются разделителями слов.
+func metricName(prefix string, name string) string {
+	var b strings.Builder
+	b.WriteString(prefix)
+
+	upper := true
+	for _, r := range name {
+		if !unicode.IsLetter(r) && !unicode.IsDigit(r) {
+			upper = true
+			continue
+		}
+		if upper {
+			r = unicode.ToUpper(r)
+			upper = false
+		}
+		b.WriteRune(r)
+	}
+
+	return b.String()
+}
+
+func newGauge(name string, v float64) metrics.Metric {
+	return metrics.NewOmitEmpty(
+		name,
+		metrics.GaugeType,
+		metrics.PointerFromFloat64(v),
+		nil,
+	)
+}
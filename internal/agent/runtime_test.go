@@ -0,0 +1,143 @@
+package agent
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/fedoroko/practicum_go/internal/config"
+	"github.com/fedoroko/practicum_go/internal/metrics"
+)
+
+func Test_metricName(t *testing.T) {
+	tests := []struct {
+		name   string
+		prefix string
+		input  string
+		want   string
+	}{
+		{
+			name:   "simple",
+			prefix: "Go",
+			input:  "/gc/heap/allocs:bytes",
+			want:   "GoGcHeapAllocsBytes",
+		},
+		{
+			name:   "hyphens and units",
+			prefix: "",
+			input:  "/cpu/classes/gc/mark/assist:cpu-seconds",
+			want:   "CpuClassesGcMarkAssistCpuSeconds",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			assert.Equal(t, tt.want, metricName(tt.prefix, tt.input))
+		})
+	}
+}
+
+func Test_histogramQuantile(t *testing.T) {
+	buckets := []float64{0, 1, 2, 4, 8}
+	tests := []struct {
+		name   string
+		counts []uint64
+		q      float64
+		want   float64
+	}{
+		{
+			name:   "empty",
+			counts: []uint64{0, 0, 0, 0},
+			q:      0.5,
+			want:   0,
+		},
+		{
+			name:   "median",
+			counts: []uint64{1, 1, 1, 1},
+			q:      0.5,
+			want:   2,
+		},
+		{
+			name:   "p99",
+			counts: []uint64{90, 9, 0, 1},
+			q:      0.99,
+			want:   2,
+		},
+		{
+			name:   "max",
+			counts: []uint64{90, 9, 0, 1},
+			q:      1,
+			want:   8,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			assert.Equal(t, tt.want, histogramQuantile(tt.counts, buckets, tt.q))
+		})
+	}
+}
+
+func Test_runtimeCollector_collect(t *testing.T) {
+	cfg := config.NewAgentConfig()
+	cfg.RuntimeMetricsNames = []string{
+		"/sched/goroutines:goroutines=NumGoroutine",
+		"/gc/cycles/total:gc-cycles=-",
+	}
+	r := newRuntimeCollector(cfg, config.TestLogger())
+
+	metricsCh := make(chan []metrics.Metric, 1)
+	r.collect(metricsCh)
+	got := map[string]metrics.Metric{}
+	for _, m := range <-metricsCh {
+		got[m.Name()] = m
+	}
+
+	require.Contains(t, got, "NumGoroutine")
+	assert.Equal(t, metrics.GaugeType, got["NumGoroutine"].Type())
+	assert.Greater(t, got["NumGoroutine"].Float64Value(), float64(0))
+
+	assert.NotContains(t, got, "GoGcCyclesTotalGcCycles")
+	assert.Contains(t, got, "GoGcHeapAllocsBytes")
+	assert.Contains(t, got, "GoSchedLatenciesSecondsP99")
+	assert.Contains(t, got, "GoSchedLatenciesSecondsCount")
+}
+
+func Benchmark_runtimeCollector_collect(b *testing.B) {
+	r := newRuntimeCollector(config.NewAgentConfig(), config.TestLogger())
+	metricsCh := make(chan []metrics.Metric, 1)
+
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		r.collect(metricsCh)
+		<-metricsCh
+	}
+}
+
+// С RuntimeMetrics runtimeCollector заменяет getBasicMetrics
+// и должен отдавать те же имена, кроме недоступных в runtime/metrics
+func Test_runtimeCollector_legacy(t *testing.T) {
+	cfg := config.NewAgentConfig()
+	cfg.RuntimeMetrics = true
+	cfg.RuntimeMetricsNames = []string{"/gc/cycles/total:gc-cycles=-"}
+	s := newStats(cfg, config.TestLogger())
+	require.Len(t, s.collectors, 2)
+
+	metricsCh := make(chan []metrics.Metric, 1)
+	s.collectors[0](metricsCh)
+	got := map[string]metrics.Metric{}
+	for _, m := range <-metricsCh {
+		got[m.Name()] = m
+	}
+
+	getBasicMetrics(metricsCh)
+	for _, m := range <-metricsCh {
+		switch m.Name() {
+		case "LastGC", "Lookups", "PauseTotalNs":
+			assert.NotContains(t, got, m.Name())
+		default:
+			assert.Contains(t, got, m.Name())
+		}
+	}
+	assert.Greater(t, got["HeapSys"].Float64Value(), got["HeapAlloc"].Float64Value())
+	assert.NotContains(t, got, "GoGcCyclesTotalGcCycles")
+}
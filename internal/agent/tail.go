@@ -0,0 +1,262 @@
+package agent
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"os"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/fedoroko/practicum_go/internal/config"
+	"github.com/fedoroko/practicum_go/internal/metrics"
+)
+
+// maxTailLine - длина, после которой незавершенная строка
+// обрабатывается принудительно, чтобы буфер не рос бесконечно
+const maxTailLine = 64 * 1024
+
+// tailRule задается строкой вида "Name:type:regexp".
+// counter увеличивается на 1 за каждую совпавшую строку,
+// gauge принимает значение первой группы захвата.
+type tailRule struct {
+	name  string
+	mtype string
+	re    *regexp.Regexp
+}
+
+func parseTailRule(rule string) (tailRule, error) {
+	parts := strings.SplitN(rule, ":", 3)
+	if len(parts) != 3 || parts[0] == "" || parts[2] == "" {
+		return tailRule{}, fmt.Errorf("invalid tail rule %q, want Name:type:regexp", rule)
+	}
+
+	re, err := regexp.Compile(parts[2])
+	if err != nil {
+		return tailRule{}, err
+	}
+
+	switch parts[1] {
+	case metrics.CounterType:
+	case metrics.GaugeType:
+		if re.NumSubexp() < 1 {
+			return tailRule{}, fmt.Errorf("gauge rule %q needs a capture group", rule)
+		}
+	default:
+		return tailRule{}, metrics.ThrowInvalidTypeError(parts[1])
+	}
+
+	return tailRule{
+		name:  parts[0],
+		mtype: parts[1],
+		re:    re,
+	}, nil
+}
+
+type tailFile struct {
+	path    string
+	file    *os.File
+	info    os.FileInfo
+	offset  int64
+	partial []byte
+	started bool
+}
+
+// tailCollector следит за лог-файлами и применяет к новым строкам правила.
+// При старте содержимое файлов пропускается, после ротации (файл по пути
+// подменили) старый файл дочитывается, а новый читается с начала,
+// при усечении (copytruncate) чтение начинается заново.
+type tailCollector struct {
+	files    []*tailFile
+	rules    []tailRule
+	interval time.Duration
+	pending  *pendingMetrics
+	logger   *config.Logger
+}
+
+func newTailCollector(cfg *config.AgentConfig, logger *config.Logger) (*tailCollector, error) {
+	subLogger := logger.With().Str("Component", "TAIL").Logger()
+	t := &tailCollector{
+		interval: cfg.TailInterval,
+		pending:  newPendingMetrics(),
+		logger:   config.NewLogger(&subLogger),
+	}
+
+	for _, r := range cfg.TailRules {
+		rule, err := parseTailRule(r)
+		if err != nil {
+			return nil, err
+		}
+		t.rules = append(t.rules, rule)
+	}
+
+	for _, p := range cfg.TailFiles {
+		t.files = append(t.files, &tailFile{path: p})
+	}
+
+	return t, nil
+}
+
+func (t *tailCollector) listen(done <-chan struct{}) {
+	defer t.close()
+	t.run()
+
+	ticker := time.NewTicker(t.interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-done:
+			return
+		case <-ticker.C:
+			t.run()
+		}
+	}
+}
+
+func (t *tailCollector) run() {
+	for _, f := range t.files {
+		if err := t.poll(f); err != nil {
+			t.logger.Error().Err(err).Str("file", f.path).Msg("")
+		}
+	}
+}
+
+func (t *tailCollector) poll(f *tailFile) error {
+	info, err := os.Stat(f.path)
+	if err != nil {
+		// файл могли переместить при ротации, а новый еще не создан,
+		// тогда дочитываем то, что успели дописать в старый
+		if os.IsNotExist(err) {
+			f.started = true
+			if f.file != nil {
+				return t.read(f)
+			}
+			return nil
+		}
+		return err
+	}
+
+	if f.file != nil && !os.SameFile(f.info, info) {
+		if err = t.read(f); err != nil {
+			return err
+		}
+		t.flushPartial(f)
+		f.file.Close()
+		f.file = nil
+	}
+
+	if f.file == nil {
+		if err = t.open(f); err != nil {
+			return err
+		}
+	}
+
+	if info.Size() < f.offset {
+		f.offset = 0
+		f.partial = nil
+	}
+
+	return t.read(f)
+}
+
+func (t *tailCollector) open(f *tailFile) error {
+	file, err := os.Open(f.path)
+	if err != nil {
+		return err
+	}
+
+	info, err := file.Stat()
+	if err != nil {
+		file.Close()
+		return err
+	}
+
+	f.file = file
+	f.info = info
+	f.offset = 0
+	f.partial = nil
+	if !f.started {
+		f.offset = info.Size()
+		f.started = true
+	}
+
+	return nil
+}
+
+func (t *tailCollector) read(f *tailFile) error {
+	buf := make([]byte, 32*1024)
+	for {
+		n, err := f.file.ReadAt(buf, f.offset)
+		if n > 0 {
+			f.offset += int64(n)
+			t.consume(f, buf[:n])
+		}
+
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+	}
+}
+
+func (t *tailCollector) consume(f *tailFile, data []byte) {
+	data = append(f.partial, data...)
+	for {
+		i := bytes.IndexByte(data, '\n')
+		if i < 0 {
+			break
+		}
+		t.apply(string(bytes.TrimRight(data[:i], "\r")))
+		data = data[i+1:]
+	}
+
+	f.partial = append([]byte(nil), data...)
+	if len(f.partial) > maxTailLine {
+		t.flushPartial(f)
+	}
+}
+
+func (t *tailCollector) flushPartial(f *tailFile) {
+	if len(f.partial) > 0 {
+		t.apply(string(f.partial))
+	}
+	f.partial = nil
+}
+
+func (t *tailCollector) apply(line string) {
+	for _, r := range t.rules {
+		switch r.mtype {
+		case metrics.CounterType:
+			if r.re.MatchString(line) {
+				t.pending.addCounter(r.name, 1)
+			}
+		case metrics.GaugeType:
+			m := r.re.FindStringSubmatch(line)
+			if len(m) < 2 {
+				continue
+			}
+			v, err := strconv.ParseFloat(m[1], 64)
+			if err != nil {
+				t.logger.Debug().Err(err).Str("rule", r.name).Send()
+				continue
+			}
+			t.pending.setGauge(r.name, v)
+		}
+	}
+}
+
+func (t *tailCollector) collect(metricsCh chan<- []metrics.Metric) {
+	t.pending.collect(metricsCh)
+}
+
+func (t *tailCollector) close() {
+	for _, f := range t.files {
+		if f.file != nil {
+			f.file.Close()
+		}
+	}
+}
@@ -0,0 +1,129 @@
+package agent
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/fedoroko/practicum_go/internal/config"
+	"github.com/fedoroko/practicum_go/internal/metrics"
+)
+
+func Test_parseTailRule(t *testing.T) {
+	tests := []struct {
+		name    string
+		rule    string
+		wantErr bool
+	}{
+		{
+			name: "counter",
+			rule: "LogErrors:counter:ERROR",
+		},
+		{
+			name: "gauge",
+			rule: `RequestDuration:gauge:took ([0-9.]+)ms`,
+		},
+		{
+			name: "regexp with colons",
+			rule: `Slow:counter:level=warn msg="slow: \d+"`,
+		},
+		{
+			name:    "gauge without group",
+			rule:    "Bad:gauge:took",
+			wantErr: true,
+		},
+		{
+			name:    "wrong type",
+			rule:    "Bad:int:took",
+			wantErr: true,
+		},
+		{
+			name:    "bad regexp",
+			rule:    "Bad:counter:(",
+			wantErr: true,
+		},
+		{
+			name:    "no regexp",
+			rule:    "Bad:counter",
+			wantErr: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := parseTailRule(tt.rule)
+			if tt.wantErr {
+				assert.Error(t, err)
+			} else {
+				assert.NoError(t, err)
+			}
+		})
+	}
+}
+
+func appendFile(t *testing.T, path string, data string) {
+	f, err := os.OpenFile(path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
+	require.NoError(t, err)
+	defer f.Close()
+	_, err = f.WriteString(data)
+	require.NoError(t, err)
+}
+
+func collectTail(tc *tailCollector) map[string]string {
+	metricsCh := make(chan []metrics.Metric, 1)
+	tc.collect(metricsCh)
+
+	ret := map[string]string{}
+	for _, m := range <-metricsCh {
+		ret[m.Name()] = m.ToString()
+	}
+	return ret
+}
+
+func Test_tailCollector(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "app.log")
+	appendFile(t, path, "ERROR old line must be skipped\n")
+
+	cfg := config.NewAgentConfig()
+	cfg.TailFiles = []string{path}
+	cfg.TailRules = []string{
+		"LogErrors:counter:ERROR",
+		`RequestDuration:gauge:took ([0-9.]+)ms`,
+	}
+	tc, err := newTailCollector(cfg, config.TestLogger())
+	require.NoError(t, err)
+	defer tc.close()
+
+	tc.run()
+	assert.Empty(t, collectTail(tc))
+
+	appendFile(t, path, "INFO took 12.5ms\nERROR boom\nERROR bo")
+	tc.run()
+	assert.Equal(t, map[string]string{"LogErrors": "1", "RequestDuration": "12.5"}, collectTail(tc))
+
+	appendFile(t, path, "om\nINFO took 3ms\n")
+	tc.run()
+	assert.Equal(t, map[string]string{"LogErrors": "1", "RequestDuration": "3"}, collectTail(tc))
+
+	t.Run("truncate", func(t *testing.T) {
+		require.NoError(t, os.Truncate(path, 0))
+		appendFile(t, path, "ERROR after truncate\n")
+		tc.run()
+		assert.Equal(t, "1", collectTail(tc)["LogErrors"])
+	})
+
+	t.Run("rotate", func(t *testing.T) {
+		appendFile(t, path, "ERROR before rotate\n")
+		require.NoError(t, os.Rename(path, path+".1"))
+		appendFile(t, path+".1", "ERROR written late to old file\n")
+
+		tc.run()
+		assert.Equal(t, "2", collectTail(tc)["LogErrors"])
+
+		appendFile(t, path, "ERROR new file\nERROR new file\n")
+		tc.run()
+		assert.Equal(t, "2", collectTail(tc)["LogErrors"])
+	})
+}
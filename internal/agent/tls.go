@@ -0,0 +1,65 @@
+package agent
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+
+	"github.com/fedoroko/practicum_go/internal/config"
+)
+
+// tlsEnabled - адреса без схемы отправляются по HTTPS
+func tlsEnabled(cfg *config.AgentConfig) bool {
+	return cfg.TLS || cfg.TLSCA != "" || cfg.TLSCert != "" || cfg.TLSServerName != ""
+}
+
+// baseURL добавляет к адресу сервера схему, если она не указана явно
+func baseURL(cfg *config.AgentConfig, addr string) string {
+	if strings.Contains(addr, "://") {
+		return strings.TrimSuffix(addr, "/")
+	}
+	if tlsEnabled(cfg) {
+		return "https://" + addr
+	}
+	return "http://" + addr
+}
+
+// newTLSConfig возвращает nil, если TLS не настроен;
+// без TLSCA сервер проверяется по системным корневым сертификатам
+func newTLSConfig(cfg *config.AgentConfig) (*tls.Config, error) {
+	if !tlsEnabled(cfg) {
+		return nil, nil
+	}
+
+	c := &tls.Config{
+		ServerName: cfg.TLSServerName,
+		MinVersion: tls.VersionTLS12,
+	}
+
+	if cfg.TLSCA != "" {
+		data, err := os.ReadFile(cfg.TLSCA)
+		if err != nil {
+			return nil, err
+		}
+		c.RootCAs = x509.NewCertPool()
+		if !c.RootCAs.AppendCertsFromPEM(data) {
+			return nil, fmt.Errorf("%s: no certificates found", cfg.TLSCA)
+		}
+	}
+
+	if (cfg.TLSCert == "") != (cfg.TLSKey == "") {
+		return nil, errors.New("client certificate and key must be set together")
+	}
+	if cfg.TLSCert != "" {
+		cert, err := tls.LoadX509KeyPair(cfg.TLSCert, cfg.TLSKey)
+		if err != nil {
+			return nil, err
+		}
+		c.Certificates = []tls.Certificate{cert}
+	}
+
+	return c, nil
+}
@@ -0,0 +1,164 @@
+package agent
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"net/http/httptest"
+	"os"
+	"testing"
+
+	"github.com/go-resty/resty/v2"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/fedoroko/practicum_go/internal/config"
+	"github.com/fedoroko/practicum_go/internal/testcerts"
+)
+
+func Test_baseURL(t *testing.T) {
+	tests := []struct {
+		name string
+		tls  bool
+		addr string
+		want string
+	}{
+		{
+			name: "plain",
+			addr: "127.0.0.1:8080",
+			want: "http://127.0.0.1:8080",
+		},
+		{
+			name: "tls",
+			tls:  true,
+			addr: "127.0.0.1:8080",
+			want: "https://127.0.0.1:8080",
+		},
+		{
+			name: "explicit scheme",
+			addr: "https://metrics.local/",
+			want: "https://metrics.local",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg := config.NewAgentConfig()
+			cfg.TLS = tt.tls
+			assert.Equal(t, tt.want, baseURL(cfg, tt.addr))
+		})
+	}
+}
+
+func Test_stats_report_tls(t *testing.T) {
+	certs := testcerts.Generate(t)
+
+	srv := &counterServer{values: map[string]int64{}}
+
+	tests := []struct {
+		name       string
+		serverName string
+		clientCert bool
+		ca         string
+		wantOK     bool
+	}{
+		{
+			name:       "mtls",
+			ca:         certs.CA,
+			clientCert: true,
+			wantOK:     true,
+		},
+		{
+			name:       "server name",
+			ca:         certs.CA,
+			serverName: testcerts.ServerName,
+			clientCert: true,
+			wantOK:     true,
+		},
+		{
+			name: "no client certificate",
+			ca:   certs.CA,
+		},
+		{
+			name:       "wrong server name",
+			ca:         certs.CA,
+			serverName: "other.local",
+			clientCert: true,
+		},
+		{
+			name:       "unknown ca",
+			clientCert: true,
+		},
+	}
+
+	// сервер требует клиентский сертификат от того же CA
+	serverCert, err := tls.LoadX509KeyPair(certs.ServerCert, certs.ServerKey)
+	require.NoError(t, err)
+	caData, err := os.ReadFile(certs.CA)
+	require.NoError(t, err)
+	clientCAs := x509.NewCertPool()
+	require.True(t, clientCAs.AppendCertsFromPEM(caData))
+
+	ts := httptest.NewUnstartedServer(srv)
+	ts.TLS = &tls.Config{
+		Certificates: []tls.Certificate{serverCert},
+		ClientCAs:    clientCAs,
+		ClientAuth:   tls.RequireAndVerifyClientCert,
+	}
+	ts.StartTLS()
+	defer ts.Close()
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg := config.NewAgentConfig()
+			cfg.Address = ts.Listener.Addr().String()
+			cfg.Compress = CompressNone
+			cfg.TLS = true
+			cfg.TLSCA = tt.ca
+			cfg.TLSServerName = tt.serverName
+			if tt.clientCert {
+				cfg.TLSCert, cfg.TLSKey = certs.ClientCert, certs.ClientKey
+			}
+
+			s := newStats(cfg, config.TestLogger())
+			s.tls, err = newTLSConfig(cfg)
+			require.NoError(t, err)
+			c := resty.New()
+			s.prepare(c)
+
+			assert.Equal(t, tt.wantOK, s.report(context.Background(), c, testBatch(1, 1)))
+		})
+	}
+	assert.Equal(t, int64(2), srv.value("PollCount"))
+}
+
+func Test_newTLSConfig_errors(t *testing.T) {
+	certs := testcerts.Generate(t)
+
+	tests := []struct {
+		name string
+		cfg  *config.AgentConfig
+	}{
+		{
+			name: "cert without key",
+			cfg:  &config.AgentConfig{TLSCert: certs.ClientCert},
+		},
+		{
+			name: "not a ca bundle",
+			cfg:  &config.AgentConfig{TLSCA: certs.ClientKey},
+		},
+		{
+			name: "missing ca",
+			cfg:  &config.AgentConfig{TLSCA: certs.CA + ".missing"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := newTLSConfig(tt.cfg)
+			assert.Error(t, err)
+		})
+	}
+
+	got, err := newTLSConfig(config.NewAgentConfig())
+	require.NoError(t, err)
+	assert.Nil(t, got)
+}
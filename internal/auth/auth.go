@@ -0,0 +1,102 @@
+// Package auth проверяет bearer-токены агентов и пользователей.
+// Токен дает набор прав (write, read, admin) и, опционально,
+// префикс имен метрик, с которыми ему разрешено работать.
+// В хранилищах лежит только sha256 от токена.
+package auth
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"strings"
+)
+
+const (
+	ScopeWrite = "write"
+	ScopeRead  = "read"
+	// ScopeAdmin включает все остальные права
+	ScopeAdmin = "admin"
+)
+
+var ErrUnknownToken = errors.New("unknown token")
+
+// ErrUnavailable - хранилище токенов временно не отвечает
+var ErrUnavailable = errors.New("token store is unavailable")
+
+type Token struct {
+	Name   string   `json:"name"`
+	Hash   string   `json:"hash"`
+	Scopes []string `json:"scopes"`
+	Prefix string   `json:"prefix,omitempty"`
+}
+
+// Allows проверяет право токена; nil означает, что аутентификация выключена
+func (t *Token) Allows(scope string) bool {
+	if t == nil {
+		return true
+	}
+
+	for _, s := range t.Scopes {
+		if s == scope || s == ScopeAdmin {
+			return true
+		}
+	}
+
+	return false
+}
+
+// AllowsMetric проверяет имя метрики по префиксу токена
+func (t *Token) AllowsMetric(name string) bool {
+	return t == nil || strings.HasPrefix(name, t.Prefix)
+}
+
+type Store interface {
+	Lookup(ctx context.Context, token string) (*Token, error)
+}
+
+// Hash возвращает hex sha256 токена в том виде, в каком он хранится
+func Hash(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
+
+func validScope(scope string) bool {
+	switch scope {
+	case ScopeWrite, ScopeRead, ScopeAdmin:
+		return true
+	}
+	return false
+}
+
+// chain опрашивает хранилища по очереди
+type chain []Store
+
+func (c chain) Lookup(ctx context.Context, token string) (*Token, error) {
+	for _, s := range c {
+		t, err := s.Lookup(ctx, token)
+		if errors.Is(err, ErrUnknownToken) {
+			continue
+		}
+		return t, err
+	}
+
+	return nil, ErrUnknownToken
+}
+
+// Chain объединяет хранилища, первое знающее токен побеждает
+func Chain(stores ...Store) Store {
+	return chain(stores)
+}
+
+type ctxKey struct{}
+
+func NewContext(ctx context.Context, t *Token) context.Context {
+	return context.WithValue(ctx, ctxKey{}, t)
+}
+
+// FromContext возвращает токен запроса или nil, если аутентификация выключена
+func FromContext(ctx context.Context) *Token {
+	t, _ := ctx.Value(ctxKey{}).(*Token)
+	return t
+}
@@ -0,0 +1,174 @@
+package auth
+
+import (
+	"context"
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestToken_Allows(t *testing.T) {
+	tests := []struct {
+		name   string
+		token  *Token
+		scope  string
+		metric string
+		want   bool
+	}{
+		{
+			name:   "scope granted",
+			token:  &Token{Scopes: []string{ScopeWrite}},
+			scope:  ScopeWrite,
+			metric: "Alloc",
+			want:   true,
+		},
+		{
+			name:   "scope missing",
+			token:  &Token{Scopes: []string{ScopeWrite}},
+			scope:  ScopeRead,
+			metric: "Alloc",
+			want:   false,
+		},
+		{
+			name:   "admin",
+			token:  &Token{Scopes: []string{ScopeAdmin}},
+			scope:  ScopeRead,
+			metric: "Alloc",
+			want:   true,
+		},
+		{
+			name:   "prefix mismatch",
+			token:  &Token{Scopes: []string{ScopeWrite}, Prefix: "web_"},
+			scope:  ScopeWrite,
+			metric: "db_Alloc",
+			want:   false,
+		},
+		{
+			name:   "prefix match",
+			token:  &Token{Scopes: []string{ScopeWrite}, Prefix: "web_"},
+			scope:  ScopeWrite,
+			metric: "web_Alloc",
+			want:   true,
+		},
+		{
+			name:   "auth disabled",
+			scope:  ScopeAdmin,
+			metric: "Alloc",
+			want:   true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := tt.token.Allows(tt.scope) && tt.token.AllowsMetric(tt.metric)
+			assert.Equal(t, tt.want, got)
+		})
+	}
+}
+
+func TestNewFileStore(t *testing.T) {
+	write := func(data string) string {
+		path := filepath.Join(t.TempDir(), "tokens.json")
+		require.NoError(t, os.WriteFile(path, []byte(data), 0600))
+		return path
+	}
+
+	tests := []struct {
+		name    string
+		data    string
+		token   string
+		want    string
+		wantErr bool
+	}{
+		{
+			name:  "found",
+			data:  `[{"name":"agent","hash":"` + Hash("secret") + `","scopes":["write"],"prefix":"agent_"}]`,
+			token: "secret",
+			want:  "agent",
+		},
+		{
+			name:  "unknown",
+			data:  `[{"name":"agent","hash":"` + Hash("secret") + `","scopes":["write"]}]`,
+			token: "other",
+		},
+		{
+			name:    "plain token instead of hash",
+			data:    `[{"name":"agent","hash":"secret","scopes":["write"]}]`,
+			wantErr: true,
+		},
+		{
+			name:    "unknown scope",
+			data:    `[{"name":"agent","hash":"` + Hash("secret") + `","scopes":["root"]}]`,
+			wantErr: true,
+		},
+		{
+			name:    "broken json",
+			data:    `{`,
+			wantErr: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s, err := NewFileStore(write(tt.data))
+			if tt.wantErr {
+				assert.Error(t, err)
+				return
+			}
+			require.NoError(t, err)
+
+			got, err := s.Lookup(context.Background(), tt.token)
+			if tt.want == "" {
+				assert.ErrorIs(t, err, ErrUnknownToken)
+				return
+			}
+			require.NoError(t, err)
+			assert.Equal(t, tt.want, got.Name)
+		})
+	}
+}
+
+type mapStore map[string]*Token
+
+func (m mapStore) Lookup(_ context.Context, token string) (*Token, error) {
+	if token == "broken" {
+		return nil, errors.New("db is down")
+	}
+	t, ok := m[token]
+	if !ok {
+		return nil, ErrUnknownToken
+	}
+	return t, nil
+}
+
+func TestChain(t *testing.T) {
+	ctx := context.Background()
+	s := Chain(
+		mapStore{"a": {Name: "file a"}},
+		mapStore{"a": {Name: "db a"}, "b": {Name: "db b"}},
+	)
+
+	got, err := s.Lookup(ctx, "a")
+	require.NoError(t, err)
+	assert.Equal(t, "file a", got.Name)
+
+	got, err = s.Lookup(ctx, "b")
+	require.NoError(t, err)
+	assert.Equal(t, "db b", got.Name)
+
+	_, err = s.Lookup(ctx, "c")
+	assert.ErrorIs(t, err, ErrUnknownToken)
+
+	_, err = s.Lookup(ctx, "broken")
+	assert.Error(t, err)
+	assert.NotErrorIs(t, err, ErrUnknownToken)
+}
+
+func TestFromContext(t *testing.T) {
+	assert.Nil(t, FromContext(context.Background()))
+
+	token := &Token{Name: "agent"}
+	assert.Equal(t, token, FromContext(NewContext(context.Background(), token)))
+}
@@ -0,0 +1,50 @@
+package auth
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"os"
+)
+
+// fileStore читает токены из JSON файла вида
+// [{"name":"agent-1","hash":"<sha256 hex>","scopes":["write"],"prefix":"agent1_"}]
+type fileStore struct {
+	tokens map[string]*Token
+}
+
+func NewFileStore(path string) (Store, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	var tokens []*Token
+	if err = json.Unmarshal(data, &tokens); err != nil {
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+
+	s := &fileStore{tokens: make(map[string]*Token, len(tokens))}
+	for _, t := range tokens {
+		if len(t.Hash) != 64 {
+			return nil, fmt.Errorf("%s: token %q: hash must be sha256 hex", path, t.Name)
+		}
+		for _, scope := range t.Scopes {
+			if !validScope(scope) {
+				return nil, fmt.Errorf("%s: token %q: unknown scope %q", path, t.Name, scope)
+			}
+		}
+		s.tokens[t.Hash] = t
+	}
+
+	return s, nil
+}
+
+func (s *fileStore) Lookup(_ context.Context, token string) (*Token, error) {
+	t, ok := s.tokens[Hash(token)]
+	if !ok {
+		return nil, ErrUnknownToken
+	}
+
+	return t, nil
+}
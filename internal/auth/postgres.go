@@ -0,0 +1,56 @@
+package auth
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+)
+
+// таблицу auth_tokens создают миграции хранилища метрик
+const lookupQuery string = `SELECT name, scopes, prefix
+							FROM auth_tokens
+							WHERE hash = $1;`
+
+// postgresStore хранит токены в таблице auth_tokens,
+// права перечисляются через запятую: "write,read"
+type postgresStore struct {
+	db      *sql.DB
+	timeout time.Duration
+}
+
+// NewPostgresStore использует пул хранилища метрик, timeout 0 - без ограничения
+func NewPostgresStore(db *sql.DB, timeout time.Duration) Store {
+	return &postgresStore{db: db, timeout: timeout}
+}
+
+// Lookup возвращает ErrUnavailable, пока база недоступна
+// или миграции еще не создали таблицу
+func (p *postgresStore) Lookup(ctx context.Context, token string) (*Token, error) {
+	if p.timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, p.timeout)
+		defer cancel()
+	}
+
+	t := &Token{Hash: Hash(token)}
+	var scopes string
+
+	err := p.db.QueryRowContext(ctx, lookupQuery, t.Hash).Scan(&t.Name, &scopes, &t.Prefix)
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, ErrUnknownToken
+	}
+	if err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrUnavailable, err)
+	}
+
+	for _, s := range strings.Split(scopes, ",") {
+		if s = strings.TrimSpace(s); s != "" {
+			t.Scopes = append(t.Scopes, s)
+		}
+	}
+
+	return t, nil
+}
@@ -24,6 +24,52 @@ type ServerConfig struct {
 	Key           string        `env:"KEY"`
 	Database      string        `env:"DATABASE_DSN"`
 	Debug         bool
+
+	// QueryTimeout ограничивает каждый запрос к базе, 0 - без ограничения
+	QueryTimeout time.Duration `env:"QUERY_TIMEOUT"`
+	// DBRetries - число повторов запроса при временной ошибке базы,
+	// пауза между ними начинается с DBRetryBackoff и удваивается
+	DBRetries      int           `env:"DB_RETRIES"`
+	DBRetryBackoff time.Duration `env:"DB_RETRY_BACKOFF"`
+	// DBReconnectInterval - как часто подключаться к базе, недоступной при старте
+	DBReconnectInterval time.Duration `env:"DB_RECONNECT_INTERVAL"`
+	// Cache включает write-behind кэш перед базой: записи копятся в памяти
+	// и сбрасываются раз в CacheFlushInterval или при CacheFlushSize метрик
+	Cache              bool          `env:"CACHE"`
+	CacheFlushInterval time.Duration `env:"CACHE_FLUSH_INTERVAL"`
+	CacheFlushSize     int           `env:"CACHE_FLUSH_SIZE"`
+	// CacheMaxPending - сколько несброшенных метрик кэш держит, пока база
+	// не принимает сброс; сверх него записи отклоняются как при недоступной базе
+	CacheMaxPending int `env:"CACHE_MAX_PENDING"`
+
+	// Keys - дополнительные ключи подписи вида id=secret,
+	// ответы подписываются ключом SigningKeyID (пустой - ключ из Key)
+	Keys         []string `env:"KEYS" envSeparator:";"`
+	SigningKeyID string   `env:"SIGNING_KEY_ID"`
+	// ReplayWindow - допустимый возраст подписанной метрики,
+	// повторы nonce внутри окна отклоняются; 0 выключает проверку.
+	// С ключом неподписанные метрики тогда не принимаются.
+	ReplayWindow time.Duration `env:"REPLAY_WINDOW"`
+	// LegacyHash принимает подписи старого формата "name:type:%f"
+	// от агентов, которые еще не обновлены. Старый формат не покрывает
+	// ts и nonce, поэтому сервер не стартует вместе с ReplayWindow.
+	LegacyHash bool `env:"LEGACY_HASH"`
+
+	// MaxBodySize ограничивает тело запроса после распаковки
+	MaxBodySize int64 `env:"MAX_BODY_SIZE"`
+	// CryptoKey - закрытый ключ для расшифровки тел запросов агента
+	CryptoKey string `env:"CRYPTO_KEY"`
+	// TrustedSubnet - CIDR агентов, которым разрешена запись метрик
+	TrustedSubnet string `env:"TRUSTED_SUBNET"`
+	// TokensFile и TokensDB включают аутентификацию по bearer-токенам,
+	// TokensDB читает таблицу auth_tokens из Postgres в Database
+	TokensFile string `env:"TOKENS_FILE"`
+	TokensDB   bool   `env:"TOKENS_DB"`
+	// TLSCert и TLSKey включают HTTPS, TLSClientCA - проверку
+	// клиентских сертификатов агентов
+	TLSCert     string `env:"TLS_CERT"`
+	TLSKey      string `env:"TLS_KEY"`
+	TLSClientCA string `env:"TLS_CLIENT_CA"`
 }
 
 func (s *ServerConfig) Flags() *ServerConfig {
@@ -32,7 +78,30 @@ func (s *ServerConfig) Flags() *ServerConfig {
 	flag.DurationVar(&s.StoreInterval, "i", time.Second*300, "Store interval")
 	flag.StringVar(&s.StoreFile, "f", "/tmp/devops-metrics-db.json", "Store file path")
 	flag.StringVar(&s.Key, "k", "", "Key for hashing")
-	flag.StringVar(&s.Database, "d", "", "Database DSN")
+	flag.Func("keys", "Hashing key id=secret, can be repeated", func(k string) error {
+		s.Keys = append(s.Keys, k)
+		return nil
+	})
+	flag.StringVar(&s.SigningKeyID, "kid", "", "Key id to sign responses with")
+	flag.DurationVar(&s.ReplayWindow, "rw", 0, "Max age of signed metrics, 0 disables replay protection")
+	flag.BoolVar(&s.LegacyHash, "legacy-hash", false, "Accept and sign with the legacy hash format")
+	flag.StringVar(&s.Database, "d", "", "Database DSN, bolt:///path/to/file.db selects the embedded store")
+	flag.DurationVar(&s.QueryTimeout, "qt", time.Second*5, "Database query timeout, 0 disables it")
+	flag.IntVar(&s.DBRetries, "dbr", 3, "Retries of a database query on transient errors")
+	flag.DurationVar(&s.DBRetryBackoff, "dbb", time.Millisecond*100, "Initial pause between database retries")
+	flag.DurationVar(&s.DBReconnectInterval, "dbri", time.Second*5, "Reconnect interval while the database is unavailable")
+	flag.BoolVar(&s.Cache, "cache", false, "Write-behind cache in front of the database")
+	flag.DurationVar(&s.CacheFlushInterval, "cfi", time.Second, "Cache flush interval, 0 flushes by size only")
+	flag.IntVar(&s.CacheFlushSize, "cfs", 1000, "Pending metrics that trigger a cache flush, 0 disables it")
+	flag.IntVar(&s.CacheMaxPending, "cmp", 100000, "Pending metrics the cache holds before rejecting writes, 0 is unlimited")
+	flag.Int64Var(&s.MaxBodySize, "mb", 10<<20, "Max decompressed request body size in bytes")
+	flag.StringVar(&s.CryptoKey, "crypto-key", "", "Private key to decrypt agent payloads (PEM)")
+	flag.StringVar(&s.TrustedSubnet, "t", "", "Trusted agents subnet (CIDR)")
+	flag.StringVar(&s.TokensFile, "tokens", "", "API tokens file (JSON)")
+	flag.BoolVar(&s.TokensDB, "tokens-db", false, "Read API tokens from the database")
+	flag.StringVar(&s.TLSCert, "tls-cert", "", "Server TLS certificate (PEM)")
+	flag.StringVar(&s.TLSKey, "tls-key", "", "Server TLS private key (PEM)")
+	flag.StringVar(&s.TLSClientCA, "tls-client-ca", "", "CA bundle to verify agent certificates (PEM)")
 	flag.BoolVar(&s.Debug, "debug", false, "Debug mode")
 	flag.Parse()
 
@@ -54,6 +123,16 @@ func NewServerConfig() *ServerConfig {
 		Restore:       false,
 		StoreInterval: time.Second * 300,
 		StoreFile:     "/tmp/devops-metrics-db.json",
+		MaxBodySize:   10 << 20,
+		QueryTimeout:  time.Second * 5,
+
+		DBRetries:           3,
+		DBRetryBackoff:      time.Millisecond * 100,
+		DBReconnectInterval: time.Second * 5,
+
+		CacheFlushInterval: time.Second,
+		CacheFlushSize:     1000,
+		CacheMaxPending:    100000,
 	}
 }
 
@@ -61,17 +140,114 @@ type AgentConfig struct {
 	Address          string        `env:"ADDRESS"`
 	PollInterval     time.Duration `env:"POLL_INTERVAL"`
 	ReportInterval   time.Duration `env:"REPORT_INTERVAL"`
-	ShutdownInterval time.Duration
+	ShutdownInterval time.Duration `env:"SHUTDOWN_INTERVAL"`
 	ContentType      string
-	Key              string `env:"KEY"`
+	Key              string        `env:"KEY"`
+	KeyID            string        `env:"KEY_ID"`
+	LegacyHash       bool          `env:"LEGACY_HASH"`
+	ExecCommands     []string      `env:"EXEC_COMMANDS" envSeparator:";"`
+	ExecInterval     time.Duration `env:"EXEC_INTERVAL"`
+	ExecTimeout      time.Duration `env:"EXEC_TIMEOUT"`
 	Debug            bool
+
+	RuntimeMetrics       bool     `env:"RUNTIME_METRICS"`
+	RuntimeMetricsPrefix string   `env:"RUNTIME_METRICS_PREFIX"`
+	RuntimeMetricsNames  []string `env:"RUNTIME_METRICS_NAMES" envSeparator:";"`
+
+	CgroupMetrics bool     `env:"CGROUP_METRICS"`
+	CgroupRoot    string   `env:"CGROUP_ROOT"`
+	CgroupPaths   []string `env:"CGROUP_PATHS" envSeparator:";"`
+
+	TailFiles    []string      `env:"TAIL_FILES" envSeparator:";"`
+	TailRules    []string      `env:"TAIL_RULES" envSeparator:"\n"`
+	TailInterval time.Duration `env:"TAIL_INTERVAL"`
+
+	QueueDir     string        `env:"QUEUE_DIR"`
+	QueueMaxSize int64         `env:"QUEUE_MAX_SIZE"`
+	QueueMaxAge  time.Duration `env:"QUEUE_MAX_AGE"`
+
+	CounterMode      string `env:"COUNTER_MODE"`
+	CounterStateFile string `env:"COUNTER_STATE_FILE"`
+
+	Aggregates []string `env:"AGGREGATES" envSeparator:";"`
+
+	RateLimit int  `env:"RATE_LIMIT"`
+	Batch     bool `env:"BATCH"`
+
+	// Address может содержать несколько серверов через запятую
+	EndpointMode string `env:"ENDPOINT_MODE"`
+
+	// Compress по умолчанию выключен: сервер старше распаковки отклонил бы
+	// сжатые тела, gzip включается после обновления всех серверов
+	Compress string `env:"COMPRESS"`
+	// CryptoKey - открытый ключ или сертификат сервера для шифрования тел запросов
+	CryptoKey string `env:"CRYPTO_KEY"`
+	// Token отправляется в заголовке Authorization: Bearer
+	Token string `env:"TOKEN"`
+	// TLS включает HTTPS для адресов без схемы; TLSCA, TLSCert/TLSKey
+	// и TLSServerName настраивают проверку сервера и клиентский сертификат
+	TLS           bool   `env:"TLS"`
+	TLSCA         string `env:"TLS_CA"`
+	TLSCert       string `env:"TLS_CERT"`
+	TLSKey        string `env:"TLS_KEY"`
+	TLSServerName string `env:"TLS_SERVER_NAME"`
 }
 
 func (a *AgentConfig) Flags() *AgentConfig {
-	flag.StringVar(&a.Address, "a", "127.0.0.1:8080", "Host address")
+	flag.StringVar(&a.Address, "a", "127.0.0.1:8080", "Host address, comma separated for several servers")
 	flag.DurationVar(&a.PollInterval, "p", time.Second*2, "Poll count interval")
 	flag.DurationVar(&a.ReportInterval, "r", time.Second*10, "Report interval")
 	flag.StringVar(&a.Key, "k", "", "Key for hashing")
+	flag.StringVar(&a.KeyID, "kid", "", "Id of the hashing key on the server")
+	flag.BoolVar(&a.LegacyHash, "legacy-hash", false, "Sign with the legacy hash format for old servers")
+	flag.Func("e", "Exec command, can be repeated", func(c string) error {
+		a.ExecCommands = append(a.ExecCommands, c)
+		return nil
+	})
+	flag.DurationVar(&a.ExecInterval, "ei", time.Second*10, "Exec commands interval")
+	flag.DurationVar(&a.ExecTimeout, "et", time.Second*5, "Exec command timeout")
+	flag.BoolVar(&a.RuntimeMetrics, "rt", false, "Collect runtime/metrics instead of stop-the-world ReadMemStats")
+	flag.StringVar(&a.RuntimeMetricsPrefix, "rtp", "Go", "Runtime metrics name prefix")
+	flag.Func("rtn", "Runtime metric name mapping /name:unit=MetricName, can be repeated", func(m string) error {
+		a.RuntimeMetricsNames = append(a.RuntimeMetricsNames, m)
+		return nil
+	})
+	flag.BoolVar(&a.CgroupMetrics, "cg", false, "Collect cgroup v2 metrics")
+	flag.StringVar(&a.CgroupRoot, "cgr", "/sys/fs/cgroup", "Cgroup v2 mount point")
+	flag.Func("cgp", "Cgroup path [Label=]path relative to mount point, can be repeated", func(p string) error {
+		a.CgroupPaths = append(a.CgroupPaths, p)
+		return nil
+	})
+	flag.Func("tf", "Log file to tail, can be repeated", func(f string) error {
+		a.TailFiles = append(a.TailFiles, f)
+		return nil
+	})
+	flag.Func("tr", "Log rule Name:type:regexp, can be repeated", func(r string) error {
+		a.TailRules = append(a.TailRules, r)
+		return nil
+	})
+	flag.DurationVar(&a.TailInterval, "ti", time.Second, "Log files check interval")
+	flag.StringVar(&a.QueueDir, "q", "", "Directory for unsent batches, empty disables the queue")
+	flag.Int64Var(&a.QueueMaxSize, "qs", 10<<20, "Queue max size in bytes")
+	flag.DurationVar(&a.QueueMaxAge, "qa", time.Hour, "Queue max batch age")
+	flag.StringVar(&a.CounterMode, "cm", "delta", "Counter mode: delta or cumulative")
+	flag.StringVar(&a.CounterStateFile, "cs", "", "Counter state file, keeps counters between restarts")
+	flag.Func("ag", "Gauge aggregates pattern=agg,agg (last,min,max,avg,sum,count,pNN), can be repeated", func(r string) error {
+		a.Aggregates = append(a.Aggregates, r)
+		return nil
+	})
+	flag.IntVar(&a.RateLimit, "l", 10, "Max concurrent outbound requests")
+	flag.BoolVar(&a.Batch, "b", true, "Send metrics in batches, otherwise one request per metric")
+	flag.DurationVar(&a.ShutdownInterval, "si", time.Second*5, "Final report timeout on shutdown")
+	flag.StringVar(&a.EndpointMode, "em", "failover", "Several servers mode: failover or fanout")
+	flag.StringVar(&a.Compress, "z", "none", "Request body compression: gzip (servers must support it) or none")
+	flag.StringVar(&a.CryptoKey, "crypto-key", "", "Server public key to encrypt payloads (PEM)")
+	flag.StringVar(&a.Token, "token", "", "API token")
+	flag.BoolVar(&a.TLS, "tls", false, "Use HTTPS for addresses without a scheme")
+	flag.StringVar(&a.TLSCA, "tls-ca", "", "CA bundle to verify the server (PEM)")
+	flag.StringVar(&a.TLSCert, "tls-cert", "", "Client TLS certificate (PEM)")
+	flag.StringVar(&a.TLSKey, "tls-key", "", "Client TLS private key (PEM)")
+	flag.StringVar(&a.TLSServerName, "tls-server-name", "", "Expected server name in its certificate")
 	flag.BoolVar(&a.Debug, "debug", false, "Debug mode - bool")
 	flag.Parse()
 
@@ -92,8 +268,21 @@ func NewAgentConfig() *AgentConfig {
 		Address:          "127.0.0.1:8080",
 		PollInterval:     time.Second * 2,
 		ReportInterval:   time.Second * 10,
-		ShutdownInterval: time.Second * 500,
+		ShutdownInterval: time.Second * 5,
 		ContentType:      "text/plain",
+		ExecInterval:     time.Second * 10,
+		ExecTimeout:      time.Second * 5,
+
+		RuntimeMetricsPrefix: "Go",
+		CgroupRoot:           "/sys/fs/cgroup",
+		TailInterval:         time.Second,
+		QueueMaxSize:         10 << 20,
+		QueueMaxAge:          time.Hour,
+		CounterMode:          "delta",
+		RateLimit:            10,
+		Batch:                true,
+		EndpointMode:         "failover",
+		Compress:             "none",
 	}
 }
 
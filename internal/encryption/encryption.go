@@ -0,0 +1,260 @@
+// Package encryption шифрует тела запросов агента открытым ключом сервера.
+// Схема гибридная: тело шифруется AES-256-GCM на случайном ключе,
+// а сам ключ - RSA-OAEP или выводится через ECDH на P-256
+// с эфемерным ключом агента.
+package encryption
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+)
+
+// Header содержит алгоритм, которым зашифровано тело запроса
+const Header = "X-Encryption"
+
+const (
+	AlgRSA  = "rsa-oaep-aes-gcm"
+	AlgECDH = "ecdh-p256-aes-gcm"
+)
+
+const keySize = 32
+
+var ErrDecrypt = errors.New("cannot decrypt payload")
+
+// Encrypter шифрует данные открытым ключом сервера
+type Encrypter struct {
+	alg string
+	rsa *rsa.PublicKey
+	ec  *ecdsa.PublicKey
+}
+
+// NewEncrypter читает PEM с открытым ключом (PUBLIC KEY, RSA PUBLIC KEY)
+// или сертификатом сервера
+func NewEncrypter(path string) (*Encrypter, error) {
+	block, err := readPEM(path)
+	if err != nil {
+		return nil, err
+	}
+
+	var key interface{}
+	switch block.Type {
+	case "CERTIFICATE":
+		cert, err := x509.ParseCertificate(block.Bytes)
+		if err != nil {
+			return nil, err
+		}
+		key = cert.PublicKey
+	case "RSA PUBLIC KEY":
+		key, err = x509.ParsePKCS1PublicKey(block.Bytes)
+	default:
+		key, err = x509.ParsePKIXPublicKey(block.Bytes)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	switch k := key.(type) {
+	case *rsa.PublicKey:
+		return &Encrypter{alg: AlgRSA, rsa: k}, nil
+	case *ecdsa.PublicKey:
+		if k.Curve != elliptic.P256() {
+			return nil, fmt.Errorf("unsupported curve %s", k.Curve.Params().Name)
+		}
+		return &Encrypter{alg: AlgECDH, ec: k}, nil
+	default:
+		return nil, fmt.Errorf("unsupported public key %T", key)
+	}
+}
+
+func (e *Encrypter) Alg() string {
+	return e.alg
+}
+
+// Encrypt возвращает зашифрованный ключ (или эфемерный открытый ключ),
+// nonce и шифротекст одним куском
+func (e *Encrypter) Encrypt(data []byte) ([]byte, error) {
+	var (
+		header []byte
+		key    []byte
+		err    error
+	)
+
+	switch e.alg {
+	case AlgRSA:
+		key = make([]byte, keySize)
+		if _, err = io.ReadFull(rand.Reader, key); err != nil {
+			return nil, err
+		}
+		header, err = rsa.EncryptOAEP(sha256.New(), rand.Reader, e.rsa, key, nil)
+		if err != nil {
+			return nil, err
+		}
+	case AlgECDH:
+		eph, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+		if err != nil {
+			return nil, err
+		}
+		header = elliptic.Marshal(elliptic.P256(), eph.X, eph.Y)
+		key = sharedKey(e.ec, eph.D.Bytes(), header)
+	}
+
+	aead, err := newAEAD(key)
+	if err != nil {
+		return nil, err
+	}
+
+	nonce := make([]byte, aead.NonceSize())
+	if _, err = io.ReadFull(rand.Reader, nonce); err != nil {
+		return nil, err
+	}
+
+	out := make([]byte, 0, len(header)+len(nonce)+len(data)+aead.Overhead())
+	out = append(out, header...)
+	out = append(out, nonce...)
+	return aead.Seal(out, nonce, data, nil), nil
+}
+
+// Decrypter расшифровывает данные закрытым ключом сервера
+type Decrypter struct {
+	alg string
+	rsa *rsa.PrivateKey
+	ec  *ecdsa.PrivateKey
+}
+
+// NewDecrypter читает PEM с закрытым ключом в формате PKCS#1, SEC 1 или PKCS#8
+func NewDecrypter(path string) (*Decrypter, error) {
+	block, err := readPEM(path)
+	if err != nil {
+		return nil, err
+	}
+
+	var key interface{}
+	switch block.Type {
+	case "RSA PRIVATE KEY":
+		key, err = x509.ParsePKCS1PrivateKey(block.Bytes)
+	case "EC PRIVATE KEY":
+		key, err = x509.ParseECPrivateKey(block.Bytes)
+	default:
+		key, err = x509.ParsePKCS8PrivateKey(block.Bytes)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	switch k := key.(type) {
+	case *rsa.PrivateKey:
+		return &Decrypter{alg: AlgRSA, rsa: k}, nil
+	case *ecdsa.PrivateKey:
+		if k.Curve != elliptic.P256() {
+			return nil, fmt.Errorf("unsupported curve %s", k.Curve.Params().Name)
+		}
+		return &Decrypter{alg: AlgECDH, ec: k}, nil
+	default:
+		return nil, fmt.Errorf("unsupported private key %T", key)
+	}
+}
+
+func (d *Decrypter) Alg() string {
+	return d.alg
+}
+
+// Decrypt проверяет, что данные зашифрованы под ключ этого типа,
+// и расшифровывает их; любая порча данных дает ErrDecrypt
+func (d *Decrypter) Decrypt(alg string, data []byte) ([]byte, error) {
+	if alg != d.alg {
+		return nil, fmt.Errorf("unsupported encryption %q, want %q", alg, d.alg)
+	}
+
+	var (
+		headerSize int
+		key        []byte
+		err        error
+	)
+
+	switch d.alg {
+	case AlgRSA:
+		headerSize = d.rsa.Size()
+		if len(data) < headerSize {
+			return nil, ErrDecrypt
+		}
+		key, err = rsa.DecryptOAEP(sha256.New(), nil, d.rsa, data[:headerSize], nil)
+		if err != nil {
+			return nil, ErrDecrypt
+		}
+	case AlgECDH:
+		headerSize = 1 + 2*keySize
+		if len(data) < headerSize {
+			return nil, ErrDecrypt
+		}
+		x, y := elliptic.Unmarshal(elliptic.P256(), data[:headerSize])
+		if x == nil {
+			return nil, ErrDecrypt
+		}
+		key = sharedKey(&ecdsa.PublicKey{Curve: elliptic.P256(), X: x, Y: y}, d.ec.D.Bytes(), data[:headerSize])
+	}
+
+	aead, err := newAEAD(key)
+	if err != nil {
+		return nil, err
+	}
+
+	data = data[headerSize:]
+	if len(data) < aead.NonceSize() {
+		return nil, ErrDecrypt
+	}
+
+	plain, err := aead.Open(nil, data[:aead.NonceSize()], data[aead.NonceSize():], nil)
+	if err != nil {
+		return nil, ErrDecrypt
+	}
+
+	return plain, nil
+}
+
+// sharedKey выводит ключ AES из общего секрета ECDH
+// и эфемерного ключа агента
+func sharedKey(pub *ecdsa.PublicKey, priv []byte, ephemeral []byte) []byte {
+	x, _ := pub.Curve.ScalarMult(pub.X, pub.Y, priv)
+
+	secret := make([]byte, keySize)
+	x.FillBytes(secret)
+
+	h := sha256.New()
+	h.Write(secret)
+	h.Write(ephemeral)
+	return h.Sum(nil)
+}
+
+func newAEAD(key []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+
+	return cipher.NewGCM(block)
+}
+
+func readPEM(path string) (*pem.Block, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	block, _ := pem.Decode(data)
+	if block == nil {
+		return nil, fmt.Errorf("%s: no PEM data", path)
+	}
+
+	return block, nil
+}
@@ -0,0 +1,165 @@
+package encryption
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/pem"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func writePEM(t *testing.T, name, typ string, der []byte) string {
+	path := filepath.Join(t.TempDir(), name)
+	data := pem.EncodeToMemory(&pem.Block{Type: typ, Bytes: der})
+	require.NoError(t, os.WriteFile(path, data, 0600))
+	return path
+}
+
+// keyPair сохраняет пару ключей в файлы и возвращает пути к ним
+func keyPair(t *testing.T, kind string) (string, string) {
+	switch kind {
+	case "rsa pkcs1":
+		k, err := rsa.GenerateKey(rand.Reader, 2048)
+		require.NoError(t, err)
+		return writePEM(t, "pub.pem", "RSA PUBLIC KEY", x509.MarshalPKCS1PublicKey(&k.PublicKey)),
+			writePEM(t, "priv.pem", "RSA PRIVATE KEY", x509.MarshalPKCS1PrivateKey(k))
+	case "rsa pkcs8":
+		k, err := rsa.GenerateKey(rand.Reader, 2048)
+		require.NoError(t, err)
+		pub, err := x509.MarshalPKIXPublicKey(&k.PublicKey)
+		require.NoError(t, err)
+		priv, err := x509.MarshalPKCS8PrivateKey(k)
+		require.NoError(t, err)
+		return writePEM(t, "pub.pem", "PUBLIC KEY", pub), writePEM(t, "priv.pem", "PRIVATE KEY", priv)
+	case "ec":
+		k, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+		require.NoError(t, err)
+		pub, err := x509.MarshalPKIXPublicKey(&k.PublicKey)
+		require.NoError(t, err)
+		priv, err := x509.MarshalECPrivateKey(k)
+		require.NoError(t, err)
+		return writePEM(t, "pub.pem", "PUBLIC KEY", pub), writePEM(t, "priv.pem", "EC PRIVATE KEY", priv)
+	}
+
+	t.Fatalf("unknown key kind %s", kind)
+	return "", ""
+}
+
+func TestEncryptDecrypt(t *testing.T) {
+	data := []byte("[{\"id\":\"Alloc\",\"type\":\"gauge\",\"value\":1}]")
+
+	tests := []struct {
+		name string
+		kind string
+		alg  string
+	}{
+		{
+			name: "rsa pkcs1",
+			kind: "rsa pkcs1",
+			alg:  AlgRSA,
+		},
+		{
+			name: "rsa pkcs8",
+			kind: "rsa pkcs8",
+			alg:  AlgRSA,
+		},
+		{
+			name: "ecdh",
+			kind: "ec",
+			alg:  AlgECDH,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			pub, priv := keyPair(t, tt.kind)
+			e, err := NewEncrypter(pub)
+			require.NoError(t, err)
+			d, err := NewDecrypter(priv)
+			require.NoError(t, err)
+			assert.Equal(t, tt.alg, e.Alg())
+			assert.Equal(t, tt.alg, d.Alg())
+
+			enc, err := e.Encrypt(data)
+			require.NoError(t, err)
+			assert.NotContains(t, string(enc), "Alloc")
+
+			// одинаковые данные дают разный шифротекст
+			enc2, err := e.Encrypt(data)
+			require.NoError(t, err)
+			assert.NotEqual(t, enc, enc2)
+
+			got, err := d.Decrypt(e.Alg(), enc)
+			require.NoError(t, err)
+			assert.Equal(t, data, got)
+
+			enc[len(enc)-1] ^= 1
+			_, err = d.Decrypt(e.Alg(), enc)
+			assert.ErrorIs(t, err, ErrDecrypt)
+
+			_, err = d.Decrypt(e.Alg(), enc[:10])
+			assert.ErrorIs(t, err, ErrDecrypt)
+		})
+	}
+}
+
+func TestDecrypt_wrongKey(t *testing.T) {
+	pub, _ := keyPair(t, "ec")
+	_, priv := keyPair(t, "ec")
+	_, rsaPriv := keyPair(t, "rsa pkcs1")
+
+	e, err := NewEncrypter(pub)
+	require.NoError(t, err)
+	enc, err := e.Encrypt([]byte("data"))
+	require.NoError(t, err)
+
+	d, err := NewDecrypter(priv)
+	require.NoError(t, err)
+	_, err = d.Decrypt(e.Alg(), enc)
+	assert.ErrorIs(t, err, ErrDecrypt)
+
+	d, err = NewDecrypter(rsaPriv)
+	require.NoError(t, err)
+	_, err = d.Decrypt(e.Alg(), enc)
+	assert.Error(t, err)
+}
+
+func TestNewEncrypter_errors(t *testing.T) {
+	ec, err := ecdsa.GenerateKey(elliptic.P384(), rand.Reader)
+	require.NoError(t, err)
+	p384, err := x509.MarshalPKIXPublicKey(&ec.PublicKey)
+	require.NoError(t, err)
+
+	garbage := filepath.Join(t.TempDir(), "garbage.pem")
+	require.NoError(t, os.WriteFile(garbage, []byte("not a key"), 0600))
+
+	tests := []struct {
+		name string
+		path string
+	}{
+		{
+			name: "missing file",
+			path: filepath.Join(t.TempDir(), "missing.pem"),
+		},
+		{
+			name: "no pem",
+			path: garbage,
+		},
+		{
+			name: "unsupported curve",
+			path: writePEM(t, "p384.pem", "PUBLIC KEY", p384),
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := NewEncrypter(tt.path)
+			assert.Error(t, err)
+		})
+	}
+}
@@ -1,13 +1,17 @@
 package handlers
 
 import (
+	"context"
+	"encoding/json"
 	"errors"
 	"net/http"
+	"strconv"
 
 	"github.com/go-chi/chi/v5"
 	"github.com/rs/zerolog"
 	"github.com/rs/zerolog/pkgerrors"
 
+	"github.com/fedoroko/practicum_go/internal/auth"
 	"github.com/fedoroko/practicum_go/internal/config"
 	"github.com/fedoroko/practicum_go/internal/metrics"
 	"github.com/fedoroko/practicum_go/internal/storage"
@@ -27,19 +31,38 @@ func NewRepoHandler(r storage.Repository, logger *config.Logger) *repoHandler {
 	}
 }
 
+// allowed проверяет, что токен запроса может работать с метриками,
+// батч с чужой метрикой отклоняется целиком
+func (h *repoHandler) allowed(w http.ResponseWriter, r *http.Request, ms ...metrics.Metric) bool {
+	token := auth.FromContext(r.Context())
+	for _, m := range ms {
+		if !token.AllowsMetric(m.Name()) {
+			h.logger.Warn().Str("token", token.Name).Str("metric", m.Name()).Msg("metric prefix not allowed")
+			http.Error(w, "metric "+m.Name()+" is not allowed for this token", http.StatusForbidden)
+			return false
+		}
+	}
+
+	return true
+}
+
 func (h *repoHandler) IndexFunc(w http.ResponseWriter, r *http.Request) {
 	h.logger.Debug().Msg("IndexFunc")
 
 	w.Header().Set("Content-Type", "text/html")
 
-	data, err := h.r.List()
+	data, err := h.r.List(r.Context())
 	if err != nil {
 		h.logger.Error().Stack().Err(err).Msg("")
 		http.Error(w, err.Error(), http.StatusInternalServerError)
 		return
 	}
+	token := auth.FromContext(r.Context())
 	html := "<div><ul>"
 	for i := range data {
+		if !token.AllowsMetric(data[i].Name()) {
+			continue
+		}
 		html += "<li>" + data[i].Name() + " - " + data[i].ToString() + "</li>"
 	}
 	html += "</ul></div>"
@@ -67,9 +90,13 @@ func (h *repoHandler) UpdateFunc(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	if err = h.r.Set(m); err != nil {
+	if !h.allowed(w, r, m) {
+		return
+	}
+
+	if err = h.r.Set(r.Context(), m); err != nil {
 		h.logger.Error().Stack().Err(err).Msg("")
-		http.Error(w, err.Error(), http.StatusBadRequest)
+		http.Error(w, err.Error(), setStatus(err))
 		return
 	}
 
@@ -92,9 +119,13 @@ func (h *repoHandler) UpdateJSONFunc(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	if err = h.r.Set(m); err != nil {
+	if !h.allowed(w, r, m) {
+		return
+	}
+
+	if err = h.r.Set(r.Context(), m); err != nil {
 		h.logger.Error().Stack().Err(err).Msg("")
-		http.Error(w, err.Error(), http.StatusBadRequest)
+		http.Error(w, err.Error(), setStatus(err))
 		return
 	}
 
@@ -122,11 +153,14 @@ func (h *repoHandler) GetFunc(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	ret, err := h.r.Get(m)
+	if !h.allowed(w, r, m) {
+		return
+	}
+
+	ret, err := h.r.Get(r.Context(), m)
 	if err != nil {
 		h.logger.Error().Stack().Err(err).Msg("")
-
-		http.Error(w, err.Error(), http.StatusNotFound)
+		http.Error(w, err.Error(), getStatus(err))
 		return
 	}
 
@@ -150,16 +184,14 @@ func (h *repoHandler) GetJSONFunc(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	ret, err := h.r.Get(m)
+	if !h.allowed(w, r, m) {
+		return
+	}
+
+	ret, err := h.r.Get(r.Context(), m)
 	if err != nil {
 		h.logger.Error().Stack().Err(err).Msg("")
-
-		switch {
-		case errors.As(err, &metrics.InvalidHash):
-			http.Error(w, err.Error(), http.StatusBadRequest)
-		default:
-			http.Error(w, err.Error(), http.StatusNotFound)
-		}
+		http.Error(w, err.Error(), getStatus(err))
 		return
 	}
 
@@ -167,21 +199,117 @@ func (h *repoHandler) GetJSONFunc(w http.ResponseWriter, r *http.Request) {
 	w.Write(ret.ToJSON())
 }
 
+// storeStatus отделяет недоступную или медленную базу от прочих сбоев хранилища
+func storeStatus(err error) int {
+	switch {
+	case errors.Is(err, storage.ErrUnavailable):
+		return http.StatusServiceUnavailable
+	case errors.Is(err, context.DeadlineExceeded):
+		return http.StatusGatewayTimeout
+	default:
+		return http.StatusInternalServerError
+	}
+}
+
+// setStatus - ошибки проверки метрики относятся к запросу, остальные к хранилищу
+func setStatus(err error) int {
+	switch {
+	case errors.As(err, &metrics.InvalidType),
+		errors.As(err, &metrics.InvalidName),
+		errors.As(err, &metrics.InvalidHash),
+		errors.As(err, &metrics.Replay):
+		return http.StatusBadRequest
+	default:
+		return storeStatus(err)
+	}
+}
+
+func getStatus(err error) int {
+	switch {
+	case errors.Is(err, storage.ErrNotFound):
+		return http.StatusNotFound
+	case errors.As(err, &metrics.InvalidHash):
+		return http.StatusBadRequest
+	default:
+		return storeStatus(err)
+	}
+}
+
 func (h *repoHandler) PingFunc(w http.ResponseWriter, r *http.Request) {
 	h.logger.Debug().Msg("PingFunc")
 
-	if err := h.r.Ping(); err != nil {
+	if err := h.r.Ping(r.Context()); err != nil {
 		h.logger.Error().Stack().Err(err).Msg("")
-		http.Error(w, err.Error(), http.StatusInternalServerError)
+
+		http.Error(w, err.Error(), storeStatus(err))
 		return
 	}
 
 	w.Write([]byte(""))
 }
 
+// Статусы метрик в ответе /updates
+const (
+	StatusAccepted    = "accepted"
+	StatusInvalidType = "invalid_type"
+	StatusBadHash     = "bad_hash"
+	StatusReplayed    = "replayed"
+	StatusNotApplied  = "not_applied"
+	StatusStoreError  = "store_error"
+)
+
+type itemResult struct {
+	ID     string `json:"id"`
+	Type   string `json:"type"`
+	Status string `json:"status"`
+	Error  string `json:"error,omitempty"`
+}
+
+func newItemResult(m metrics.Metric, err error) itemResult {
+	ret := itemResult{
+		ID:     m.Name(),
+		Type:   m.Type(),
+		Status: StatusAccepted,
+	}
+	if err == nil {
+		return ret
+	}
+
+	ret.Error = err.Error()
+	switch {
+	case errors.As(err, &metrics.InvalidType):
+		ret.Status = StatusInvalidType
+	case errors.As(err, &metrics.InvalidHash):
+		ret.Status = StatusBadHash
+	case errors.As(err, &metrics.Replay):
+		ret.Status = StatusReplayed
+	case errors.Is(err, storage.ErrNotApplied):
+		ret.Status = StatusNotApplied
+	default:
+		ret.Status = StatusStoreError
+	}
+
+	return ret
+}
+
+// UpdatesFunc отвечает статусом для каждой метрики батча.
+// С atomic=true батч применяется целиком или не применяется вовсе,
+// и любая ошибка меняет код ответа. Без atomic 200 значит, что приняты
+// все метрики, 207 Multi-Status — только часть (какие именно, видно
+// по статусам в теле), а если не принята ни одна, код такой же, как
+// у отвергнутого атомарного батча.
 func (h *repoHandler) UpdatesFunc(w http.ResponseWriter, r *http.Request) {
 	h.logger.Debug().Msg("UpdatesFunc")
 
+	atomic := false
+	if v := r.URL.Query().Get("atomic"); v != "" {
+		var err error
+		if atomic, err = strconv.ParseBool(v); err != nil {
+			http.Error(w, "invalid atomic value: "+v, http.StatusBadRequest)
+			return
+		}
+	}
+
 	ms, err := metrics.ArrFromJSON(r.Body)
 	if err != nil {
 		h.logger.Error().Stack().Err(err).Msg("")
@@ -189,11 +317,51 @@ func (h *repoHandler) UpdatesFunc(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	if err = h.r.SetBatch(ms); err != nil {
+	if !h.allowed(w, r, ms...) {
+		return
+	}
+
+	errs, err := h.r.SetBatch(r.Context(), ms, atomic)
+	if err != nil {
+		h.logger.Error().Stack().Err(err).Msg("")
+		http.Error(w, err.Error(), storeStatus(err))
+		return
+	}
+
+	status := http.StatusOK
+	applied := 0
+	results := make([]itemResult, len(ms))
+	for i, m := range ms {
+		results[i] = newItemResult(m, errs[i])
+		if errs[i] == nil {
+			applied++
+			continue
+		}
+
+		h.logger.Warn().Str("metric", m.Name()).Err(errs[i]).Msg("metric rejected")
+		switch results[i].Status {
+		case StatusStoreError:
+			status = http.StatusInternalServerError
+		case StatusNotApplied:
+		default:
+			if status == http.StatusOK {
+				status = http.StatusBadRequest
+			}
+		}
+	}
+	// часть батча применена: повторять его целиком нельзя
+	if !atomic && applied > 0 && applied < len(ms) {
+		status = http.StatusMultiStatus
+	}
+
+	data, err := json.Marshal(results)
+	if err != nil {
 		h.logger.Error().Stack().Err(err).Msg("")
 		http.Error(w, err.Error(), http.StatusInternalServerError)
 		return
 	}
 
-	w.Write([]byte(""))
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	w.Write(data)
 }
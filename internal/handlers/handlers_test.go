@@ -4,6 +4,7 @@ import (
 	"bytes"
 	"context"
 	"errors"
+	"fmt"
 	"io"
 	"net/http"
 	"net/http/httptest"
@@ -16,6 +17,7 @@ import (
 	"github.com/fedoroko/practicum_go/internal/config"
 	"github.com/fedoroko/practicum_go/internal/metrics"
 	"github.com/fedoroko/practicum_go/internal/mocks"
+	"github.com/fedoroko/practicum_go/internal/storage"
 )
 
 type input struct {
@@ -87,7 +89,7 @@ func Test_repoHandler_GetFunc(t *testing.T) {
 				0,
 				0,
 			),
-			err: errors.New("not found"),
+			err: storage.ErrNotFound,
 			want: want{
 				code:        404,
 				body:        "",
@@ -108,7 +110,7 @@ func Test_repoHandler_GetFunc(t *testing.T) {
 			if err != nil {
 				t.Skip()
 			}
-			db.EXPECT().Get(m).Return(tt.output, tt.err)
+			db.EXPECT().Get(gomock.Any(), m).Return(tt.output, tt.err)
 
 			request := httptest.NewRequest(http.MethodGet, "/value/{type}/{name}", nil)
 			w := httptest.NewRecorder()
@@ -187,7 +189,7 @@ func Test_repoHandler_GetJSONFunc(t *testing.T) {
 				name:  "zlloc",
 				mtype: "gauge",
 			},
-			err:  errors.New("not found"),
+			err:  storage.ErrNotFound,
 			body: "{\"id\":\"zlloc\",\"type\":\"gauge\"}",
 			want: want{
 				code:        404,
@@ -212,7 +214,7 @@ func Test_repoHandler_GetJSONFunc(t *testing.T) {
 			if tt.output.value != nil {
 				ret.SetFloat64(*tt.output.value)
 			}
-			db.EXPECT().Get(m).Return(ret, tt.err)
+			db.EXPECT().Get(gomock.Any(), m).Return(ret, tt.err)
 
 			request := httptest.NewRequest(http.MethodPost, "/value/", bytes.NewBuffer([]byte(tt.body)))
 			w := httptest.NewRecorder()
@@ -298,7 +300,7 @@ func Test_repoHandler_UpdateFunc(t *testing.T) {
 			if err != nil {
 				t.Skip()
 			}
-			db.EXPECT().Set(m).Return(tt.err)
+			db.EXPECT().Set(gomock.Any(), m).Return(tt.err)
 
 			request := httptest.NewRequest(http.MethodPost, "/update/{type}/{name}/{value}", nil)
 			w := httptest.NewRecorder()
@@ -368,9 +370,9 @@ func Test_repoHandler_UpdateJSONFunc(t *testing.T) {
 			},
 		},
 		{
-			name: "empty value",
-			body: "{\"id\":\"Alloc\",\"type\":\"gauge\"}",
-			err:  errors.New(""),
+			name: "bad hash",
+			body: "{\"id\":\"Alloc\",\"type\":\"gauge\",\"value\":1}",
+			err:  metrics.ThrowInvalidHashError("", "hash mismatch"),
 			mock: true,
 			want: want{
 				code:        400,
@@ -387,6 +389,36 @@ func Test_repoHandler_UpdateJSONFunc(t *testing.T) {
 				contentType: "text/plain; charset=utf-8",
 			},
 		},
+		{
+			name: "store error",
+			body: "{\"id\":\"Alloc\",\"type\":\"gauge\"}",
+			err:  errors.New("conn reset"),
+			mock: true,
+			want: want{
+				code:        500,
+				contentType: "text/plain; charset=utf-8",
+			},
+		},
+		{
+			name: "db unavailable",
+			body: "{\"id\":\"Alloc\",\"type\":\"gauge\",\"value\":1}",
+			err:  storage.ErrUnavailable,
+			mock: true,
+			want: want{
+				code:        503,
+				contentType: "text/plain; charset=utf-8",
+			},
+		},
+		{
+			name: "query timeout",
+			body: "{\"id\":\"Alloc\",\"type\":\"gauge\",\"value\":1}",
+			err:  fmt.Errorf("query: %w", context.DeadlineExceeded),
+			mock: true,
+			want: want{
+				code:        504,
+				contentType: "text/plain; charset=utf-8",
+			},
+		},
 	}
 	ctrl := gomock.NewController(t)
 	defer ctrl.Finish()
@@ -401,7 +433,7 @@ func Test_repoHandler_UpdateJSONFunc(t *testing.T) {
 				t.Skip(err.Error())
 			}
 			if tt.mock {
-				db.EXPECT().Set(m).Return(tt.err)
+				db.EXPECT().Set(gomock.Any(), m).Return(tt.err)
 			}
 
 			request := httptest.NewRequest(http.MethodPost, "/update/", bytes.NewBuffer([]byte(tt.body)))
@@ -422,3 +454,216 @@ func Test_repoHandler_UpdateJSONFunc(t *testing.T) {
 		})
 	}
 }
+
+func Test_repoHandler_UpdatesFunc(t *testing.T) {
+	body := "[{\"id\":\"Alloc\",\"type\":\"gauge\",\"value\":1},{\"id\":\"PollCount\",\"type\":\"counter\",\"delta\":1}]"
+	type want struct {
+		code int
+		body string
+	}
+	tests := []struct {
+		name   string
+		query  string
+		atomic bool
+		errs   []error
+		err    error
+		mock   bool
+		want   want
+	}{
+		{
+			name: "accepted",
+			errs: []error{nil, nil},
+			mock: true,
+			want: want{
+				code: 200,
+				body: "[{\"id\":\"Alloc\",\"type\":\"gauge\",\"status\":\"accepted\"},{\"id\":\"PollCount\",\"type\":\"counter\",\"status\":\"accepted\"}]",
+			},
+		},
+		{
+			name: "partial",
+			errs: []error{nil, metrics.ThrowInvalidHashError("k1", "hash mismatch")},
+			mock: true,
+			want: want{
+				code: 207,
+				body: "[{\"id\":\"Alloc\",\"type\":\"gauge\",\"status\":\"accepted\"},{\"id\":\"PollCount\",\"type\":\"counter\",\"status\":\"bad_hash\",\"error\":\"Invalid hash: hash mismatch, expected key id \\\"k1\\\"\"}]",
+			},
+		},
+		{
+			name: "partial store error",
+			errs: []error{errors.New("conn reset"), nil},
+			mock: true,
+			want: want{
+				code: 207,
+				body: "[{\"id\":\"Alloc\",\"type\":\"gauge\",\"status\":\"store_error\",\"error\":\"conn reset\"},{\"id\":\"PollCount\",\"type\":\"counter\",\"status\":\"accepted\"}]",
+			},
+		},
+		{
+			name: "none applied",
+			errs: []error{metrics.ThrowInvalidHashError("k1", "hash mismatch"), metrics.ThrowReplayError("duplicate nonce a")},
+			mock: true,
+			want: want{
+				code: 400,
+				body: "[{\"id\":\"Alloc\",\"type\":\"gauge\",\"status\":\"bad_hash\",\"error\":\"Invalid hash: hash mismatch, expected key id \\\"k1\\\"\"},{\"id\":\"PollCount\",\"type\":\"counter\",\"status\":\"replayed\",\"error\":\"Replayed metric: duplicate nonce a\"}]",
+			},
+		},
+		{
+			name: "none applied store error",
+			errs: []error{metrics.ThrowInvalidHashError("k1", "hash mismatch"), errors.New("conn reset")},
+			mock: true,
+			want: want{
+				code: 500,
+				body: "[{\"id\":\"Alloc\",\"type\":\"gauge\",\"status\":\"bad_hash\",\"error\":\"Invalid hash: hash mismatch, expected key id \\\"k1\\\"\"},{\"id\":\"PollCount\",\"type\":\"counter\",\"status\":\"store_error\",\"error\":\"conn reset\"}]",
+			},
+		},
+		{
+			name:   "atomic rejected",
+			query:  "?atomic=true",
+			atomic: true,
+			errs:   []error{storage.ErrNotApplied, metrics.ThrowReplayError("duplicate nonce a")},
+			mock:   true,
+			want: want{
+				code: 400,
+				body: "[{\"id\":\"Alloc\",\"type\":\"gauge\",\"status\":\"not_applied\",\"error\":\"batch rejected, metric not applied\"},{\"id\":\"PollCount\",\"type\":\"counter\",\"status\":\"replayed\",\"error\":\"Replayed metric: duplicate nonce a\"}]",
+			},
+		},
+		{
+			name:   "atomic store error",
+			query:  "?atomic=1",
+			atomic: true,
+			errs:   []error{errors.New("conn reset"), storage.ErrNotApplied},
+			mock:   true,
+			want: want{
+				code: 500,
+				body: "[{\"id\":\"Alloc\",\"type\":\"gauge\",\"status\":\"store_error\",\"error\":\"conn reset\"},{\"id\":\"PollCount\",\"type\":\"counter\",\"status\":\"not_applied\",\"error\":\"batch rejected, metric not applied\"}]",
+			},
+		},
+		{
+			name: "storage down",
+			err:  errors.New("no db"),
+			mock: true,
+			want: want{
+				code: 500,
+				body: "no db\n",
+			},
+		},
+		{
+			name:  "bad atomic",
+			query: "?atomic=maybe",
+			want: want{
+				code: 400,
+				body: "invalid atomic value: maybe\n",
+			},
+		},
+	}
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+	db := mocks.NewMockRepository(ctrl)
+
+	h := NewRepoHandler(db, config.TestLogger())
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if tt.mock {
+				db.EXPECT().SetBatch(gomock.Any(), gomock.Len(2), tt.atomic).Return(tt.errs, tt.err)
+			}
+
+			request := httptest.NewRequest(http.MethodPost, "/updates/"+tt.query, bytes.NewBuffer([]byte(body)))
+			w := httptest.NewRecorder()
+			http.HandlerFunc(h.UpdatesFunc).ServeHTTP(w, request)
+			res := w.Result()
+			defer res.Body.Close()
+
+			assert.Equal(t, tt.want.code, res.StatusCode)
+			got, _ := io.ReadAll(res.Body)
+			assert.Equal(t, tt.want.body, string(got))
+		})
+	}
+}
+
+type ctxKey struct{}
+
+// ctxMatcher проверяет, что в хранилище пришел контекст запроса
+type ctxMatcher struct{}
+
+func (ctxMatcher) Matches(x interface{}) bool {
+	ctx, ok := x.(context.Context)
+	return ok && ctx.Value(ctxKey{}) == "request"
+}
+
+func (ctxMatcher) String() string {
+	return "is request context"
+}
+
+func Test_repoHandler_context(t *testing.T) {
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+	db := mocks.NewMockRepository(ctrl)
+	h := NewRepoHandler(db, config.TestLogger())
+
+	db.EXPECT().Ping(ctxMatcher{}).Return(nil)
+	db.EXPECT().List(ctxMatcher{}).Return(nil, nil)
+	db.EXPECT().SetBatch(ctxMatcher{}, gomock.Any(), false).Return([]error{}, nil)
+
+	tests := []struct {
+		name    string
+		handler http.HandlerFunc
+		body    string
+	}{
+		{name: "ping", handler: h.PingFunc},
+		{name: "index", handler: h.IndexFunc},
+		{name: "updates", handler: h.UpdatesFunc, body: "[]"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			request := httptest.NewRequest(http.MethodPost, "/", bytes.NewBufferString(tt.body))
+			request = request.WithContext(context.WithValue(request.Context(), ctxKey{}, "request"))
+			w := httptest.NewRecorder()
+			tt.handler.ServeHTTP(w, request)
+			assert.Equal(t, http.StatusOK, w.Code)
+		})
+	}
+}
+
+func Test_repoHandler_PingFunc(t *testing.T) {
+	tests := []struct {
+		name string
+		err  error
+		want int
+	}{
+		{name: "ok", err: nil, want: http.StatusOK},
+		{name: "degraded", err: storage.ErrUnavailable, want: http.StatusServiceUnavailable},
+		{name: "error", err: errors.New("broken"), want: http.StatusInternalServerError},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ctrl := gomock.NewController(t)
+			defer ctrl.Finish()
+			db := mocks.NewMockRepository(ctrl)
+			h := NewRepoHandler(db, config.TestLogger())
+			db.EXPECT().Ping(gomock.Any()).Return(tt.err)
+
+			request := httptest.NewRequest(http.MethodGet, "/ping", nil)
+			w := httptest.NewRecorder()
+			h.PingFunc(w, request)
+			assert.Equal(t, tt.want, w.Code)
+		})
+	}
+}
+
+func Test_getStatus(t *testing.T) {
+	tests := []struct {
+		name string
+		err  error
+		want int
+	}{
+		{name: "not found", err: storage.ErrNotFound, want: http.StatusNotFound},
+		{name: "bad hash", err: metrics.ThrowInvalidHashError("", "hash mismatch"), want: http.StatusBadRequest},
+		{name: "db unavailable", err: storage.ErrUnavailable, want: http.StatusServiceUnavailable},
+		{name: "query timeout", err: fmt.Errorf("query: %w", context.DeadlineExceeded), want: http.StatusGatewayTimeout},
+		{name: "store error", err: errors.New("conn reset"), want: http.StatusInternalServerError},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			assert.Equal(t, tt.want, getStatus(tt.err))
+		})
+	}
+}
@@ -20,12 +20,47 @@ func ThrowInvalidTypeError(t string) error {
 
 var InvalidHash *invalidHashError
 
-type invalidHashError struct{}
+// invalidHashError сообщает, каким ключом сервер проверял подпись
+type invalidHashError struct {
+	KeyID  string
+	Reason string
+}
 
 func (e *invalidHashError) Error() string {
-	return "Invalid hash"
+	return fmt.Sprintf("Invalid hash: %s, expected key id %q", e.Reason, e.KeyID)
+}
+
+func ThrowInvalidHashError(keyID string, reason string) error {
+	return &invalidHashError{KeyID: keyID, Reason: reason}
+}
+
+var InvalidName *invalidNameError
+
+// invalidNameError - имя метрики нельзя сохранить
+type invalidNameError struct {
+	Name   string
+	Reason string
+}
+
+func (e *invalidNameError) Error() string {
+	return fmt.Sprintf("Invalid name %q: %s", e.Name, e.Reason)
+}
+
+func ThrowInvalidNameError(name string, reason string) error {
+	return &invalidNameError{Name: name, Reason: reason}
+}
+
+var Replay *replayError
+
+// replayError - подписанная метрика устарела или уже была принята
+type replayError struct {
+	Reason string
+}
+
+func (e *replayError) Error() string {
+	return fmt.Sprintf("Replayed metric: %s", e.Reason)
 }
 
-func ThrowInvalidHashError() error {
-	return &invalidHashError{}
+func ThrowReplayError(reason string) error {
+	return &replayError{Reason: reason}
 }
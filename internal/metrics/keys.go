@@ -0,0 +1,113 @@
+package metrics
+
+import (
+	"fmt"
+	"strings"
+)
+
+// KeyRing хранит ключи HMAC по идентификаторам, чтобы ключ можно было
+// сменить без одновременного обновления всех агентов.
+// Ключ из KEY получает пустой идентификатор и проверяет метрики без key_id.
+// Ответы сервера подписываются ключом signing.
+// С legacy принимаются подписи HashLegacy и ими же подписываются ответы.
+// HashLegacy не покрывает key_id, ts, nonce и cumulative, поэтому такие
+// метрики принимаются только без этих полей и только ключом из KEY.
+// nil KeyRing означает, что подписи выключены.
+type KeyRing struct {
+	keys    map[string]string
+	signing string
+	legacy  bool
+}
+
+// NewKeyRing собирает набор из старого KEY и записей вида "id=secret"
+func NewKeyRing(key string, entries []string, signing string, legacy bool) (*KeyRing, error) {
+	r := &KeyRing{
+		keys:    make(map[string]string),
+		signing: signing,
+		legacy:  legacy,
+	}
+	if key != "" {
+		r.keys[""] = key
+	}
+
+	for _, e := range entries {
+		kv := strings.SplitN(e, "=", 2)
+		if len(kv) != 2 || kv[0] == "" || kv[1] == "" {
+			return nil, fmt.Errorf("invalid key %q, want id=secret", e)
+		}
+		if _, ok := r.keys[kv[0]]; ok {
+			return nil, fmt.Errorf("duplicate key id %q", kv[0])
+		}
+		r.keys[kv[0]] = kv[1]
+	}
+
+	if _, ok := r.keys[signing]; !ok && len(r.keys) > 0 {
+		return nil, fmt.Errorf("unknown signing key id %q", signing)
+	}
+
+	return r, nil
+}
+
+// Sign подписывает метрику ключом для ответов
+func (r *KeyRing) Sign(m Metric) error {
+	if r == nil || len(r.keys) == 0 {
+		return nil
+	}
+
+	if r.legacy {
+		m.SetKeyID("")
+		return m.SetLegacyHash(r.keys[r.signing])
+	}
+	m.SetKeyID(r.signing)
+	return m.SetHash(r.keys[r.signing])
+}
+
+// Empty - ключей нет, подписи не проверяются
+func (r *KeyRing) Empty() bool {
+	return r == nil || len(r.keys) == 0
+}
+
+// Check проверяет подпись ключом из key_id метрики.
+// Неподписанные метрики пропускаются, как и раньше с одним KEY.
+func (r *KeyRing) Check(m Metric) error {
+	if r.Empty() {
+		return nil
+	}
+
+	// агенту с неизвестным ключом подсказываем ключ для перехода
+	key, ok := r.keys[m.KeyID()]
+	if !ok {
+		return ThrowInvalidHashError(r.signing, fmt.Sprintf("unknown key id %q", m.KeyID()))
+	}
+
+	if m.IsSigned() && m.HashVersion() == HashLegacy {
+		if !r.legacy {
+			return ThrowInvalidHashError(m.KeyID(), "legacy hash format is disabled")
+		}
+		if err := checkLegacyFields(m); err != nil {
+			return err
+		}
+	}
+
+	if ok, _ := m.CheckHash(key); !ok {
+		return ThrowInvalidHashError(m.KeyID(), "hash mismatch")
+	}
+
+	return nil
+}
+
+// checkLegacyFields отклоняет поля, которые подпись HashLegacy не защищает:
+// их можно подменить в перехваченной метрике
+func checkLegacyFields(m Metric) error {
+	ts, nonce := m.Stamp()
+	switch {
+	case m.KeyID() != "":
+		return ThrowInvalidHashError("", "legacy hash does not cover key_id")
+	case ts != 0 || nonce != "":
+		return ThrowInvalidHashError("", "legacy hash does not cover ts and nonce")
+	case m.IsCumulative():
+		return ThrowInvalidHashError("", "legacy hash does not cover cumulative")
+	}
+
+	return nil
+}
@@ -1,12 +1,14 @@
 package metrics
 
 import (
+	"bytes"
 	"crypto/hmac"
 	"crypto/sha256"
 	"encoding/hex"
 	"encoding/json"
 	"fmt"
 	"io"
+	"math"
 	"strconv"
 )
 
@@ -15,9 +17,15 @@ const (
 	CounterType = "counter"
 )
 
+// Версии формата подписи. HashLegacy - строка "name:type:%f", в которой
+// gauge теряет точность; метрики без hash_v подписаны им.
+const (
+	HashLegacy = 1
+	HashV2     = 2
+)
+
 type Metric interface {
 	Name() string
-	DBName() string
 	Type() string
 	Float64Value() float64
 	Float64Pointer() *float64
@@ -27,7 +35,17 @@ type Metric interface {
 	SetFloat64(float64)
 	SetInt64(int64)
 
+	IsCumulative() bool
+	SetCumulative(bool)
+
+	KeyID() string
+	SetKeyID(string)
+	Stamp() (int64, string)
+	SetStamp(int64, string)
+	IsSigned() bool
+	HashVersion() int
 	SetHash(string) error
+	SetLegacyHash(string) error
 	CheckHash(string) (bool, error)
 	CheckType() error
 
@@ -35,22 +53,26 @@ type Metric interface {
 	ToJSON() []byte
 }
 
+// metric.Cumulative означает, что Delta счетчика - это полное значение,
+// которое сервер должен записать вместо прибавления.
+// Timestamp (unix ms) и NonceID входят в подпись HashV2 и защищают от повтора.
 type metric struct {
-	ID    string   `json:"id"`
-	MType string   `json:"type"`
-	Delta *int64   `json:"delta,omitempty"`
-	Value *float64 `json:"value,omitempty"`
-	Hash  string   `json:"hash,omitempty"`
+	ID         string   `json:"id"`
+	MType      string   `json:"type"`
+	Delta      *int64   `json:"delta,omitempty"`
+	Value      *float64 `json:"value,omitempty"`
+	Hash       string   `json:"hash,omitempty"`
+	HashV      int      `json:"hash_v,omitempty"`
+	KID        string   `json:"key_id,omitempty"`
+	Timestamp  int64    `json:"ts,omitempty"`
+	NonceID    string   `json:"nonce,omitempty"`
+	Cumulative bool     `json:"cumulative,omitempty"`
 }
 
 func (m *metric) Name() string {
 	return m.ID
 }
 
-func (m *metric) DBName() string {
-	return m.Name() + "::" + m.Type()
-}
-
 func (m *metric) Type() string {
 	return m.MType
 }
@@ -85,16 +107,61 @@ func (m *metric) SetInt64(i int64) {
 	m.Delta = &i
 }
 
+func (m *metric) IsCumulative() bool {
+	return m.Cumulative
+}
+
+func (m *metric) SetCumulative(c bool) {
+	m.Cumulative = c
+}
+
+func (m *metric) KeyID() string {
+	return m.KID
+}
+
+func (m *metric) SetKeyID(id string) {
+	m.KID = id
+}
+
+func (m *metric) Stamp() (int64, string) {
+	return m.Timestamp, m.NonceID
+}
+
+func (m *metric) SetStamp(ts int64, nonce string) {
+	m.Timestamp = ts
+	m.NonceID = nonce
+}
+
+func (m *metric) IsSigned() bool {
+	return m.Hash != ""
+}
+
+func (m *metric) HashVersion() int {
+	if m.HashV == 0 {
+		return HashLegacy
+	}
+	return m.HashV
+}
+
+// SetHash подписывает метрику в каноническом формате HashV2
 func (m *metric) SetHash(key string) error {
 	if key == "" {
 		return nil
 	}
-	data := getHashSrc(m)
 
-	h := hmac.New(sha256.New, []byte(key))
-	h.Write(data)
-	hash := h.Sum(nil)
-	m.Hash = hex.EncodeToString(hash)
+	m.HashV = HashV2
+	m.Hash = hex.EncodeToString(sum(key, getCanonicalHashSrc(m)))
+	return nil
+}
+
+// SetLegacyHash подписывает метрику для серверов, не знающих hash_v
+func (m *metric) SetLegacyHash(key string) error {
+	if key == "" {
+		return nil
+	}
+
+	m.HashV = 0
+	m.Hash = hex.EncodeToString(sum(key, getHashSrc(m)))
 	return nil
 }
 
@@ -103,17 +170,28 @@ func (m *metric) CheckHash(key string) (bool, error) {
 		return true, nil
 	}
 
-	data := getHashSrc(m)
+	var data []byte
+	switch m.HashVersion() {
+	case HashLegacy:
+		data = getHashSrc(m)
+	case HashV2:
+		data = getCanonicalHashSrc(m)
+	default:
+		return false, fmt.Errorf("unsupported hash version %d", m.HashV)
+	}
 
-	h := hmac.New(sha256.New, []byte(key))
-	h.Write(data)
-	hash := h.Sum(nil)
 	currHash, err := hex.DecodeString(m.Hash)
 	if err != nil {
 		return false, err
 	}
 
-	return hmac.Equal(hash, currHash), nil
+	return hmac.Equal(sum(key, data), currHash), nil
+}
+
+func sum(key string, data []byte) []byte {
+	h := hmac.New(sha256.New, []byte(key))
+	h.Write(data)
+	return h.Sum(nil)
 }
 
 func (m *metric) CheckType() error {
@@ -139,6 +217,36 @@ func getHashSrc(m *metric) []byte {
 	return data
 }
 
+// getCanonicalHashSrc собирает подпись HashV2: каждое поле с префиксом длины,
+// gauge - точные биты IEEE-754, отсутствующее значение - пустое поле.
+// Новые поля добавляются в конец вместе с новой версией формата.
+func getCanonicalHashSrc(m *metric) []byte {
+	var b bytes.Buffer
+	field := func(s string) {
+		b.WriteString(strconv.Itoa(len(s)))
+		b.WriteByte(':')
+		b.WriteString(s)
+	}
+
+	field(strconv.Itoa(HashV2))
+	field(m.ID)
+	field(m.MType)
+	switch {
+	case m.MType == GaugeType && m.Value != nil:
+		field(strconv.FormatUint(math.Float64bits(*m.Value), 16))
+	case m.MType == CounterType && m.Delta != nil:
+		field(strconv.FormatInt(*m.Delta, 10))
+	default:
+		field("")
+	}
+	field(strconv.FormatBool(m.Cumulative))
+	field(m.KID)
+	field(strconv.FormatInt(m.Timestamp, 10))
+	field(m.NonceID)
+
+	return b.Bytes()
+}
+
 func (m *metric) ToString() string {
 	switch m.Type() {
 	case GaugeType:
@@ -248,6 +356,23 @@ func NewOmitEmpty(n string, t string, v *float64, d *int64) Metric {
 	}
 }
 
+// Copy копирует имя, тип, значение и признак cumulative без подписи:
+// копию можно менять и подписывать заново, не трогая исходную метрику
+func Copy(m Metric) Metric {
+	var v *float64
+	if f := m.Float64Pointer(); f != nil {
+		v = PointerFromFloat64(*f)
+	}
+	var d *int64
+	if i := m.Int64Pointer(); i != nil {
+		d = PointerFromInt64(*i)
+	}
+
+	ret := NewOmitEmpty(m.Name(), m.Type(), v, d)
+	ret.SetCumulative(m.IsCumulative())
+	return ret
+}
+
 func PointerFromFloat64(v float64) *float64 {
 	return &v
 }
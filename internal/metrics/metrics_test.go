@@ -0,0 +1,236 @@
+package metrics
+
+import (
+	"bytes"
+	"math"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestGetCanonicalHashSrc(t *testing.T) {
+	m := NewOmitEmpty("Alloc", GaugeType, PointerFromFloat64(1.5), nil).(*metric)
+	m.SetKeyID("k1")
+	m.SetStamp(1700000000000, "ab")
+	// формат подписи фиксирован: его должны одинаково считать все версии агента и сервера
+	assert.Equal(t, "1:25:Alloc5:gauge16:3ff80000000000005:false2:k113:17000000000002:ab", string(getCanonicalHashSrc(m)))
+
+	c := NewOmitEmpty("PollCount", CounterType, nil, PointerFromInt64(-3)).(*metric)
+	c.SetCumulative(true)
+	assert.Equal(t, "1:29:PollCount7:counter2:-34:true0:1:00:", string(getCanonicalHashSrc(c)))
+}
+
+func TestSetHash_precision(t *testing.T) {
+	hash := func(v float64, legacy bool) string {
+		m := NewOmitEmpty("Alloc", GaugeType, PointerFromFloat64(v), nil).(*metric)
+		if legacy {
+			require.NoError(t, m.SetLegacyHash("key"))
+		} else {
+			require.NoError(t, m.SetHash("key"))
+		}
+		return m.Hash
+	}
+
+	// %f обрезает значение до 6 знаков
+	assert.Equal(t, hash(0.1234567, true), hash(0.1234568, true))
+	assert.NotEqual(t, hash(0.1234567, false), hash(0.1234568, false))
+	assert.NotEqual(t, hash(1e-7, false), hash(2e-7, false))
+
+	assert.Equal(t, hash(math.Inf(1), false), hash(math.Inf(1), false))
+	assert.NotEqual(t, hash(math.Inf(1), false), hash(math.Inf(-1), false))
+	assert.Equal(t, hash(math.NaN(), false), hash(math.NaN(), false))
+	assert.NotEqual(t, hash(0, false), hash(math.Copysign(0, -1), false))
+}
+
+func TestCheckHash_tampered(t *testing.T) {
+	tests := []struct {
+		name   string
+		tamper func(m *metric)
+	}{
+		{
+			name:   "value",
+			tamper: func(m *metric) { m.SetInt64(6) },
+		},
+		{
+			name:   "cumulative",
+			tamper: func(m *metric) { m.SetCumulative(true) },
+		},
+		{
+			name:   "key id",
+			tamper: func(m *metric) { m.SetKeyID("k2") },
+		},
+		{
+			name:   "nonce",
+			tamper: func(m *metric) { m.SetStamp(m.Timestamp, "other") },
+		},
+		{
+			name:   "downgrade to legacy",
+			tamper: func(m *metric) { m.HashV = 0 },
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			m := NewOmitEmpty("PollCount", CounterType, nil, PointerFromInt64(5)).(*metric)
+			m.SetKeyID("k1")
+			m.SetStamp(1700000000000, "ab")
+			require.NoError(t, m.SetHash("key"))
+
+			ok, err := m.CheckHash("key")
+			require.NoError(t, err)
+			require.True(t, ok)
+
+			tt.tamper(m)
+			ok, _ = m.CheckHash("key")
+			assert.False(t, ok)
+		})
+	}
+
+	m := NewOmitEmpty("PollCount", CounterType, nil, PointerFromInt64(5)).(*metric)
+	require.NoError(t, m.SetHash("key"))
+	m.HashV = 3
+	ok, err := m.CheckHash("key")
+	assert.Error(t, err)
+	assert.False(t, ok)
+}
+
+// TestKeyRing_crossVersion проверяет подписи агента, прошедшие через JSON,
+// на сервере с выключенным и включенным старым форматом
+func TestKeyRing_crossVersion(t *testing.T) {
+	tests := []struct {
+		name         string
+		agentLegacy  bool
+		serverLegacy bool
+		wantErr      bool
+	}{
+		{
+			name: "new agent, new server",
+		},
+		{
+			name:         "new agent, server accepting legacy",
+			serverLegacy: true,
+		},
+		{
+			name:         "old agent, server accepting legacy",
+			agentLegacy:  true,
+			serverLegacy: true,
+		},
+		{
+			name:        "old agent, new server",
+			agentLegacy: true,
+			wantErr:     true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			sent := NewOmitEmpty("Alloc", GaugeType, PointerFromFloat64(0.1+0.2), nil)
+			if tt.agentLegacy {
+				require.NoError(t, sent.SetLegacyHash("key"))
+			} else {
+				require.NoError(t, sent.SetHash("key"))
+			}
+
+			got, err := FromJSON(bytes.NewReader(sent.ToJSON()))
+			require.NoError(t, err)
+
+			r, err := NewKeyRing("key", nil, "", tt.serverLegacy)
+			require.NoError(t, err)
+			err = r.Check(got)
+			if tt.wantErr {
+				assert.ErrorAs(t, err, &InvalidHash)
+				return
+			}
+			require.NoError(t, err)
+
+			// ответ сервера подписан форматом, который понимает агент этой версии
+			resp := NewOmitEmpty("Alloc", GaugeType, PointerFromFloat64(0.1+0.2), nil)
+			require.NoError(t, r.Sign(resp))
+			back, err := FromJSON(bytes.NewReader(resp.ToJSON()))
+			require.NoError(t, err)
+			ok, err := back.CheckHash("key")
+			require.NoError(t, err)
+			assert.True(t, ok)
+			if tt.serverLegacy {
+				assert.Equal(t, HashLegacy, back.HashVersion())
+			} else {
+				assert.Equal(t, HashV2, back.HashVersion())
+			}
+		})
+	}
+}
+
+// TestKeyRing_legacyFields проверяет, что к старой подписи нельзя
+// дописать поля, которые она не покрывает
+func TestKeyRing_legacyFields(t *testing.T) {
+	tests := []struct {
+		name    string
+		tamper  func(m Metric)
+		wantErr bool
+	}{
+		{
+			name:   "plain legacy",
+			tamper: func(m Metric) {},
+		},
+		{
+			name:    "nonce",
+			tamper:  func(m Metric) { m.SetStamp(time.Now().UnixMilli(), "fresh") },
+			wantErr: true,
+		},
+		{
+			name:    "cumulative",
+			tamper:  func(m Metric) { m.SetCumulative(true) },
+			wantErr: true,
+		},
+		{
+			name:    "key id",
+			tamper:  func(m Metric) { m.SetKeyID("k2") },
+			wantErr: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r, err := NewKeyRing("key", []string{"k2=key"}, "", true)
+			require.NoError(t, err)
+
+			m := NewOmitEmpty("PollCount", CounterType, nil, PointerFromInt64(2))
+			require.NoError(t, m.SetLegacyHash("key"))
+			tt.tamper(m)
+
+			err = r.Check(m)
+			if tt.wantErr {
+				assert.ErrorAs(t, err, &InvalidHash)
+				return
+			}
+			assert.NoError(t, err)
+		})
+	}
+}
+
+func TestCopy(t *testing.T) {
+	c := NewOmitEmpty("PollCount", CounterType, nil, PointerFromInt64(3))
+	c.SetCumulative(true)
+	c.SetStamp(1700000000000, "ab")
+	require.NoError(t, c.SetHash("key"))
+
+	got := Copy(c)
+	assert.Equal(t, "PollCount", got.Name())
+	assert.Equal(t, CounterType, got.Type())
+	assert.Equal(t, int64(3), *got.Int64Pointer())
+	assert.Nil(t, got.Float64Pointer())
+	assert.True(t, got.IsCumulative())
+	// подпись и отметка времени не копируются
+	assert.False(t, got.IsSigned())
+	ts, nonce := got.Stamp()
+	assert.Zero(t, ts)
+	assert.Empty(t, nonce)
+
+	// значение не разделяется с исходной метрикой
+	*got.Int64Pointer() = 5
+	assert.Equal(t, int64(3), *c.Int64Pointer())
+
+	g := Copy(NewOmitEmpty("Alloc", GaugeType, PointerFromFloat64(1.5), nil))
+	assert.Equal(t, 1.5, *g.Float64Pointer())
+	assert.Nil(t, g.Int64Pointer())
+	assert.False(t, g.IsCumulative())
+}
@@ -0,0 +1,171 @@
+package server
+
+import (
+	"bytes"
+	"compress/gzip"
+	"errors"
+	"io"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/fedoroko/practicum_go/internal/auth"
+	"github.com/fedoroko/practicum_go/internal/config"
+	"github.com/fedoroko/practicum_go/internal/encryption"
+)
+
+// decompress распаковывает тело запроса с Content-Encoding: gzip
+// до того, как оно попадет в обработчики.
+// Распакованное тело больше maxSize отклоняется,
+// чтобы маленький архив не раздул память сервера.
+func decompress(maxSize int64, logger *config.Logger) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			encoding := strings.ToLower(strings.TrimSpace(r.Header.Get("Content-Encoding")))
+			switch encoding {
+			case "", "identity":
+				next.ServeHTTP(w, r)
+				return
+			case "gzip":
+			default:
+				http.Error(w, "unsupported content encoding: "+encoding, http.StatusUnsupportedMediaType)
+				return
+			}
+
+			gz, err := gzip.NewReader(r.Body)
+			if err != nil {
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+			defer gz.Close()
+
+			var body bytes.Buffer
+			n, err := io.Copy(&body, io.LimitReader(gz, maxSize+1))
+			if err != nil {
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+			if n > maxSize {
+				logger.Warn().Int64("limit", maxSize).Str("remote", r.RemoteAddr).Msg("decompressed body too large")
+				http.Error(w, "request body too large", http.StatusRequestEntityTooLarge)
+				return
+			}
+
+			r.Body = io.NopCloser(&body)
+			r.ContentLength = n
+			r.Header.Del("Content-Encoding")
+			r.Header.Set("Content-Length", strconv.FormatInt(n, 10))
+
+			next.ServeHTTP(w, r)
+		})
+	}
+}
+
+// decrypt расшифровывает тела запросов с заголовком X-Encryption.
+// Незашифрованные запросы пропускаются как есть, поэтому шифрование
+// включается на агентах независимо от сервера.
+func decrypt(d *encryption.Decrypter, maxSize int64, logger *config.Logger) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			alg := r.Header.Get(encryption.Header)
+			if alg == "" {
+				next.ServeHTTP(w, r)
+				return
+			}
+			if d == nil {
+				http.Error(w, "encryption is not configured", http.StatusBadRequest)
+				return
+			}
+
+			data, err := io.ReadAll(io.LimitReader(r.Body, maxSize+1))
+			if err != nil {
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+			if int64(len(data)) > maxSize {
+				http.Error(w, "request body too large", http.StatusRequestEntityTooLarge)
+				return
+			}
+
+			plain, err := d.Decrypt(alg, data)
+			if err != nil {
+				logger.Warn().Err(err).Str("remote", r.RemoteAddr).Msg("")
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+
+			r.Body = io.NopCloser(bytes.NewReader(plain))
+			r.ContentLength = int64(len(plain))
+			r.Header.Del(encryption.Header)
+			r.Header.Set("Content-Length", strconv.Itoa(len(plain)))
+
+			next.ServeHTTP(w, r)
+		})
+	}
+}
+
+// trustedSubnet пропускает только запросы, у которых X-Real-IP
+// входит в подсеть; без подсети проверка выключена
+func trustedSubnet(subnet *net.IPNet) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		if subnet == nil {
+			return next
+		}
+
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			ip := net.ParseIP(strings.TrimSpace(r.Header.Get("X-Real-IP")))
+			if ip == nil || !subnet.Contains(ip) {
+				http.Error(w, "untrusted address", http.StatusForbidden)
+				return
+			}
+
+			next.ServeHTTP(w, r)
+		})
+	}
+}
+
+// authorize проверяет bearer-токен и его право scope, токен
+// кладется в контекст для проверки префикса метрик в обработчиках.
+// Без хранилища токенов проверка выключена.
+func authorize(store auth.Store, scope string, logger *config.Logger) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		if store == nil {
+			return next
+		}
+
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			header := r.Header.Get("Authorization")
+			if len(header) < 7 || !strings.EqualFold(header[:7], "Bearer ") {
+				w.Header().Set("WWW-Authenticate", "Bearer")
+				http.Error(w, "token required", http.StatusUnauthorized)
+				return
+			}
+
+			t, err := store.Lookup(r.Context(), strings.TrimSpace(header[7:]))
+			if err != nil {
+				switch {
+				case errors.Is(err, auth.ErrUnavailable):
+					logger.Error().Err(err).Msg("token lookup")
+					http.Error(w, err.Error(), http.StatusServiceUnavailable)
+					return
+				case !errors.Is(err, auth.ErrUnknownToken):
+					logger.Error().Err(err).Msg("token lookup")
+					http.Error(w, err.Error(), http.StatusInternalServerError)
+					return
+				}
+				w.Header().Set("WWW-Authenticate", "Bearer error=\"invalid_token\"")
+				http.Error(w, err.Error(), http.StatusUnauthorized)
+				return
+			}
+
+			if !t.Allows(scope) {
+				logger.Warn().Str("token", t.Name).Str("scope", scope).Msg("forbidden")
+				http.Error(w, "token has no "+scope+" scope", http.StatusForbidden)
+				return
+			}
+
+			next.ServeHTTP(w, r.WithContext(auth.NewContext(r.Context(), t)))
+		})
+	}
+}
@@ -0,0 +1,297 @@
+package server
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/fedoroko/practicum_go/internal/auth"
+	"github.com/fedoroko/practicum_go/internal/config"
+	"github.com/fedoroko/practicum_go/internal/encryption"
+	"github.com/fedoroko/practicum_go/internal/storage"
+)
+
+func gzipped(t *testing.T, s string) []byte {
+	var buf bytes.Buffer
+	gz := gzip.NewWriter(&buf)
+	_, err := gz.Write([]byte(s))
+	require.NoError(t, err)
+	require.NoError(t, gz.Close())
+	return buf.Bytes()
+}
+
+func Test_decompress(t *testing.T) {
+	payload := "[{\"id\":\"Alloc\",\"type\":\"gauge\",\"value\":1}]"
+
+	tests := []struct {
+		name       string
+		encoding   string
+		body       []byte
+		maxSize    int64
+		wantStatus int
+		wantBody   string
+	}{
+		{
+			name:       "plain",
+			body:       []byte(payload),
+			maxSize:    10,
+			wantStatus: http.StatusOK,
+			wantBody:   payload,
+		},
+		{
+			name:       "gzip",
+			encoding:   "gzip",
+			body:       gzipped(t, payload),
+			maxSize:    int64(len(payload)),
+			wantStatus: http.StatusOK,
+			wantBody:   payload,
+		},
+		{
+			name:       "too large",
+			encoding:   "gzip",
+			body:       gzipped(t, strings.Repeat("a", 1<<20)),
+			maxSize:    1 << 10,
+			wantStatus: http.StatusRequestEntityTooLarge,
+		},
+		{
+			name:       "broken",
+			encoding:   "gzip",
+			body:       []byte(payload),
+			maxSize:    1 << 10,
+			wantStatus: http.StatusBadRequest,
+		},
+		{
+			name:       "unsupported",
+			encoding:   "zstd",
+			body:       []byte(payload),
+			maxSize:    1 << 10,
+			wantStatus: http.StatusUnsupportedMediaType,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var got string
+			h := decompress(tt.maxSize, config.TestLogger())(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				assert.Empty(t, r.Header.Get("Content-Encoding"))
+				body, err := io.ReadAll(r.Body)
+				require.NoError(t, err)
+				got = string(body)
+			}))
+
+			r := httptest.NewRequest(http.MethodPost, "/updates", bytes.NewReader(tt.body))
+			if tt.encoding != "" {
+				r.Header.Set("Content-Encoding", tt.encoding)
+			}
+			w := httptest.NewRecorder()
+			h.ServeHTTP(w, r)
+
+			assert.Equal(t, tt.wantStatus, w.Code)
+			assert.Equal(t, tt.wantBody, got)
+		})
+	}
+}
+
+func Test_decrypt(t *testing.T) {
+	k, err := rsa.GenerateKey(rand.Reader, 2048)
+	require.NoError(t, err)
+	dir := t.TempDir()
+	pubPath, privPath := filepath.Join(dir, "pub.pem"), filepath.Join(dir, "priv.pem")
+	require.NoError(t, os.WriteFile(pubPath, pem.EncodeToMemory(&pem.Block{
+		Type: "RSA PUBLIC KEY", Bytes: x509.MarshalPKCS1PublicKey(&k.PublicKey),
+	}), 0600))
+	require.NoError(t, os.WriteFile(privPath, pem.EncodeToMemory(&pem.Block{
+		Type: "RSA PRIVATE KEY", Bytes: x509.MarshalPKCS1PrivateKey(k),
+	}), 0600))
+
+	e, err := encryption.NewEncrypter(pubPath)
+	require.NoError(t, err)
+	d, err := encryption.NewDecrypter(privPath)
+	require.NoError(t, err)
+
+	payload := "[{\"id\":\"Alloc\",\"type\":\"gauge\",\"value\":1}]"
+	encrypted, err := e.Encrypt(gzipped(t, payload))
+	require.NoError(t, err)
+
+	tests := []struct {
+		name       string
+		decrypter  *encryption.Decrypter
+		alg        string
+		body       []byte
+		wantStatus int
+		wantBody   string
+	}{
+		{
+			name:       "encrypted and compressed",
+			decrypter:  d,
+			alg:        e.Alg(),
+			body:       encrypted,
+			wantStatus: http.StatusOK,
+			wantBody:   payload,
+		},
+		{
+			name:       "plain",
+			decrypter:  d,
+			body:       gzipped(t, payload),
+			wantStatus: http.StatusOK,
+			wantBody:   payload,
+		},
+		{
+			name:       "tampered",
+			decrypter:  d,
+			alg:        e.Alg(),
+			body:       append(append([]byte{}, encrypted[:len(encrypted)-1]...), encrypted[len(encrypted)-1]^1),
+			wantStatus: http.StatusBadRequest,
+		},
+		{
+			name:       "wrong algorithm",
+			decrypter:  d,
+			alg:        encryption.AlgECDH,
+			body:       encrypted,
+			wantStatus: http.StatusBadRequest,
+		},
+		{
+			name:       "no key",
+			alg:        e.Alg(),
+			body:       encrypted,
+			wantStatus: http.StatusBadRequest,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var got string
+			logger := config.TestLogger()
+			h := decrypt(tt.decrypter, 1<<20, logger)(decompress(1<<20, logger)(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				body, err := io.ReadAll(r.Body)
+				require.NoError(t, err)
+				got = string(body)
+			})))
+
+			r := httptest.NewRequest(http.MethodPost, "/updates", bytes.NewReader(tt.body))
+			r.Header.Set("Content-Encoding", "gzip")
+			if tt.alg != "" {
+				r.Header.Set(encryption.Header, tt.alg)
+			}
+			w := httptest.NewRecorder()
+			h.ServeHTTP(w, r)
+
+			assert.Equal(t, tt.wantStatus, w.Code)
+			assert.Equal(t, tt.wantBody, got)
+		})
+	}
+}
+
+func Test_trustedSubnet(t *testing.T) {
+	_, subnet, err := net.ParseCIDR("192.168.1.0/24")
+	require.NoError(t, err)
+
+	tests := []struct {
+		name       string
+		subnet     *net.IPNet
+		realIP     string
+		wantStatus int
+	}{
+		{
+			name:       "trusted",
+			subnet:     subnet,
+			realIP:     "192.168.1.10",
+			wantStatus: http.StatusOK,
+		},
+		{
+			name:       "untrusted",
+			subnet:     subnet,
+			realIP:     "10.0.0.1",
+			wantStatus: http.StatusForbidden,
+		},
+		{
+			name:       "no header",
+			subnet:     subnet,
+			wantStatus: http.StatusForbidden,
+		},
+		{
+			name:       "garbage",
+			subnet:     subnet,
+			realIP:     "192.168.1.x",
+			wantStatus: http.StatusForbidden,
+		},
+		{
+			name:       "disabled",
+			wantStatus: http.StatusOK,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			h := trustedSubnet(tt.subnet)(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+
+			r := httptest.NewRequest(http.MethodPost, "/updates", nil)
+			if tt.realIP != "" {
+				r.Header.Set("X-Real-IP", tt.realIP)
+			}
+			w := httptest.NewRecorder()
+			h.ServeHTTP(w, r)
+
+			assert.Equal(t, tt.wantStatus, w.Code)
+		})
+	}
+}
+
+// lookupStore отвечает на любой токен одной ошибкой
+type lookupStore struct {
+	err error
+}
+
+func (s lookupStore) Lookup(_ context.Context, _ string) (*auth.Token, error) {
+	return nil, s.err
+}
+
+func Test_authorize_storeErrors(t *testing.T) {
+	tests := []struct {
+		name       string
+		err        error
+		wantStatus int
+	}{
+		{name: "unknown token", err: auth.ErrUnknownToken, wantStatus: http.StatusUnauthorized},
+		{name: "db unavailable", err: fmt.Errorf("%w: connection refused", auth.ErrUnavailable), wantStatus: http.StatusServiceUnavailable},
+		{name: "other error", err: errors.New("broken"), wantStatus: http.StatusInternalServerError},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			h := authorize(lookupStore{err: tt.err}, auth.ScopeWrite, config.TestLogger())(
+				http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+
+			r := httptest.NewRequest(http.MethodPost, "/updates", nil)
+			r.Header.Set("Authorization", "Bearer secret")
+			w := httptest.NewRecorder()
+			h.ServeHTTP(w, r)
+
+			assert.Equal(t, tt.wantStatus, w.Code)
+		})
+	}
+}
+
+func Test_newAuthStore_tokensDB(t *testing.T) {
+	cfg := config.NewServerConfig()
+	cfg.TokensDB = true
+	cfg.Database = "bolt://" + filepath.Join(t.TempDir(), "metrics.db")
+	db := storage.New(cfg, config.TestLogger())
+	defer db.Close()
+
+	_, err := newAuthStore(cfg, db)
+	assert.Error(t, err, "tokens need a Postgres pool")
+}
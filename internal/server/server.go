@@ -1,6 +1,11 @@
 package server
 
 import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"net"
 	"net/http"
 	"os"
 	"os/signal"
@@ -9,7 +14,9 @@ import (
 	"github.com/go-chi/chi/v5"
 	"github.com/go-chi/chi/v5/middleware"
 
+	"github.com/fedoroko/practicum_go/internal/auth"
 	"github.com/fedoroko/practicum_go/internal/config"
+	"github.com/fedoroko/practicum_go/internal/encryption"
 	"github.com/fedoroko/practicum_go/internal/handlers"
 	"github.com/fedoroko/practicum_go/internal/storage"
 )
@@ -18,16 +25,28 @@ func Run(cfg *config.ServerConfig, logger *config.Logger) {
 	db := storage.New(cfg, logger)
 	defer db.Close()
 
-	r := router(&db, logger)
+	r := router(cfg, &db, logger)
 
 	server := &http.Server{
 		Addr:    cfg.Address,
 		Handler: r,
 	}
 
+	tlsConfig, err := newTLSConfig(cfg)
+	if err != nil {
+		logger.Fatal().Err(err).Msg("tls")
+	}
+	server.TLSConfig = tlsConfig
+
 	defer server.Close()
 	go func() {
-		if err := server.ListenAndServe(); err != nil {
+		var err error
+		if tlsConfig != nil {
+			err = server.ListenAndServeTLS(cfg.TLSCert, cfg.TLSKey)
+		} else {
+			err = server.ListenAndServe()
+		}
+		if err != nil {
 			logger.Error().Err(err).Send()
 		}
 	}()
@@ -41,7 +60,7 @@ func Run(cfg *config.ServerConfig, logger *config.Logger) {
 	<-sig
 }
 
-func router(db *storage.Repository, logger *config.Logger) chi.Router {
+func router(cfg *config.ServerConfig, db *storage.Repository, logger *config.Logger) chi.Router {
 	r := chi.NewRouter()
 
 	r.Use(middleware.Recoverer)
@@ -50,14 +69,43 @@ func router(db *storage.Repository, logger *config.Logger) chi.Router {
 	r.Use(middleware.Logger)
 	r.Use(middleware.Compress(5))
 
+	// агент сначала сжимает, потом шифрует
+	var d *encryption.Decrypter
+	if cfg.CryptoKey != "" {
+		var err error
+		if d, err = encryption.NewDecrypter(cfg.CryptoKey); err != nil {
+			logger.Fatal().Err(err).Msg("crypto key")
+		}
+	}
+	r.Use(decrypt(d, cfg.MaxBodySize, logger))
+	r.Use(decompress(cfg.MaxBodySize, logger))
+
 	h := handlers.NewRepoHandler(*db, logger)
 
-	r.Get("/", h.IndexFunc)
+	store, err := newAuthStore(cfg, *db)
+	if err != nil {
+		logger.Fatal().Err(err).Msg("auth tokens")
+	}
+	read := authorize(store, auth.ScopeRead, logger)
+	write := authorize(store, auth.ScopeWrite, logger)
+
+	r.With(read).Get("/", h.IndexFunc)
 	r.Route("/value", func(r chi.Router) {
+		r.Use(read)
 		r.Post("/", h.GetJSONFunc)
 		r.Get("/{type}/{name}", h.GetFunc)
 	})
+	// запись метрик доступна только агентам из доверенной подсети
+	var subnet *net.IPNet
+	if cfg.TrustedSubnet != "" {
+		if _, subnet, err = net.ParseCIDR(cfg.TrustedSubnet); err != nil {
+			logger.Fatal().Err(err).Msg("trusted subnet")
+		}
+	}
+
 	r.Route("/update", func(r chi.Router) {
+		r.Use(trustedSubnet(subnet))
+		r.Use(write)
 		r.Post("/", h.UpdateJSONFunc)
 		r.Post("/{type}/{name}/{value}", h.UpdateFunc)
 	})
@@ -65,8 +113,82 @@ func router(db *storage.Repository, logger *config.Logger) chi.Router {
 		r.Get("/", h.PingFunc)
 	})
 	r.Route("/updates", func(r chi.Router) {
+		r.Use(trustedSubnet(subnet))
+		r.Use(write)
 		r.Post("/", h.UpdatesFunc)
 	})
 
 	return r
 }
+
+// newAuthStore собирает хранилище токенов из конфига,
+// nil означает, что аутентификация выключена.
+// TokensDB читает токены через пул хранилища метрик.
+func newAuthStore(cfg *config.ServerConfig, db storage.Repository) (auth.Store, error) {
+	var stores []auth.Store
+	if cfg.TokensFile != "" {
+		s, err := auth.NewFileStore(cfg.TokensFile)
+		if err != nil {
+			return nil, err
+		}
+		stores = append(stores, s)
+	}
+	if cfg.TokensDB {
+		pool, ok := storage.SQLDB(db)
+		if !ok {
+			return nil, errors.New("TOKENS_DB requires a Postgres DATABASE_DSN")
+		}
+		stores = append(stores, auth.NewPostgresStore(pool, cfg.QueryTimeout))
+	}
+
+	if len(stores) == 0 {
+		return nil, nil
+	}
+	return auth.Chain(stores...), nil
+}
+
+// newTLSConfig возвращает nil, если сертификат сервера не задан.
+// С TLSClientCA сервер требует клиентский сертификат, подписанный этим CA.
+func newTLSConfig(cfg *config.ServerConfig) (*tls.Config, error) {
+	if cfg.TLSCert == "" && cfg.TLSKey == "" {
+		if cfg.TLSClientCA != "" {
+			return nil, errors.New("client CA requires server certificate")
+		}
+		return nil, nil
+	}
+
+	cert, err := tls.LoadX509KeyPair(cfg.TLSCert, cfg.TLSKey)
+	if err != nil {
+		return nil, err
+	}
+
+	c := &tls.Config{
+		Certificates: []tls.Certificate{cert},
+		MinVersion:   tls.VersionTLS12,
+	}
+
+	if cfg.TLSClientCA != "" {
+		pool, err := loadCertPool(cfg.TLSClientCA)
+		if err != nil {
+			return nil, err
+		}
+		c.ClientCAs = pool
+		c.ClientAuth = tls.RequireAndVerifyClientCert
+	}
+
+	return c, nil
+}
+
+func loadCertPool(path string) (*x509.CertPool, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(data) {
+		return nil, fmt.Errorf("%s: no certificates found", path)
+	}
+
+	return pool, nil
+}
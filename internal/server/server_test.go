@@ -6,12 +6,15 @@ import (
 	"io/ioutil"
 	"net/http"
 	"net/http/httptest"
+	"os"
+	"path/filepath"
 	"testing"
 
 	"github.com/golang/mock/gomock"
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/require"
 
+	"github.com/fedoroko/practicum_go/internal/auth"
 	"github.com/fedoroko/practicum_go/internal/config"
 	"github.com/fedoroko/practicum_go/internal/metrics"
 	"github.com/fedoroko/practicum_go/internal/mocks"
@@ -40,24 +43,24 @@ func TestRouter(t *testing.T) {
 	var db storage.Repository
 	tdb := mocks.NewMockRepository(ctrl)
 	m, _ := metrics.RawWithValue("gauge", "Alloc", "1")
-	tdb.EXPECT().Set(m).Return(nil)
+	tdb.EXPECT().Set(gomock.Any(), m).Return(nil)
 
 	m, _ = metrics.Raw("gauge", "Alloc")
 	ret, _ := metrics.RawWithValue("gauge", "Alloc", "1")
-	tdb.EXPECT().Get(m).Return(ret, nil)
+	tdb.EXPECT().Get(gomock.Any(), m).Return(ret, nil)
 
-	tdb.EXPECT().List().Return([]metrics.Metric{}, nil)
+	tdb.EXPECT().List(gomock.Any()).Return([]metrics.Metric{}, nil)
 
 	m, _ = metrics.FromJSON(bytes.NewBuffer([]byte("{\"id\":\"Alloc\",\"type\":\"gauge\",\"value\":393728}")))
-	tdb.EXPECT().Set(m).Return(nil)
+	tdb.EXPECT().Set(gomock.Any(), m).Return(nil)
 
 	m, _ = metrics.FromJSON(bytes.NewBuffer([]byte("{\"id\":\"Alloc\",\"type\":\"gauge\"}")))
 	ret, _ = metrics.RawWithValue("gauge", "Alloc", "1")
-	tdb.EXPECT().Get(m).Return(ret, nil)
+	tdb.EXPECT().Get(gomock.Any(), m).Return(ret, nil)
 
 	db = tdb
 	logger := config.TestLogger()
-	r := router(&db, logger)
+	r := router(config.NewServerConfig(), &db, logger)
 	ts := httptest.NewServer(r)
 	defer ts.Close()
 
@@ -94,3 +97,108 @@ func TestRouter(t *testing.T) {
 	assert.Equal(t, http.StatusOK, resp.StatusCode)
 	assert.Equal(t, "{\"id\":\"Alloc\",\"type\":\"gauge\",\"value\":1}", body)
 }
+
+func TestRouter_trustedSubnet(t *testing.T) {
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+
+	var db storage.Repository
+	tdb := mocks.NewMockRepository(ctrl)
+	tdb.EXPECT().List(gomock.Any()).Return([]metrics.Metric{}, nil)
+	m, _ := metrics.RawWithValue("gauge", "Alloc", "1")
+	tdb.EXPECT().Set(gomock.Any(), m).Return(nil)
+	db = tdb
+
+	cfg := config.NewServerConfig()
+	cfg.TrustedSubnet = "10.0.0.0/8"
+	ts := httptest.NewServer(router(cfg, &db, config.TestLogger()))
+	defer ts.Close()
+
+	resp, _ := testRequest(t, ts, "POST", "/update/gauge/Alloc/1", nil)
+	defer resp.Body.Close()
+	assert.Equal(t, http.StatusForbidden, resp.StatusCode)
+
+	resp, _ = testRequest(t, ts, "POST", "/updates", bytes.NewBufferString("[]"))
+	defer resp.Body.Close()
+	assert.Equal(t, http.StatusForbidden, resp.StatusCode)
+
+	// чтение не ограничено
+	resp, _ = testRequest(t, ts, "GET", "/", nil)
+	defer resp.Body.Close()
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+
+	req, err := http.NewRequest("POST", ts.URL+"/update/gauge/Alloc/1", nil)
+	require.NoError(t, err)
+	req.Header.Set("X-Real-IP", "10.1.2.3")
+	resp, err = http.DefaultClient.Do(req)
+	require.NoError(t, err)
+	defer resp.Body.Close()
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+}
+
+func TestRouter_tokens(t *testing.T) {
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+
+	var db storage.Repository
+	tdb := mocks.NewMockRepository(ctrl)
+	m, _ := metrics.RawWithValue("gauge", "web_Alloc", "1")
+	tdb.EXPECT().Set(gomock.Any(), m).Return(nil)
+	web, _ := metrics.RawWithValue("gauge", "web_Alloc", "1")
+	other, _ := metrics.RawWithValue("gauge", "db_Alloc", "2")
+	tdb.EXPECT().List(gomock.Any()).Return([]metrics.Metric{web, other}, nil)
+	db = tdb
+
+	tokens := filepath.Join(t.TempDir(), "tokens.json")
+	require.NoError(t, os.WriteFile(tokens, []byte(`[
+		{"name":"web","hash":"`+auth.Hash("web-token")+`","scopes":["write","read"],"prefix":"web_"},
+		{"name":"reader","hash":"`+auth.Hash("read-token")+`","scopes":["read"]}
+	]`), 0600))
+
+	cfg := config.NewServerConfig()
+	cfg.TokensFile = tokens
+	ts := httptest.NewServer(router(cfg, &db, config.TestLogger()))
+	defer ts.Close()
+
+	request := func(method, path, token string) (int, string) {
+		req, err := http.NewRequest(method, ts.URL+path, nil)
+		require.NoError(t, err)
+		if token != "" {
+			req.Header.Set("Authorization", "Bearer "+token)
+		}
+		resp, err := http.DefaultClient.Do(req)
+		require.NoError(t, err)
+		defer resp.Body.Close()
+		body, err := io.ReadAll(resp.Body)
+		require.NoError(t, err)
+		return resp.StatusCode, string(body)
+	}
+
+	tests := []struct {
+		name   string
+		method string
+		path   string
+		token  string
+		want   int
+	}{
+		{name: "no token", method: "POST", path: "/update/gauge/web_Alloc/1", want: http.StatusUnauthorized},
+		{name: "unknown token", method: "POST", path: "/update/gauge/web_Alloc/1", token: "nope", want: http.StatusUnauthorized},
+		{name: "no write scope", method: "POST", path: "/update/gauge/web_Alloc/1", token: "read-token", want: http.StatusForbidden},
+		{name: "foreign prefix", method: "POST", path: "/update/gauge/db_Alloc/1", token: "web-token", want: http.StatusForbidden},
+		{name: "write", method: "POST", path: "/update/gauge/web_Alloc/1", token: "web-token", want: http.StatusOK},
+		{name: "ping is open", method: "GET", path: "/ping", want: http.StatusOK},
+	}
+	tdb.EXPECT().Ping(gomock.Any()).Return(nil)
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, _ := request(tt.method, tt.path, tt.token)
+			assert.Equal(t, tt.want, got)
+		})
+	}
+
+	// список метрик фильтруется по префиксу токена
+	code, body := request("GET", "/", "web-token")
+	assert.Equal(t, http.StatusOK, code)
+	assert.Contains(t, body, "web_Alloc")
+	assert.NotContains(t, body, "db_Alloc")
+}
@@ -0,0 +1,109 @@
+package server
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/fedoroko/practicum_go/internal/config"
+	"github.com/fedoroko/practicum_go/internal/testcerts"
+)
+
+func Test_newTLSConfig(t *testing.T) {
+	certs := testcerts.Generate(t)
+
+	caData, err := os.ReadFile(certs.CA)
+	require.NoError(t, err)
+	roots := x509.NewCertPool()
+	require.True(t, roots.AppendCertsFromPEM(caData))
+	clientCert, err := tls.LoadX509KeyPair(certs.ClientCert, certs.ClientKey)
+	require.NoError(t, err)
+
+	tests := []struct {
+		name       string
+		cert       string
+		key        string
+		clientCA   string
+		withClient bool
+		wantNil    bool
+		wantErr    bool
+		wantReject bool
+	}{
+		{
+			name:    "disabled",
+			wantNil: true,
+		},
+		{
+			name:     "client ca without certificate",
+			clientCA: certs.CA,
+			wantErr:  true,
+		},
+		{
+			name:    "missing key",
+			cert:    certs.ServerCert,
+			wantErr: true,
+		},
+		{
+			name: "tls",
+			cert: certs.ServerCert,
+			key:  certs.ServerKey,
+		},
+		{
+			name:       "mtls",
+			cert:       certs.ServerCert,
+			key:        certs.ServerKey,
+			clientCA:   certs.CA,
+			withClient: true,
+		},
+		{
+			name:       "mtls without client certificate",
+			cert:       certs.ServerCert,
+			key:        certs.ServerKey,
+			clientCA:   certs.CA,
+			wantReject: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg := config.NewServerConfig()
+			cfg.TLSCert, cfg.TLSKey, cfg.TLSClientCA = tt.cert, tt.key, tt.clientCA
+
+			got, err := newTLSConfig(cfg)
+			if tt.wantErr {
+				assert.Error(t, err)
+				return
+			}
+			require.NoError(t, err)
+			if tt.wantNil {
+				assert.Nil(t, got)
+				return
+			}
+
+			ts := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+			ts.TLS = got
+			ts.StartTLS()
+			defer ts.Close()
+
+			clientTLS := &tls.Config{RootCAs: roots}
+			if tt.withClient {
+				clientTLS.Certificates = []tls.Certificate{clientCert}
+			}
+			c := &http.Client{Transport: &http.Transport{TLSClientConfig: clientTLS}}
+
+			resp, err := c.Get(ts.URL + "/ping")
+			if tt.wantReject {
+				assert.Error(t, err)
+				return
+			}
+			require.NoError(t, err)
+			defer resp.Body.Close()
+			assert.Equal(t, http.StatusOK, resp.StatusCode)
+		})
+	}
+}
@@ -0,0 +1,87 @@
+package storage
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+	"unicode/utf8"
+
+	"github.com/fedoroko/practicum_go/internal/metrics"
+)
+
+// ErrNotApplied - метрика корректна, но атомарный батч отклонен из-за других
+var ErrNotApplied = errors.New("batch rejected, metric not applied")
+
+// maxNameLength - размер колонки metrics.name
+const maxNameLength = 255
+
+// checkName отклоняет имена, которые не поместятся в хранилище:
+// иначе ошибка всплывет только при записи в базу
+func checkName(m metrics.Metric) error {
+	switch n := utf8.RuneCountInString(m.Name()); {
+	case n == 0:
+		return metrics.ThrowInvalidNameError(m.Name(), "empty name")
+	case n > maxNameLength:
+		return metrics.ThrowInvalidNameError(m.Name(), fmt.Sprintf("longer than %d characters", maxNameLength))
+	}
+
+	return nil
+}
+
+// validateBatch проверяет каждую метрику батча, nil в ответе - метрика годна
+func validateBatch(ms []metrics.Metric, check func(metrics.Metric) error) ([]error, bool) {
+	errs := make([]error, len(ms))
+	failed := false
+	for i, m := range ms {
+		if err := m.CheckType(); err != nil {
+			errs[i] = err
+			failed = true
+			continue
+		}
+		if err := checkName(m); err != nil {
+			errs[i] = err
+			failed = true
+			continue
+		}
+
+		if err := check(m); err != nil {
+			errs[i] = err
+			failed = true
+		}
+	}
+
+	return errs, failed
+}
+
+// checkBatch проверяет тип и подпись каждой метрики, а nonce всего
+// батча занимает одним вызовом replayGuard
+func checkBatch(
+	ctx context.Context,
+	ms []metrics.Metric,
+	keys *metrics.KeyRing,
+	g replayGuard,
+	window time.Duration,
+) ([]error, bool, error) {
+	errs, _ := validateBatch(ms, keys.Check)
+	if err := checkReplayBatch(ctx, g, replayWindow(keys, window), ms, errs); err != nil {
+		return nil, false, err
+	}
+
+	for _, err := range errs {
+		if err != nil {
+			return errs, true, nil
+		}
+	}
+
+	return errs, false, nil
+}
+
+// notApplied помечает принятые метрики отклоненного атомарного батча
+func notApplied(errs []error) {
+	for i := range errs {
+		if errs[i] == nil {
+			errs[i] = ErrNotApplied
+		}
+	}
+}
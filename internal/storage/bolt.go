@@ -0,0 +1,247 @@
+package storage
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"math"
+	"net/url"
+	"time"
+
+	"go.etcd.io/bbolt"
+
+	"github.com/fedoroko/practicum_go/internal/config"
+	"github.com/fedoroko/practicum_go/internal/metrics"
+)
+
+// boltScheme выбирает встроенное хранилище вместо Postgres:
+// DATABASE_DSN=bolt:///var/lib/metrics.db
+const boltScheme = "bolt"
+
+// boltDB хранит метрики в одном файле, бакет на каждый тип:
+// ключ - имя, значение - 8 байт big-endian (биты float64 или int64).
+// Файл блокируется, поэтому с ним работает только один сервер.
+type boltDB struct {
+	db     *bbolt.DB
+	cfg    *config.ServerConfig
+	keys   *metrics.KeyRing
+	replay replayGuard
+	logger *config.Logger
+}
+
+var boltBuckets = []string{metrics.GaugeType, metrics.CounterType}
+
+func (b *boltDB) Get(_ context.Context, m metrics.Metric) (metrics.Metric, error) {
+	if err := m.CheckType(); err != nil {
+		return m, err
+	}
+
+	var raw []byte
+	err := b.db.View(func(tx *bbolt.Tx) error {
+		if v := tx.Bucket([]byte(m.Type())).Get([]byte(m.Name())); v != nil {
+			raw = append(raw, v...)
+		}
+		return nil
+	})
+	if err != nil {
+		return m, err
+	}
+	if raw == nil {
+		return m, ErrNotFound
+	}
+
+	ret := decodeBolt(m.Name(), m.Type(), raw)
+	if err = b.keys.Sign(ret); err != nil {
+		return ret, err
+	}
+
+	return ret, nil
+}
+
+func (b *boltDB) Set(ctx context.Context, m metrics.Metric) error {
+	if err := m.CheckType(); err != nil {
+		return err
+	}
+	if err := b.check(ctx, m); err != nil {
+		return err
+	}
+
+	return b.db.Update(func(tx *bbolt.Tx) error {
+		return putBolt(tx, m)
+	})
+}
+
+// SetBatch пишет все корректные метрики одной транзакцией. Имена проверены
+// в checkBatch; если bbolt все же отклонит ключ, без atomic это ошибка
+// только этой метрики. Прочие ошибки транзакции - сбой всего батча.
+func (b *boltDB) SetBatch(ctx context.Context, ms []metrics.Metric, atomic bool) ([]error, error) {
+	errs, failed, err := b.checkBatch(ctx, ms)
+	if err != nil {
+		return nil, err
+	}
+	if atomic && failed {
+		notApplied(errs)
+		return errs, nil
+	}
+
+	err = b.db.Update(func(tx *bbolt.Tx) error {
+		for i, m := range ms {
+			if errs[i] != nil {
+				continue
+			}
+			err := putBolt(tx, m)
+			switch {
+			case err == nil:
+			case !atomic && invalidBoltKey(err):
+				errs[i] = metrics.ThrowInvalidNameError(m.Name(), err.Error())
+			default:
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return errs, nil
+}
+
+func (b *boltDB) check(ctx context.Context, m metrics.Metric) error {
+	if err := checkName(m); err != nil {
+		return err
+	}
+	if err := b.keys.Check(m); err != nil {
+		return err
+	}
+
+	return checkReplay(ctx, b.replay, replayWindow(b.keys, b.cfg.ReplayWindow), m)
+}
+
+func (b *boltDB) checkBatch(ctx context.Context, ms []metrics.Metric) ([]error, bool, error) {
+	return checkBatch(ctx, ms, b.keys, b.replay, b.cfg.ReplayWindow)
+}
+
+// List отдает метрики в порядке listQuery: бакеты по убыванию типа,
+// ключи в бакете bbolt уже отсортированы по имени
+func (b *boltDB) List(_ context.Context) ([]metrics.Metric, error) {
+	var ret []metrics.Metric
+	err := b.db.View(func(tx *bbolt.Tx) error {
+		for _, t := range boltBuckets {
+			err := tx.Bucket([]byte(t)).ForEach(func(k, v []byte) error {
+				ret = append(ret, decodeBolt(string(k), t, v))
+				return nil
+			})
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+
+	return ret, err
+}
+
+func (b *boltDB) Ping(_ context.Context) error {
+	return nil
+}
+
+func (b *boltDB) Close() error {
+	b.logger.Info().Msg("DB: closed")
+	return b.db.Close()
+}
+
+// putBolt прибавляет дельту счетчика к сохраненному значению,
+// gauge и cumulative counter перезаписываются
+func putBolt(tx *bbolt.Tx, m metrics.Metric) error {
+	bucket := tx.Bucket([]byte(m.Type()))
+	key := []byte(m.Name())
+
+	var bits uint64
+	switch m.Type() {
+	case metrics.GaugeType:
+		bits = math.Float64bits(m.Float64Value())
+	case metrics.CounterType:
+		v := m.Int64Value()
+		if cur := bucket.Get(key); cur != nil && !m.IsCumulative() {
+			v += int64(binary.BigEndian.Uint64(cur))
+		}
+		bits = uint64(v)
+	default:
+		return metrics.ThrowInvalidTypeError(m.Type())
+	}
+
+	buf := make([]byte, 8)
+	binary.BigEndian.PutUint64(buf, bits)
+	return bucket.Put(key, buf)
+}
+
+func invalidBoltKey(err error) bool {
+	return errors.Is(err, bbolt.ErrKeyRequired) || errors.Is(err, bbolt.ErrKeyTooLarge)
+}
+
+func decodeBolt(name, mtype string, raw []byte) metrics.Metric {
+	bits := binary.BigEndian.Uint64(raw)
+	if mtype == metrics.GaugeType {
+		return metrics.NewOmitEmpty(name, mtype, metrics.PointerFromFloat64(math.Float64frombits(bits)), nil)
+	}
+	return metrics.NewOmitEmpty(name, mtype, nil, metrics.PointerFromInt64(int64(bits)))
+}
+
+// boltPath достает путь к файлу из DSN: bolt:///abs/path или bolt://rel/path
+func boltPath(dsn string) (string, error) {
+	u, err := url.Parse(dsn)
+	if err != nil {
+		return "", err
+	}
+	if u.Scheme != boltScheme {
+		return "", fmt.Errorf("unexpected scheme %q", u.Scheme)
+	}
+
+	path := u.Host + u.Path
+	if path == "" {
+		return "", errors.New("bolt DSN has no file path")
+	}
+
+	return path, nil
+}
+
+func boltInterface(cfg *config.ServerConfig, logger *config.Logger) *boltDB {
+	path, err := boltPath(cfg.Database)
+	if err != nil {
+		panic(err)
+	}
+
+	// Timeout не дает зависнуть, если файл держит другой процесс
+	db, err := bbolt.Open(path, 0600, &bbolt.Options{Timeout: time.Second})
+	if err != nil {
+		panic(err)
+	}
+
+	err = db.Update(func(tx *bbolt.Tx) error {
+		for _, t := range boltBuckets {
+			if _, err := tx.CreateBucketIfNotExists([]byte(t)); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		panic(err)
+	}
+
+	keys, err := newKeyRing(cfg)
+	if err != nil {
+		panic(err)
+	}
+
+	subLogger := logger.With().Str("Component", "BOLT-DB").Logger()
+	return &boltDB{
+		db:     db,
+		cfg:    cfg,
+		keys:   keys,
+		replay: newMemoryGuard(cfg.ReplayWindow),
+		logger: config.NewLogger(&subLogger),
+	}
+}
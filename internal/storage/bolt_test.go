@@ -0,0 +1,152 @@
+package storage
+
+import (
+	"context"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/fedoroko/practicum_go/internal/config"
+	"github.com/fedoroko/practicum_go/internal/metrics"
+)
+
+func testBolt(t *testing.T, path string) *boltDB {
+	cfg := config.NewServerConfig()
+	cfg.Database = "bolt://" + path
+
+	r, ok := New(cfg, config.TestLogger()).(*boltDB)
+	require.True(t, ok, "bolt DSN selects bolt backend")
+	return r
+}
+
+func Test_boltPath(t *testing.T) {
+	tests := []struct {
+		name    string
+		dsn     string
+		want    string
+		wantErr bool
+	}{
+		{name: "absolute", dsn: "bolt:///var/lib/metrics.db", want: "/var/lib/metrics.db"},
+		{name: "relative", dsn: "bolt://data/metrics.db", want: "data/metrics.db"},
+		{name: "no path", dsn: "bolt://", wantErr: true},
+		{name: "postgres", dsn: "postgres://localhost/metrics", wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := boltPath(tt.dsn)
+			if tt.wantErr {
+				assert.Error(t, err)
+				return
+			}
+			require.NoError(t, err)
+			assert.Equal(t, tt.want, got)
+		})
+	}
+}
+
+func Test_boltDB_Set(t *testing.T) {
+	ctx := context.Background()
+	r := testBolt(t, filepath.Join(t.TempDir(), "metrics.db"))
+	defer r.Close()
+
+	tests := []struct {
+		name   string
+		metric metrics.Metric
+		want   string
+	}{
+		{name: "gauge", metric: gaugeValue("Alloc", 1.5), want: "1.5"},
+		{name: "gauge overwrite", metric: gaugeValue("Alloc", 0.1), want: "0.1"},
+		{name: "counter", metric: counterDelta("PollCount", 2), want: "2"},
+		{name: "counter accumulates", metric: counterDelta("PollCount", 3), want: "5"},
+		{name: "cumulative counter", metric: counterTotal("PollCount", 10), want: "10"},
+		{name: "negative delta", metric: counterDelta("PollCount", -4), want: "6"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			require.NoError(t, r.Set(ctx, tt.metric))
+
+			got, err := r.Get(ctx, metrics.NewOmitEmpty(tt.metric.Name(), tt.metric.Type(), nil, nil))
+			require.NoError(t, err)
+			assert.Equal(t, tt.want, got.ToString())
+		})
+	}
+
+	_, err := r.Get(ctx, gaugeValue("Missing", 0))
+	assert.ErrorIs(t, err, ErrNotFound)
+	assert.Error(t, r.Set(ctx, metrics.NewOmitEmpty("Bad", "int", nil, nil)))
+}
+
+func Test_boltDB_SetBatch(t *testing.T) {
+	ctx := context.Background()
+	r := testBolt(t, filepath.Join(t.TempDir(), "metrics.db"))
+	defer r.Close()
+
+	batch := []metrics.Metric{
+		counterDelta("PollCount", 1),
+		metrics.NewOmitEmpty("Bad", "int", nil, nil),
+		counterDelta("PollCount", 2),
+		gaugeValue("Alloc", 3),
+	}
+
+	errs, err := r.SetBatch(ctx, batch, true)
+	require.NoError(t, err)
+	assert.ErrorIs(t, errs[0], ErrNotApplied)
+	assert.Error(t, errs[1])
+	_, err = r.Get(ctx, counterDelta("PollCount", 0))
+	assert.ErrorIs(t, err, ErrNotFound, "atomic batch applies nothing")
+
+	errs, err = r.SetBatch(ctx, batch, false)
+	require.NoError(t, err)
+	assert.NoError(t, errs[0])
+	assert.Error(t, errs[1])
+
+	list, err := r.List(ctx)
+	require.NoError(t, err)
+	require.Len(t, list, 2)
+	assert.Equal(t, "Alloc", list[0].Name())
+	assert.Equal(t, "3", list[0].ToString())
+	assert.Equal(t, "PollCount", list[1].Name())
+	assert.Equal(t, "3", list[1].ToString())
+}
+
+// негодное имя - ошибка метрики, а не всего батча
+func Test_boltDB_SetBatch_names(t *testing.T) {
+	ctx := context.Background()
+	r := testBolt(t, filepath.Join(t.TempDir(), "metrics.db"))
+	defer r.Close()
+
+	errs, err := r.SetBatch(ctx, []metrics.Metric{
+		gaugeValue("", 1),
+		gaugeValue(strings.Repeat("x", maxNameLength+1), 1),
+		gaugeValue("Alloc", 2),
+	}, false)
+	require.NoError(t, err)
+	assert.ErrorAs(t, errs[0], &metrics.InvalidName)
+	assert.ErrorAs(t, errs[1], &metrics.InvalidName)
+	assert.NoError(t, errs[2])
+
+	got, err := r.Get(ctx, gaugeValue("Alloc", 0))
+	require.NoError(t, err)
+	assert.Equal(t, "2", got.ToString())
+
+	assert.ErrorAs(t, r.Set(ctx, gaugeValue("", 1)), &metrics.InvalidName)
+}
+
+func Test_boltDB_reopen(t *testing.T) {
+	ctx := context.Background()
+	path := filepath.Join(t.TempDir(), "metrics.db")
+
+	r := testBolt(t, path)
+	require.NoError(t, r.Set(ctx, counterDelta("PollCount", 7)))
+	require.NoError(t, r.Close())
+
+	r = testBolt(t, path)
+	defer r.Close()
+	require.NoError(t, r.Set(ctx, counterDelta("PollCount", 1)))
+	got, err := r.Get(ctx, counterDelta("PollCount", 0))
+	require.NoError(t, err)
+	assert.Equal(t, "8", got.ToString())
+}
@@ -0,0 +1,419 @@
+package storage
+
+import (
+	"context"
+	"errors"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/fedoroko/practicum_go/internal/config"
+	"github.com/fedoroko/practicum_go/internal/metrics"
+)
+
+// writeBehind - хранилище, в которое кэш сбрасывает уже проверенные метрики
+type writeBehind interface {
+	Repository
+	check(ctx context.Context, m metrics.Metric) error
+	checkBatch(ctx context.Context, ms []metrics.Metric) ([]error, bool, error)
+	flush(ctx context.Context, ms []metrics.Metric) error
+	// flushRows пишет метрики по одной, ошибка в ответе - строка не записана,
+	// ошибка вторым значением - сбой хранилища
+	flushRows(ctx context.Context, ms []metrics.Metric) ([]error, error)
+}
+
+type metricKey struct {
+	name  string
+	mtype string
+}
+
+func keyOf(m metrics.Metric) metricKey {
+	return metricKey{name: m.Name(), mtype: m.Type()}
+}
+
+// cache - write-behind слой перед базой. Подпись и nonce проверяются сразу,
+// после чего запись принята: чтения видят ее немедленно, а в базу она попадет
+// при следующем сбросе. Между сбросами записи склеиваются: gauge - последнее
+// значение, counter - сумма дельт после последнего cumulative.
+// Кэш считает себя единственным писателем базы; несброшенные записи
+// теряются при падении процесса, Close сбрасывает их. Пока база не
+// принимает сброс, кэш держит не больше CacheMaxPending метрик.
+type cache struct {
+	backend writeBehind
+	// values - текущие значения, pending - еще не сброшенные записи
+	values  map[metricKey]metrics.Metric
+	pending map[metricKey]metrics.Metric
+	mtx     sync.Mutex
+	// flushMtx не дает читать базу во время сброса, иначе прочитанное
+	// значение и pending могут учесть одну запись дважды
+	flushMtx sync.RWMutex
+	keys     *metrics.KeyRing
+	full     chan struct{}
+	done     chan struct{}
+	stopped  chan struct{}
+	cfg      *config.ServerConfig
+	logger   *config.Logger
+}
+
+func (c *cache) Get(ctx context.Context, m metrics.Metric) (metrics.Metric, error) {
+	if err := m.CheckType(); err != nil {
+		return m, err
+	}
+
+	c.mtx.Lock()
+	v, ok := c.values[keyOf(m)]
+	c.mtx.Unlock()
+
+	if !ok {
+		var err error
+		if v, err = c.load(ctx, m); err != nil {
+			return m, err
+		}
+	}
+
+	ret := metrics.Copy(v)
+	if err := c.keys.Sign(ret); err != nil {
+		return ret, err
+	}
+
+	return ret, nil
+}
+
+// load читает метрику из базы и накладывает на нее несброшенные записи
+func (c *cache) load(ctx context.Context, m metrics.Metric) (metrics.Metric, error) {
+	c.flushMtx.RLock()
+	defer c.flushMtx.RUnlock()
+
+	base, err := c.backend.Get(ctx, metrics.NewOmitEmpty(m.Name(), m.Type(), nil, nil))
+	switch {
+	case errors.Is(err, ErrNotFound):
+		base = nil
+	case err != nil:
+		return nil, err
+	}
+
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+
+	k := keyOf(m)
+	if v, ok := c.values[k]; ok {
+		return v, nil
+	}
+
+	p, ok := c.pending[k]
+	switch {
+	case base == nil && !ok:
+		return nil, ErrNotFound
+	case base == nil:
+		base = metrics.Copy(p)
+	case ok:
+		base = coalesce(metrics.Copy(base), p)
+	default:
+		base = metrics.Copy(base)
+	}
+
+	base.SetCumulative(false)
+	c.values[k] = base
+	return base, nil
+}
+
+func (c *cache) Set(ctx context.Context, m metrics.Metric) error {
+	if err := m.CheckType(); err != nil {
+		return err
+	}
+	if err := c.backend.check(ctx, m); err != nil {
+		return err
+	}
+
+	c.mtx.Lock()
+	if c.overflows([]metrics.Metric{m}, nil) {
+		c.mtx.Unlock()
+		return ErrUnavailable
+	}
+	c.put(m)
+	n := len(c.pending)
+	c.mtx.Unlock()
+
+	c.notify(n)
+	return nil
+}
+
+// SetBatch принимает батч целиком в память, atomic сохраняется
+// при сбросе: все склеенные записи пишутся одной транзакцией
+func (c *cache) SetBatch(ctx context.Context, ms []metrics.Metric, atomic bool) ([]error, error) {
+	errs, failed, err := c.backend.checkBatch(ctx, ms)
+	if err != nil {
+		return nil, err
+	}
+	if atomic && failed {
+		notApplied(errs)
+		return errs, nil
+	}
+
+	c.mtx.Lock()
+	if c.overflows(ms, errs) {
+		c.mtx.Unlock()
+		return nil, ErrUnavailable
+	}
+	for i, m := range ms {
+		if errs[i] == nil {
+			c.put(m)
+		}
+	}
+	n := len(c.pending)
+	c.mtx.Unlock()
+
+	c.notify(n)
+	return errs, nil
+}
+
+// overflows вызывается под mtx и сообщает, что принятые метрики
+// добавили бы в pending больше CacheMaxPending записей
+func (c *cache) overflows(ms []metrics.Metric, errs []error) bool {
+	if c.cfg.CacheMaxPending <= 0 {
+		return false
+	}
+
+	added := make(map[metricKey]bool)
+	for i, m := range ms {
+		if errs != nil && errs[i] != nil {
+			continue
+		}
+		if k := keyOf(m); c.pending[k] == nil {
+			added[k] = true
+		}
+	}
+
+	return len(c.pending)+len(added) > c.cfg.CacheMaxPending
+}
+
+// put вызывается под mtx. Значение дельты без известной базы
+// не запоминается, его досчитает load.
+func (c *cache) put(m metrics.Metric) {
+	k := keyOf(m)
+	if p, ok := c.pending[k]; ok {
+		c.pending[k] = coalesce(p, m)
+	} else {
+		c.pending[k] = metrics.Copy(m)
+	}
+
+	v, ok := c.values[k]
+	switch {
+	case ok:
+		v = coalesce(v, m)
+	case m.Type() == metrics.GaugeType || m.IsCumulative():
+		v = metrics.Copy(m)
+	default:
+		return
+	}
+	v.SetCumulative(false)
+	c.values[k] = v
+}
+
+// List читает базу и накладывает на нее несброшенные записи
+func (c *cache) List(ctx context.Context) ([]metrics.Metric, error) {
+	c.flushMtx.RLock()
+	defer c.flushMtx.RUnlock()
+
+	base, err := c.backend.List(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+
+	ret := make([]metrics.Metric, 0, len(base)+len(c.pending))
+	seen := make(map[metricKey]bool, len(base))
+	add := func(k metricKey, v metrics.Metric) {
+		v.SetCumulative(false)
+		c.values[k] = v
+		ret = append(ret, metrics.Copy(v))
+	}
+
+	for _, b := range base {
+		k := keyOf(b)
+		seen[k] = true
+
+		v := metrics.Copy(b)
+		if p, ok := c.pending[k]; ok {
+			v = coalesce(v, p)
+		}
+		add(k, v)
+	}
+	for k, p := range c.pending {
+		if !seen[k] {
+			add(k, metrics.Copy(p))
+		}
+	}
+
+	sortMetrics(ret)
+	return ret, nil
+}
+
+func (c *cache) Ping(ctx context.Context) error {
+	return c.backend.Ping(ctx)
+}
+
+// Close останавливает фоновый сброс и сбрасывает оставшиеся записи
+func (c *cache) Close() error {
+	close(c.done)
+	<-c.stopped
+
+	if err := c.flush(context.Background()); err != nil {
+		c.logger.Error().Err(err).Msg("Cache: final flush failed")
+		c.backend.Close()
+		return err
+	}
+
+	return c.backend.Close()
+}
+
+// flush пишет накопленные записи в базу. Если базу отклонила сама запись,
+// батч пишется по строке, а строки с ошибкой отбрасываются: иначе одна
+// плохая строка держала бы все следующие сбросы. При сбое базы записи
+// возвращаются в pending и склеиваются с пришедшими во время сброса.
+func (c *cache) flush(ctx context.Context) error {
+	c.flushMtx.Lock()
+	defer c.flushMtx.Unlock()
+
+	c.mtx.Lock()
+	batch := c.pending
+	c.pending = make(map[metricKey]metrics.Metric)
+	c.mtx.Unlock()
+
+	if len(batch) == 0 {
+		return nil
+	}
+
+	ms := make([]metrics.Metric, 0, len(batch))
+	for _, m := range batch {
+		ms = append(ms, m)
+	}
+	// одинаковый порядок строк не дает сбросам разных серверов
+	// взять блокировки навстречу друг другу
+	sortMetrics(ms)
+
+	err := c.backend.flush(ctx, ms)
+	if permanentFlushError(ctx, err) {
+		c.logger.Warn().Err(err).Msg("Cache: flush failed, retrying row by row")
+
+		var errs []error
+		if errs, err = c.backend.flushRows(ctx, ms); err == nil {
+			for i, e := range errs {
+				if e != nil {
+					c.logger.Error().Err(e).Str("name", ms[i].Name()).Str("type", ms[i].Type()).Msg("Cache: metric dropped")
+				}
+			}
+		}
+	}
+	if err == nil {
+		c.logger.Debug().Int("metrics", len(ms)).Msg("Cache: flushed")
+		return nil
+	}
+
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+	for k, m := range batch {
+		if newer, ok := c.pending[k]; ok {
+			m = coalesce(m, newer)
+		}
+		c.pending[k] = m
+	}
+
+	return err
+}
+
+// permanentFlushError - ошибка не связана с доступностью базы, и повтор
+// того же батча упадет так же. После неясного исхода COMMIT часть строк
+// могла записаться, поэтому такой батч только возвращается в pending.
+func permanentFlushError(ctx context.Context, err error) bool {
+	var commitErr *commitError
+	return err != nil &&
+		ctx.Err() == nil &&
+		!errors.Is(err, ErrUnavailable) &&
+		!errors.As(err, &commitErr) &&
+		!isRetryable(err)
+}
+
+// notify будит фоновый сброс, когда накопилось CacheFlushSize записей
+func (c *cache) notify(pending int) {
+	if c.cfg.CacheFlushSize <= 0 || pending < c.cfg.CacheFlushSize {
+		return
+	}
+
+	select {
+	case c.full <- struct{}{}:
+	default:
+	}
+}
+
+// listen сбрасывает кэш по таймеру и по заполнению,
+// CacheFlushInterval 0 оставляет только сброс по заполнению
+func (c *cache) listen() {
+	defer close(c.stopped)
+
+	var tick <-chan time.Time
+	if c.cfg.CacheFlushInterval > 0 {
+		t := time.NewTicker(c.cfg.CacheFlushInterval)
+		defer t.Stop()
+		tick = t.C
+	}
+
+	for {
+		select {
+		case <-c.done:
+			return
+		case <-tick:
+		case <-c.full:
+		}
+
+		if err := c.flush(context.Background()); err != nil {
+			c.logger.Error().Err(err).Msg("Cache: flush failed")
+		}
+	}
+}
+
+// coalesce склеивает две записи одной метрики: gauge и cumulative counter
+// заменяют прежнее значение, дельта прибавляется к нему
+func coalesce(prev, next metrics.Metric) metrics.Metric {
+	if next.Type() == metrics.GaugeType || next.IsCumulative() {
+		return metrics.Copy(next)
+	}
+
+	prev.SetInt64(prev.Int64Value() + next.Int64Value())
+	return prev
+}
+
+// sortMetrics повторяет порядок listQuery
+func sortMetrics(ms []metrics.Metric) {
+	sort.Slice(ms, func(i, j int) bool {
+		if ms[i].Type() != ms[j].Type() {
+			return ms[i].Type() > ms[j].Type()
+		}
+		return ms[i].Name() < ms[j].Name()
+	})
+}
+
+func newCache(backend writeBehind, cfg *config.ServerConfig, logger *config.Logger) *cache {
+	keys, err := newKeyRing(cfg)
+	if err != nil {
+		panic(err)
+	}
+
+	subLogger := logger.With().Str("Component", "WRITE-BEHIND-CACHE").Logger()
+	c := &cache{
+		backend: backend,
+		values:  make(map[metricKey]metrics.Metric),
+		pending: make(map[metricKey]metrics.Metric),
+		keys:    keys,
+		full:    make(chan struct{}, 1),
+		done:    make(chan struct{}),
+		stopped: make(chan struct{}),
+		cfg:     cfg,
+		logger:  config.NewLogger(&subLogger),
+	}
+
+	go c.listen()
+	return c
+}
@@ -0,0 +1,315 @@
+package storage
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/fedoroko/practicum_go/internal/config"
+	"github.com/fedoroko/practicum_go/internal/metrics"
+)
+
+// cacheBackend - хранилище в памяти, считающее сбросы и умеющее их ронять.
+// Метрики с именами из rejected оно не принимает, как база строку
+// с нарушенным ограничением.
+type cacheBackend struct {
+	*repo
+	mtx      sync.Mutex
+	fail     error
+	rejected map[string]bool
+	flushes  [][]metrics.Metric
+}
+
+var errRowRejected = errors.New("value violates check constraint")
+
+// flush пишет метрики в память без проверки подписи, как postgres.flush
+func (b *cacheBackend) flush(_ context.Context, ms []metrics.Metric) error {
+	b.mtx.Lock()
+	defer b.mtx.Unlock()
+	if b.fail != nil {
+		return b.fail
+	}
+	for _, m := range ms {
+		if b.rejected[m.Name()] {
+			return errRowRejected
+		}
+	}
+
+	b.flushes = append(b.flushes, ms)
+	for _, m := range ms {
+		if err := b.repo.store(m); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func (b *cacheBackend) flushRows(_ context.Context, ms []metrics.Metric) ([]error, error) {
+	b.mtx.Lock()
+	defer b.mtx.Unlock()
+	if b.fail != nil {
+		return nil, b.fail
+	}
+
+	errs := make([]error, len(ms))
+	for i, m := range ms {
+		if b.rejected[m.Name()] {
+			errs[i] = errRowRejected
+			continue
+		}
+		errs[i] = b.repo.store(m)
+	}
+	b.flushes = append(b.flushes, ms)
+
+	return errs, nil
+}
+
+func (b *cacheBackend) setFail(err error) {
+	b.mtx.Lock()
+	defer b.mtx.Unlock()
+	b.fail = err
+}
+
+func (b *cacheBackend) flushCount() int {
+	b.mtx.Lock()
+	defer b.mtx.Unlock()
+	return len(b.flushes)
+}
+
+func (b *cacheBackend) Close() error {
+	return nil
+}
+
+func (b *cacheBackend) value(t *testing.T, mtype, name string) string {
+	m, err := b.repo.Get(context.Background(), metrics.NewOmitEmpty(name, mtype, nil, nil))
+	if errors.Is(err, ErrNotFound) {
+		return ""
+	}
+	require.NoError(t, err)
+	return m.ToString()
+}
+
+func testCache(t *testing.T, interval time.Duration, size int) (*cache, *cacheBackend) {
+	c, b := newTestCache(interval, size)
+	t.Cleanup(func() {
+		c.Close()
+	})
+	return c, b
+}
+
+func newTestCache(interval time.Duration, size int) (*cache, *cacheBackend) {
+	cfg := config.NewServerConfig()
+	cfg.StoreInterval = time.Hour
+	cfg.CacheFlushInterval = interval
+	cfg.CacheFlushSize = size
+
+	b := &cacheBackend{repo: &repo{
+		G:   make(map[string]gauge),
+		C:   make(map[string]counter),
+		cfg: cfg,
+	}}
+	return newCache(b, cfg, config.TestLogger()), b
+}
+
+func counterDelta(name string, d int64) metrics.Metric {
+	return metrics.NewOmitEmpty(name, metrics.CounterType, nil, &d)
+}
+
+func counterTotal(name string, d int64) metrics.Metric {
+	m := counterDelta(name, d)
+	m.SetCumulative(true)
+	return m
+}
+
+func gaugeValue(name string, v float64) metrics.Metric {
+	return metrics.NewOmitEmpty(name, metrics.GaugeType, &v, nil)
+}
+
+func cachedValue(t *testing.T, c *cache, mtype, name string) string {
+	m, err := c.Get(context.Background(), metrics.NewOmitEmpty(name, mtype, nil, nil))
+	require.NoError(t, err)
+	return m.ToString()
+}
+
+// Записи видны чтениям сразу, а в базу попадают одной склеенной записью
+func Test_cache_coalesce(t *testing.T) {
+	ctx := context.Background()
+	c, b := testCache(t, 0, 0)
+
+	tests := []struct {
+		name        string
+		writes      []metrics.Metric
+		wantCounter string
+		wantGauge   string
+	}{
+		{
+			name:        "deltas and last gauge",
+			writes:      []metrics.Metric{counterDelta("PollCount", 1), counterDelta("PollCount", 2), gaugeValue("Alloc", 1), gaugeValue("Alloc", 2.5)},
+			wantCounter: "3",
+			wantGauge:   "2.5",
+		},
+		{
+			name:        "cumulative resets the sum",
+			writes:      []metrics.Metric{counterDelta("PollCount", 5), counterTotal("PollCount", 10), counterDelta("PollCount", 3)},
+			wantCounter: "13",
+			wantGauge:   "2.5",
+		},
+		{
+			name:        "delta on flushed value",
+			writes:      []metrics.Metric{counterDelta("PollCount", 1)},
+			wantCounter: "14",
+			wantGauge:   "2.5",
+		},
+	}
+	for i, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			for _, m := range tt.writes {
+				require.NoError(t, c.Set(ctx, m))
+			}
+			assert.Equal(t, tt.wantCounter, cachedValue(t, c, metrics.CounterType, "PollCount"))
+			assert.Equal(t, tt.wantGauge, cachedValue(t, c, metrics.GaugeType, "Alloc"))
+			assert.Equal(t, i, b.flushCount(), "nothing is written before flush")
+
+			require.NoError(t, c.flush(ctx))
+			assert.Equal(t, tt.wantCounter, b.value(t, metrics.CounterType, "PollCount"))
+			assert.Equal(t, tt.wantGauge, b.value(t, metrics.GaugeType, "Alloc"))
+			assert.LessOrEqual(t, len(b.flushes[i]), 2, "one row per metric")
+		})
+	}
+}
+
+// Дельта к значению, которого нет в кэше, досчитывается от значения в базе
+func Test_cache_readThrough(t *testing.T) {
+	ctx := context.Background()
+	c, b := testCache(t, 0, 0)
+	require.NoError(t, b.repo.Set(ctx, counterTotal("PollCount", 5)))
+
+	require.NoError(t, c.Set(ctx, counterDelta("PollCount", 2)))
+	assert.Equal(t, "7", cachedValue(t, c, metrics.CounterType, "PollCount"))
+
+	list, err := c.List(ctx)
+	require.NoError(t, err)
+	require.Len(t, list, 1)
+	assert.Equal(t, "7", list[0].ToString())
+
+	_, err = c.Get(ctx, metrics.NewOmitEmpty("Missing", metrics.GaugeType, nil, nil))
+	assert.ErrorIs(t, err, ErrNotFound)
+
+	require.NoError(t, c.flush(ctx))
+	assert.Equal(t, "7", b.value(t, metrics.CounterType, "PollCount"))
+}
+
+// Неудачный сброс не теряет записи, они уходят со следующим
+func Test_cache_flushFailure(t *testing.T) {
+	ctx := context.Background()
+	c, b := testCache(t, 0, 0)
+
+	require.NoError(t, c.Set(ctx, counterDelta("PollCount", 1)))
+	b.setFail(ErrUnavailable)
+	assert.ErrorIs(t, c.flush(ctx), ErrUnavailable)
+
+	require.NoError(t, c.Set(ctx, counterDelta("PollCount", 2)))
+	b.setFail(nil)
+	require.NoError(t, c.flush(ctx))
+	assert.Equal(t, "3", b.value(t, metrics.CounterType, "PollCount"))
+	assert.Equal(t, "3", cachedValue(t, c, metrics.CounterType, "PollCount"))
+}
+
+// строка, которую база не принимает, отбрасывается и не держит остальные
+func Test_cache_flushRejectedRow(t *testing.T) {
+	ctx := context.Background()
+	c, b := testCache(t, 0, 0)
+	b.rejected = map[string]bool{"Broken": true}
+
+	require.NoError(t, c.Set(ctx, counterDelta("PollCount", 1)))
+	require.NoError(t, c.Set(ctx, gaugeValue("Broken", 1)))
+	require.NoError(t, c.flush(ctx))
+	assert.Equal(t, "1", b.value(t, metrics.CounterType, "PollCount"))
+	assert.Equal(t, "", b.value(t, metrics.GaugeType, "Broken"))
+
+	require.NoError(t, c.Set(ctx, counterDelta("PollCount", 2)))
+	require.NoError(t, c.flush(ctx))
+	assert.Equal(t, "3", b.value(t, metrics.CounterType, "PollCount"))
+}
+
+// пока база недоступна, pending ограничен CacheMaxPending
+func Test_cache_maxPending(t *testing.T) {
+	ctx := context.Background()
+	c, b := testCache(t, 0, 0)
+	c.cfg.CacheMaxPending = 2
+	b.setFail(ErrUnavailable)
+
+	require.NoError(t, c.Set(ctx, counterDelta("A", 1)))
+	require.NoError(t, c.Set(ctx, counterDelta("B", 1)))
+	// уже ожидающая метрика склеивается и места не занимает
+	require.NoError(t, c.Set(ctx, counterDelta("A", 1)))
+	assert.ErrorIs(t, c.Set(ctx, counterDelta("C", 1)), ErrUnavailable)
+
+	_, err := c.SetBatch(ctx, []metrics.Metric{counterDelta("A", 1), counterDelta("D", 1)}, false)
+	assert.ErrorIs(t, err, ErrUnavailable)
+	assert.Error(t, c.flush(ctx))
+
+	b.setFail(nil)
+	require.NoError(t, c.flush(ctx))
+	require.NoError(t, c.Set(ctx, counterDelta("C", 1)))
+	assert.Equal(t, "2", b.value(t, metrics.CounterType, "A"))
+}
+
+func Test_cache_flushTriggers(t *testing.T) {
+	ctx := context.Background()
+	tests := []struct {
+		name     string
+		interval time.Duration
+		size     int
+	}{
+		{name: "by size", size: 2},
+		{name: "by interval", interval: time.Millisecond * 10},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c, b := testCache(t, tt.interval, tt.size)
+			_, err := c.SetBatch(ctx, []metrics.Metric{gaugeValue("Alloc", 1), counterDelta("PollCount", 1)}, false)
+			require.NoError(t, err)
+
+			assert.Eventually(t, func() bool {
+				return b.flushCount() > 0
+			}, time.Second, time.Millisecond*5)
+			assert.Equal(t, "1", b.value(t, metrics.CounterType, "PollCount"))
+		})
+	}
+}
+
+func Test_cache_Close(t *testing.T) {
+	ctx := context.Background()
+	c, b := newTestCache(time.Hour, 0)
+
+	require.NoError(t, c.Set(ctx, gaugeValue("Alloc", 1)))
+	assert.Equal(t, "", b.value(t, metrics.GaugeType, "Alloc"))
+
+	require.NoError(t, c.Close())
+	assert.Equal(t, "1", b.value(t, metrics.GaugeType, "Alloc"))
+}
+
+func Test_cache_SetBatch_atomic(t *testing.T) {
+	ctx := context.Background()
+	c, b := testCache(t, 0, 0)
+
+	errs, err := c.SetBatch(ctx, []metrics.Metric{
+		gaugeValue("Alloc", 1),
+		metrics.NewOmitEmpty("Bad", "int", nil, nil),
+	}, true)
+	require.NoError(t, err)
+	assert.ErrorIs(t, errs[0], ErrNotApplied)
+	assert.Error(t, errs[1])
+
+	require.NoError(t, c.flush(ctx))
+	assert.Equal(t, 0, b.flushCount())
+	_, err = c.Get(ctx, gaugeValue("Alloc", 0))
+	assert.ErrorIs(t, err, ErrNotFound)
+}
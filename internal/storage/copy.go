@@ -0,0 +1,103 @@
+package storage
+
+import (
+	"context"
+	"errors"
+
+	"github.com/jackc/pgx/v4"
+	"github.com/jackc/pgx/v4/stdlib"
+
+	"github.com/fedoroko/practicum_go/internal/metrics"
+)
+
+// errCopyUnsupported - соединение открыто не драйвером pgx, COPY недоступен
+var errCopyUnsupported = errors.New("COPY is not supported by the driver")
+
+var stageColumns = []string{"seq", "name", "type", "value", "delta", "cumulative"}
+
+const (
+	stageSchema string = `CREATE TEMP TABLE metrics_stage (
+							seq INTEGER NOT NULL,
+							name VARCHAR (255) NOT NULL,
+							type VARCHAR (20) NOT NULL,
+							value DOUBLE PRECISION,
+							delta BIGINT,
+							cumulative BOOLEAN NOT NULL
+						) ON COMMIT DROP;`
+
+	// stageAggregate сворачивает батч до строки на метрику в порядке seq:
+	// gauge - последнее значение, counter - сумма дельт после последнего
+	// cumulative значения, которое тогда заменяет сохраненное
+	stageAggregate string = `WITH last_set AS (
+								SELECT name, type, max(seq) AS seq
+								FROM metrics_stage
+								WHERE cumulative
+								GROUP BY name, type
+							), agg AS (
+								SELECT s.name, s.type,
+									(array_agg(s.value ORDER BY s.seq DESC))[1] AS value,
+									sum(s.delta) FILTER (WHERE ls.seq IS NULL OR s.seq >= ls.seq)::BIGINT AS delta,
+									bool_or(ls.seq IS NOT NULL) AS cumulative
+								FROM metrics_stage s
+								LEFT JOIN last_set ls USING (name, type)
+								GROUP BY s.name, s.type
+							)`
+
+	mergeAddQuery string = stageAggregate + `
+							INSERT INTO metrics (name, type, value, delta)
+							SELECT name, type, value, delta FROM agg WHERE NOT cumulative
+							ON CONFLICT (name, type) DO UPDATE
+							SET value = EXCLUDED.value, delta = metrics.delta + EXCLUDED.delta;`
+
+	mergeSetQuery string = stageAggregate + `
+							INSERT INTO metrics (name, type, value, delta)
+							SELECT name, type, value, delta FROM agg WHERE cumulative
+							ON CONFLICT (name, type) DO UPDATE
+							SET value = EXCLUDED.value, delta = EXCLUDED.delta;`
+)
+
+// copyBatch пишет метрики одной транзакцией: COPY во временную таблицу
+// и слияние с metrics двумя запросами вместо запроса на каждую метрику
+func (p *postgres) copyBatch(ctx context.Context, ms []metrics.Metric) error {
+	rows := make([][]interface{}, len(ms))
+	for i, m := range ms {
+		rows[i] = []interface{}{i, m.Name(), m.Type(), m.Float64Pointer(), m.Int64Pointer(), m.IsCumulative()}
+	}
+
+	conn, err := p.DB.Conn(ctx)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+
+	return conn.Raw(func(driverConn interface{}) error {
+		c, ok := driverConn.(*stdlib.Conn)
+		if !ok {
+			return errCopyUnsupported
+		}
+
+		tx, err := c.Conn().Begin(ctx)
+		if err != nil {
+			return err
+		}
+		defer tx.Rollback(ctx)
+
+		if _, err = tx.Exec(ctx, stageSchema); err != nil {
+			return err
+		}
+		if _, err = tx.CopyFrom(ctx, pgx.Identifier{"metrics_stage"}, stageColumns, pgx.CopyFromRows(rows)); err != nil {
+			return err
+		}
+		if _, err = tx.Exec(ctx, mergeAddQuery); err != nil {
+			return err
+		}
+		if _, err = tx.Exec(ctx, mergeSetQuery); err != nil {
+			return err
+		}
+
+		if err = tx.Commit(ctx); err != nil {
+			return &commitError{err: err}
+		}
+		return nil
+	})
+}
@@ -0,0 +1,170 @@
+package storage
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/fedoroko/practicum_go/internal/config"
+	"github.com/fedoroko/practicum_go/internal/metrics"
+)
+
+// testDatabase подключается к TEST_DATABASE_DSN, без нее тест пропускается
+func testDatabase(t *testing.T) *postgres {
+	dsn := os.Getenv("TEST_DATABASE_DSN")
+	if dsn == "" {
+		t.Skip("TEST_DATABASE_DSN is not set")
+	}
+
+	cfg := config.NewServerConfig()
+	cfg.Database = dsn
+	p := postgresInterface(cfg, config.TestLogger())
+	t.Cleanup(func() { p.Close() })
+
+	return p
+}
+
+func Test_postgres_copyBatch(t *testing.T) {
+	p := testDatabase(t)
+	ctx := context.Background()
+	// уникальный префикс, чтобы не пересекаться с данными прошлых запусков
+	prefix := fmt.Sprintf("CopyTest%d_", time.Now().UnixNano())
+	t.Cleanup(func() {
+		p.ExecContext(ctx, "DELETE FROM metrics WHERE name LIKE $1;", prefix+"%")
+	})
+
+	delta := func(name string, d int64) metrics.Metric {
+		return metrics.NewOmitEmpty(prefix+name, metrics.CounterType, nil, metrics.PointerFromInt64(d))
+	}
+	total := func(name string, d int64) metrics.Metric {
+		m := delta(name, d)
+		m.SetCumulative(true)
+		return m
+	}
+	gauge := func(name string, v float64) metrics.Metric {
+		return metrics.NewOmitEmpty(prefix+name, metrics.GaugeType, metrics.PointerFromFloat64(v), nil)
+	}
+
+	tests := []struct {
+		name  string
+		start []metrics.Metric
+		batch []metrics.Metric
+		want  metrics.Metric
+	}{
+		{
+			name:  "deltas are summed",
+			batch: []metrics.Metric{delta("Deltas", 3), delta("Deltas", 4)},
+			want:  delta("Deltas", 7),
+		},
+		{
+			name:  "deltas are added to stored value",
+			start: []metrics.Metric{delta("Stored", 10)},
+			batch: []metrics.Metric{delta("Stored", 3), delta("Stored", 4)},
+			want:  delta("Stored", 17),
+		},
+		{
+			name:  "cumulative then delta",
+			start: []metrics.Metric{delta("TotalThenDelta", 10)},
+			batch: []metrics.Metric{total("TotalThenDelta", 100), delta("TotalThenDelta", 5)},
+			want:  delta("TotalThenDelta", 105),
+		},
+		{
+			name:  "delta then cumulative",
+			start: []metrics.Metric{delta("DeltaThenTotal", 10)},
+			batch: []metrics.Metric{delta("DeltaThenTotal", 5), total("DeltaThenTotal", 100)},
+			want:  delta("DeltaThenTotal", 100),
+		},
+		{
+			name:  "last gauge wins",
+			start: []metrics.Metric{gauge("Gauge", 0.5)},
+			batch: []metrics.Metric{gauge("Gauge", 1), gauge("Gauge", 3), gauge("Gauge", 2)},
+			want:  gauge("Gauge", 2),
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if tt.start != nil {
+				require.NoError(t, p.copyBatch(ctx, tt.start))
+			}
+			require.NoError(t, p.copyBatch(ctx, tt.batch))
+
+			got, err := p.Get(ctx, metrics.NewOmitEmpty(tt.want.Name(), tt.want.Type(), nil, nil))
+			require.NoError(t, err)
+			assert.Equal(t, tt.want.Float64Pointer(), got.Float64Pointer())
+			assert.Equal(t, tt.want.Int64Pointer(), got.Int64Pointer())
+		})
+	}
+}
+
+func Test_postgresGuard_claimAll(t *testing.T) {
+	p := testDatabase(t)
+	ctx := context.Background()
+	prefix := fmt.Sprintf("%d-", time.Now().UnixNano())
+	t.Cleanup(func() {
+		p.ExecContext(ctx, "DELETE FROM metric_nonces WHERE nonce LIKE $1;", prefix+"%")
+	})
+
+	g := newPostgresGuard(p.DB, p.isReady, time.Minute)
+	exp := time.Now().Add(time.Minute)
+
+	ok, err := g.claim(ctx, prefix+"a", exp)
+	require.NoError(t, err)
+	require.True(t, ok)
+
+	got, err := g.claimAll(ctx, []string{prefix + "a", prefix + "b", prefix + "c"}, []time.Time{exp, exp, exp})
+	require.NoError(t, err)
+	assert.Equal(t, []bool{false, true, true}, got)
+
+	got, err = g.claimAll(ctx, []string{prefix + "c", prefix + "d"}, []time.Time{exp, exp})
+	require.NoError(t, err)
+	assert.Equal(t, []bool{false, true}, got)
+}
+
+// BenchmarkPostgres_SetBatch сравнивает COPY со вставкой по строке.
+// Нужна отдельная база: TEST_DATABASE_DSN=postgres://... go test -bench SetBatch ./internal/storage
+func BenchmarkPostgres_SetBatch(b *testing.B) {
+	dsn := os.Getenv("TEST_DATABASE_DSN")
+	if dsn == "" {
+		b.Skip("TEST_DATABASE_DSN is not set")
+	}
+
+	cfg := config.NewServerConfig()
+	cfg.Database = dsn
+	p := postgresInterface(cfg, config.TestLogger())
+	defer p.Close()
+	ctx := context.Background()
+
+	batch := func(size int) []metrics.Metric {
+		ms := make([]metrics.Metric, 0, size)
+		for i := 0; i < size/2; i++ {
+			ms = append(ms,
+				metrics.NewOmitEmpty(fmt.Sprintf("BenchGauge%d", i), metrics.GaugeType, metrics.PointerFromFloat64(float64(i)), nil),
+				metrics.NewOmitEmpty(fmt.Sprintf("BenchCounter%d", i), metrics.CounterType, nil, metrics.PointerFromInt64(1)),
+			)
+		}
+		return ms
+	}
+
+	for _, size := range []int{10, 100, 1000} {
+		ms := batch(size)
+		b.Run(fmt.Sprintf("copy/%d", size), func(b *testing.B) {
+			for i := 0; i < b.N; i++ {
+				if err := p.copyBatch(ctx, ms); err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+		b.Run(fmt.Sprintf("rows/%d", size), func(b *testing.B) {
+			for i := 0; i < b.N; i++ {
+				if _, err := p.setRows(ctx, ms, make([]error, len(ms)), true); err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+	}
+}
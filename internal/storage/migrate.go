@@ -0,0 +1,140 @@
+package storage
+
+import (
+	"context"
+	"database/sql"
+	"embed"
+	"fmt"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// Миграции лежат в migrations/NNNN_name.sql и применяются по возрастанию
+// версии, каждая в своей транзакции. Примененные версии записываются
+// в schema_migrations; уже выпущенные файлы не меняются, только добавляются новые.
+//
+//go:embed migrations/*.sql
+var migrationsFS embed.FS
+
+const (
+	migrationsSchema string = `CREATE TABLE IF NOT EXISTS schema_migrations (
+								version INTEGER PRIMARY KEY,
+								name VARCHAR (255) NOT NULL,
+								applied_at TIMESTAMP NOT NULL DEFAULT now()
+							);`
+
+	// несколько серверов, стартующих одновременно, мигрируют по очереди
+	lockMigrationsQuery string = `LOCK TABLE schema_migrations IN EXCLUSIVE MODE;`
+
+	migrationAppliedQuery string = `SELECT EXISTS (
+									SELECT 1 FROM schema_migrations WHERE version = $1
+								);`
+
+	insertMigrationQuery string = `INSERT INTO schema_migrations (version, name)
+								   VALUES ($1, $2);`
+)
+
+type migration struct {
+	version int
+	name    string
+	query   string
+}
+
+func loadMigrations() ([]migration, error) {
+	files, err := migrationsFS.ReadDir("migrations")
+	if err != nil {
+		return nil, err
+	}
+
+	ret := make([]migration, 0, len(files))
+	seen := make(map[int]string)
+	for _, f := range files {
+		name := strings.TrimSuffix(f.Name(), ".sql")
+		parts := strings.SplitN(name, "_", 2)
+		if len(parts) != 2 {
+			return nil, fmt.Errorf("migration %s: want NNNN_name.sql", f.Name())
+		}
+
+		version, err := strconv.Atoi(parts[0])
+		if err != nil {
+			return nil, fmt.Errorf("migration %s: %w", f.Name(), err)
+		}
+		if prev, ok := seen[version]; ok {
+			return nil, fmt.Errorf("migration %s: version %d is taken by %s", f.Name(), version, prev)
+		}
+		seen[version] = f.Name()
+
+		data, err := migrationsFS.ReadFile(path.Join("migrations", f.Name()))
+		if err != nil {
+			return nil, err
+		}
+
+		ret = append(ret, migration{
+			version: version,
+			name:    parts[1],
+			query:   string(data),
+		})
+	}
+
+	sort.Slice(ret, func(i, j int) bool {
+		return ret[i].version < ret[j].version
+	})
+
+	return ret, nil
+}
+
+// migrate применяет недостающие миграции и возвращает их версии
+func migrate(ctx context.Context, db *sql.DB) ([]int, error) {
+	ms, err := loadMigrations()
+	if err != nil {
+		return nil, err
+	}
+
+	if _, err = db.ExecContext(ctx, migrationsSchema); err != nil {
+		return nil, err
+	}
+
+	var applied []int
+	for _, m := range ms {
+		ok, err := applyMigration(ctx, db, m)
+		if err != nil {
+			return applied, fmt.Errorf("migration %04d_%s: %w", m.version, m.name, err)
+		}
+		if ok {
+			applied = append(applied, m.version)
+		}
+	}
+
+	return applied, nil
+}
+
+func applyMigration(ctx context.Context, db *sql.DB, m migration) (bool, error) {
+	tx, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		return false, err
+	}
+	defer tx.Rollback()
+
+	if _, err = tx.ExecContext(ctx, lockMigrationsQuery); err != nil {
+		return false, err
+	}
+
+	var done bool
+	if err = tx.QueryRowContext(ctx, migrationAppliedQuery, m.version).Scan(&done); err != nil {
+		return false, err
+	}
+	if done {
+		return false, nil
+	}
+
+	if _, err = tx.ExecContext(ctx, m.query); err != nil {
+		return false, err
+	}
+	if _, err = tx.ExecContext(ctx, insertMigrationQuery, m.version, m.name); err != nil {
+		return false, err
+	}
+
+	return true, tx.Commit()
+}
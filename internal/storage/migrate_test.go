@@ -0,0 +1,23 @@
+package storage
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func Test_loadMigrations(t *testing.T) {
+	ms, err := loadMigrations()
+	require.NoError(t, err)
+	require.NotEmpty(t, ms)
+
+	// версии идут подряд с первой, пропуск означает потерянный файл
+	for i, m := range ms {
+		assert.Equal(t, i+1, m.version, m.name)
+		assert.NotEmpty(t, m.name)
+		assert.NotEmpty(t, m.query)
+	}
+	assert.Equal(t, "create_metrics", ms[0].name)
+	assert.Contains(t, ms[1].query, "ADD PRIMARY KEY (name, type)")
+}
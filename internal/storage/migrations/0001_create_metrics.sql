@@ -0,0 +1,9 @@
+-- исходная схема; IF NOT EXISTS подхватывает базы, созданные до миграций
+CREATE TABLE IF NOT EXISTS metrics (
+    id serial PRIMARY KEY,
+    name VARCHAR (50) UNIQUE NOT NULL,
+    type VARCHAR (20) NOT NULL,
+    value DOUBLE PRECISION,
+    delta BIGINT,
+    updated_at TIMESTAMP
+);
@@ -0,0 +1,15 @@
+-- имя хранилось вместе с типом ("Alloc::gauge"), чтобы уместить
+-- уникальность в одну колонку; теперь ключ - пара (name, type)
+ALTER TABLE metrics ALTER COLUMN name TYPE VARCHAR (255);
+
+UPDATE metrics
+SET name = split_part(name, '::', 1)
+WHERE name LIKE '%::%';
+
+ALTER TABLE metrics DROP CONSTRAINT IF EXISTS metrics_name_key;
+ALTER TABLE metrics DROP CONSTRAINT IF EXISTS metrics_pkey;
+ALTER TABLE metrics DROP COLUMN IF EXISTS id;
+ALTER TABLE metrics ADD PRIMARY KEY (name, type);
+
+-- порядок списка метрик на главной странице
+CREATE INDEX metrics_type_name_idx ON metrics (type DESC, name ASC);
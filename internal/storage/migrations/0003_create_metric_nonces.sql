@@ -0,0 +1,6 @@
+CREATE TABLE IF NOT EXISTS metric_nonces (
+    nonce VARCHAR (64) PRIMARY KEY,
+    expires_at TIMESTAMP NOT NULL
+);
+
+CREATE INDEX metric_nonces_expires_at_idx ON metric_nonces (expires_at);
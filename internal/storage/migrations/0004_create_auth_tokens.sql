@@ -0,0 +1,6 @@
+CREATE TABLE IF NOT EXISTS auth_tokens (
+    hash CHAR (64) PRIMARY KEY,
+    name VARCHAR (100) NOT NULL,
+    scopes VARCHAR (100) NOT NULL,
+    prefix VARCHAR (100) NOT NULL DEFAULT ''
+);
@@ -1,9 +1,10 @@
 package storage
 
 import (
+	"context"
 	"database/sql"
 	"errors"
-	"strings"
+	"sync/atomic"
 	"time"
 
 	_ "github.com/jackc/pgx/v4/stdlib"
@@ -12,14 +13,16 @@ import (
 	"github.com/fedoroko/practicum_go/internal/metrics"
 )
 
+// postgres.ready выставляется после подключения и миграций,
+// до этого сервер работает без базы и отвечает ErrUnavailable
 type postgres struct {
 	*sql.DB
-	upsertStmt *sql.Stmt
-	getStmt    *sql.Stmt
-	listStmt   *sql.Stmt
-	buffer     []metrics.Metric
-	cfg        *config.ServerConfig
-	logger     *config.Logger
+	ready  int32
+	done   chan struct{}
+	cfg    *config.ServerConfig
+	keys   *metrics.KeyRing
+	replay replayGuard
+	logger *config.Logger
 }
 
 type tempMetric struct {
@@ -30,15 +33,6 @@ type tempMetric struct {
 }
 
 const (
-	schema string = `CREATE TABLE metrics (
-							id serial PRIMARY KEY,
-							name VARCHAR (50) UNIQUE NOT NULL,
-							type VARCHAR (20) NOT NULL,
-							value DOUBLE PRECISION,
-							delta BIGINT,
-							updated_at TIMESTAMP
-						);`
-
 	getQuery string = `SELECT name, type, value, delta
 					   FROM metrics
 					   WHERE name = $1
@@ -50,197 +44,427 @@ const (
 
 	upsertQuery string = `INSERT INTO metrics (name, type, value, delta)
 						  VALUES($1, $2, $3, $4)
-						  ON CONFLICT(name)	DO UPDATE
+						  ON CONFLICT(name, type) DO UPDATE
  						  SET value = $3, delta = metrics.delta + $4`
+
+	setQuery string = `INSERT INTO metrics (name, type, value, delta)
+					   VALUES($1, $2, $3, $4)
+					   ON CONFLICT(name, type) DO UPDATE
+					   SET value = $3, delta = $4`
 )
 
 func (t *tempMetric) toMetric() metrics.Metric {
-	name := t.ID
-	s := strings.Split(t.ID, "::")
-	if len(s) > 1 {
-		name = s[0]
-	}
 	return metrics.NewOmitEmpty(
-		name, t.Type, t.Value, t.Delta,
+		t.ID, t.Type, t.Value, t.Delta,
 	)
 }
 
-func (p *postgres) Get(m metrics.Metric) (metrics.Metric, error) {
+// withTimeout ограничивает запрос к базе QueryTimeout
+func (p *postgres) withTimeout(ctx context.Context) (context.Context, context.CancelFunc) {
+	if p.cfg.QueryTimeout == 0 {
+		return context.WithCancel(ctx)
+	}
+	return context.WithTimeout(ctx, p.cfg.QueryTimeout)
+}
+
+func (p *postgres) isReady() bool {
+	return atomic.LoadInt32(&p.ready) == 1
+}
+
+func (p *postgres) Get(ctx context.Context, m metrics.Metric) (metrics.Metric, error) {
+	if !p.isReady() {
+		return m, ErrUnavailable
+	}
+
+	ctx, cancel := p.withTimeout(ctx)
+	defer cancel()
+
 	t := tempMetric{}
 
-	err := p.getStmt.QueryRow(m.DBName(), m.Type()).
-		Scan(&t.ID, &t.Type, &t.Value, &t.Delta)
+	err := p.retry(ctx, isRetryable, func() error {
+		return p.QueryRowContext(ctx, getQuery, m.Name(), m.Type()).
+			Scan(&t.ID, &t.Type, &t.Value, &t.Delta)
+	})
 
+	if errors.Is(err, sql.ErrNoRows) {
+		return m, ErrNotFound
+	}
 	if err != nil {
 		return m, err
 	}
 
 	ret := t.toMetric()
 
-	if err = ret.SetHash(p.cfg.Key); err != nil {
+	if err = p.keys.Sign(ret); err != nil {
 		return ret, err
 	}
 
 	return ret, nil
 }
 
-func (p *postgres) Set(m metrics.Metric) error {
-	if ok, _ := m.CheckHash(p.cfg.Key); !ok {
-		return metrics.ThrowInvalidHashError()
+func (p *postgres) Set(ctx context.Context, m metrics.Metric) error {
+	if !p.isReady() {
+		return ErrUnavailable
 	}
 
-	_, err := p.upsertStmt.Exec(
-		m.DBName(),
-		m.Type(),
-		m.Float64Pointer(),
-		m.Int64Pointer(),
-	)
-	if err != nil {
+	ctx, cancel := p.withTimeout(ctx)
+	defer cancel()
+
+	if err := p.check(ctx, m); err != nil {
 		return err
 	}
 
-	return nil
+	query := upsertQuery
+	if m.IsCumulative() {
+		query = setQuery
+	}
+
+	return p.retry(ctx, isRetryableWrite, func() error {
+		_, err := p.ExecContext(
+			ctx,
+			query,
+			m.Name(),
+			m.Type(),
+			m.Float64Pointer(),
+			m.Int64Pointer(),
+		)
+		return err
+	})
 }
 
-func (p *postgres) SetBatch(ms []metrics.Metric) error {
+// SetBatch пишет корректные метрики через COPY. Если это не удалось,
+// без atomic батч повторяется построчно, чтобы у каждой метрики был свой статус.
+func (p *postgres) SetBatch(ctx context.Context, ms []metrics.Metric, atomic bool) ([]error, error) {
 	if p.DB == nil {
-		return errors.New("no db")
+		return nil, errors.New("no db")
+	}
+	if !p.isReady() {
+		return nil, ErrUnavailable
 	}
 
-	for _, m := range ms {
-		if err := m.CheckType(); err != nil {
-			return err
+	ctx, cancel := p.withTimeout(ctx)
+	defer cancel()
+
+	errs, failed, err := p.checkBatch(ctx, ms)
+	if err != nil {
+		return nil, err
+	}
+	if atomic && failed {
+		notApplied(errs)
+		return errs, nil
+	}
+
+	valid := make([]metrics.Metric, 0, len(ms))
+	for i, m := range ms {
+		if errs[i] == nil {
+			valid = append(valid, m)
 		}
+	}
+	if len(valid) == 0 {
+		return errs, nil
+	}
 
-		if ok, _ := m.CheckHash(p.cfg.Key); !ok {
-			return metrics.ThrowInvalidHashError()
+	err = p.retry(ctx, isRetryableTx, func() error {
+		return p.copyBatch(ctx, valid)
+	})
+	switch {
+	case err == nil:
+		return errs, nil
+	case errors.Is(err, errCopyUnsupported):
+	case ctx.Err() != nil:
+		return nil, err
+	case atomic:
+		for i := range errs {
+			if errs[i] == nil {
+				errs[i] = err
+			}
 		}
+		return errs, nil
+	default:
+		p.logger.Warn().Err(err).Msg("COPY batch failed, retrying row by row")
+	}
+
+	var ret []error
+	err = p.retry(ctx, isRetryableTx, func() error {
+		var err error
+		ret, err = p.setRows(ctx, ms, errs, atomic)
+		return err
+	})
 
-		if err := p.addMetric(m); err != nil {
+	return ret, err
+}
+
+func (p *postgres) check(ctx context.Context, m metrics.Metric) error {
+	if err := checkName(m); err != nil {
+		return err
+	}
+	if err := p.keys.Check(m); err != nil {
+		return err
+	}
+
+	return checkReplay(ctx, p.replay, replayWindow(p.keys, p.cfg.ReplayWindow), m)
+}
+
+func (p *postgres) checkBatch(ctx context.Context, ms []metrics.Metric) ([]error, bool, error) {
+	return checkBatch(ctx, ms, p.keys, p.replay, p.cfg.ReplayWindow)
+}
+
+// flush пишет уже проверенные метрики одной транзакцией, без повторной
+// проверки подписи и nonce
+func (p *postgres) flush(ctx context.Context, ms []metrics.Metric) error {
+	if !p.isReady() {
+		return ErrUnavailable
+	}
+
+	ctx, cancel := p.withTimeout(ctx)
+	defer cancel()
+
+	err := p.retry(ctx, isRetryableTx, func() error {
+		return p.copyBatch(ctx, ms)
+	})
+	if !errors.Is(err, errCopyUnsupported) {
+		return err
+	}
+
+	return p.retry(ctx, isRetryableTx, func() error {
+		errs, err := p.setRows(ctx, ms, make([]error, len(ms)), true)
+		if err != nil {
 			return err
 		}
+		for _, err = range errs {
+			if err != nil && !errors.Is(err, ErrNotApplied) {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+// flushRows пишет уже проверенные метрики по одной и возвращает ошибку
+// каждой, чтобы кэш мог отбросить строки, которые база не принимает
+func (p *postgres) flushRows(ctx context.Context, ms []metrics.Metric) ([]error, error) {
+	if !p.isReady() {
+		return nil, ErrUnavailable
 	}
 
-	return p.flush()
+	ctx, cancel := p.withTimeout(ctx)
+	defer cancel()
+
+	var ret []error
+	err := p.retry(ctx, isRetryableTx, func() error {
+		var err error
+		ret, err = p.setRows(ctx, ms, make([]error, len(ms)), false)
+		return err
+	})
+
+	return ret, err
 }
 
-func (p *postgres) List() ([]metrics.Metric, error) {
-	var ret []metrics.Metric
+// setRows пишет метрики без ошибок в errs по одной. Без atomic каждая
+// метрика пишется под своим savepoint, и ошибка одной не откатывает остальные.
+// Временная ошибка прерывает всю транзакцию, чтобы ее можно было повторить.
+func (p *postgres) setRows(ctx context.Context, ms []metrics.Metric, errs []error, atomic bool) ([]error, error) {
+	errs = append([]error(nil), errs...)
 
-	rows, err := p.listStmt.Query()
+	tx, err := p.BeginTx(ctx, nil)
 	if err != nil {
-		return ret, err
+		return nil, err
 	}
+	defer tx.Rollback()
 
-	for rows.Next() {
-		t := tempMetric{}
-		if err = rows.Scan(&t.ID, &t.Type, &t.Value, &t.Delta); err != nil {
-			return ret, err
+	upsert, err := tx.PrepareContext(ctx, upsertQuery)
+	if err != nil {
+		return nil, err
+	}
+
+	set, err := tx.PrepareContext(ctx, setQuery)
+	if err != nil {
+		return nil, err
+	}
+
+	for i, m := range ms {
+		if errs[i] != nil {
+			continue
+		}
+
+		if !atomic {
+			if _, err = tx.ExecContext(ctx, "SAVEPOINT item"); err != nil {
+				return nil, err
+			}
 		}
 
-		ret = append(ret, t.toMetric())
+		stmt := upsert
+		if m.IsCumulative() {
+			stmt = set
+		}
+		if _, err = stmt.ExecContext(ctx, m.Name(), m.Type(), m.Float64Pointer(), m.Int64Pointer()); err != nil {
+			if isRetryableTx(err) {
+				return nil, err
+			}
+			errs[i] = err
+			if atomic {
+				notApplied(errs)
+				return errs, nil
+			}
+			if _, err = tx.ExecContext(ctx, "ROLLBACK TO SAVEPOINT item"); err != nil {
+				return nil, err
+			}
+		}
 	}
 
-	if err = rows.Err(); err != nil {
-		return ret, err
+	if err = tx.Commit(); err != nil {
+		return nil, &commitError{err: err}
 	}
 
-	return ret, nil
+	return errs, nil
 }
 
-func (p *postgres) Ping() error {
-	return p.DB.Ping()
-}
+func (p *postgres) List(ctx context.Context) ([]metrics.Metric, error) {
+	if !p.isReady() {
+		return nil, ErrUnavailable
+	}
 
-func (p *postgres) Close() error {
-	p.logger.Info().Msg("DB: closed")
-	return p.DB.Close()
+	ctx, cancel := p.withTimeout(ctx)
+	defer cancel()
+
+	var ret []metrics.Metric
+	err := p.retry(ctx, isRetryable, func() error {
+		ret = ret[:0]
+		return p.list(ctx, &ret)
+	})
+
+	return ret, err
 }
 
-func (p *postgres) addMetric(m metrics.Metric) error {
-	p.buffer = append(p.buffer, m)
-	if cap(p.buffer) == len(p.buffer) {
-		if err := p.flush(); err != nil {
+func (p *postgres) list(ctx context.Context, ret *[]metrics.Metric) error {
+	rows, err := p.QueryContext(ctx, listQuery)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		t := tempMetric{}
+		if err = rows.Scan(&t.ID, &t.Type, &t.Value, &t.Delta); err != nil {
 			return err
 		}
+
+		*ret = append(*ret, t.toMetric())
 	}
 
-	return nil
+	return rows.Err()
 }
 
-func (p *postgres) flush() error {
-	if p.DB == nil {
-		return errors.New("no db")
+// Ping показывает текущее состояние базы без повторов
+func (p *postgres) Ping(ctx context.Context) error {
+	if !p.isReady() {
+		return ErrUnavailable
 	}
 
-	tx, err := p.Begin()
-	if err != nil {
+	ctx, cancel := p.withTimeout(ctx)
+	defer cancel()
+
+	return p.DB.PingContext(ctx)
+}
+
+func (p *postgres) Close() error {
+	close(p.done)
+	p.logger.Info().Msg("DB: closed")
+	return p.DB.Close()
+}
+
+// connect проверяет соединение и применяет миграции
+func (p *postgres) connect(ctx context.Context) error {
+	ctx, cancel := p.withTimeout(ctx)
+	defer cancel()
+
+	if err := p.DB.PingContext(ctx); err != nil {
 		return err
 	}
 
-	stmt, err := tx.Prepare(upsertQuery)
+	applied, err := migrate(ctx, p.DB)
 	if err != nil {
 		return err
 	}
+	for _, v := range applied {
+		p.logger.Info().Int("version", v).Msg("DB: migration applied")
+	}
 
-	for _, m := range p.buffer {
-		if _, err = stmt.Exec(m.DBName(), m.Type(), m.Float64Pointer(), m.Int64Pointer()); err != nil {
-			if err = tx.Rollback(); err != nil {
-				return err
-			}
-			return err
+	atomic.StoreInt32(&p.ready, 1)
+	return nil
+}
+
+// reconnect подключается к базе раз в DBReconnectInterval до первого успеха
+func (p *postgres) reconnect() {
+	t := time.NewTicker(p.cfg.DBReconnectInterval)
+	defer t.Stop()
+
+	for {
+		select {
+		case <-p.done:
+			return
+		case <-t.C:
 		}
+
+		if err := p.connect(context.Background()); err != nil {
+			p.logger.Warn().Err(err).Msg("DB: still unavailable")
+			continue
+		}
+
+		p.logger.Info().Msg("DB: connected")
+		return
 	}
+}
 
-	if err = tx.Commit(); err != nil {
-		return err
+// SQLDB возвращает пул Postgres, на котором работает хранилище,
+// чтобы другие таблицы из миграций читались через него же
+func SQLDB(r Repository) (*sql.DB, bool) {
+	switch r := r.(type) {
+	case *postgres:
+		return r.DB, true
+	case *cache:
+		return SQLDB(r.backend)
 	}
 
-	p.buffer = p.buffer[:0]
-	return nil
+	return nil, false
 }
 
 func postgresInterface(cfg *config.ServerConfig, logger *config.Logger) *postgres {
 	db, err := sql.Open("pgx", cfg.Database)
+	if err != nil {
+		panic(err)
+	}
+
 	db.SetMaxOpenConns(30)
 	db.SetMaxIdleConns(30)
 	db.SetConnMaxIdleTime(time.Second * 30)
 	db.SetConnMaxLifetime(time.Minute * 2)
 
-	if err != nil {
-		panic(err)
-	}
-
-	_, err = db.Exec(schema)
-	if err != nil {
-		if !strings.Contains(err.Error(), "already exists") {
-			panic(err)
-		}
-	}
+	return newPostgres(db, cfg, logger)
+}
 
-	getStmt, err := db.Prepare(getQuery)
+// newPostgres не падает, если база недоступна: сервер стартует
+// в деградированном режиме и подключается в фоне
+func newPostgres(db *sql.DB, cfg *config.ServerConfig, logger *config.Logger) *postgres {
+	keys, err := newKeyRing(cfg)
 	if err != nil {
 		panic(err)
 	}
 
-	listStmt, err := db.Prepare(listQuery)
-	if err != nil {
-		panic(err)
+	subLogger := logger.With().Str("Component", "POSTGRES-DB").Logger()
+	p := &postgres{
+		DB:     db,
+		done:   make(chan struct{}),
+		cfg:    cfg,
+		keys:   keys,
+		logger: config.NewLogger(&subLogger),
 	}
+	p.replay = newPostgresGuard(db, p.isReady, cfg.ReplayWindow)
 
-	upsertStmt, err := db.Prepare(upsertQuery)
-	if err != nil {
-		panic(err)
+	if err = p.connect(context.Background()); err != nil {
+		p.logger.Error().Err(err).Msg("DB: unavailable, starting degraded")
+		go p.reconnect()
 	}
 
-	subLogger := logger.With().Str("Component", "POSTGRES-DB").Logger()
-	return &postgres{
-		DB:         db,
-		getStmt:    getStmt,
-		listStmt:   listStmt,
-		upsertStmt: upsertStmt,
-		cfg:        cfg,
-		buffer:     make([]metrics.Metric, 0, 100),
-		logger:     config.NewLogger(&subLogger),
-	}
+	return p
 }
@@ -0,0 +1,305 @@
+package storage
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"sync"
+	"time"
+	"unicode/utf8"
+
+	"github.com/fedoroko/practicum_go/internal/metrics"
+)
+
+// replayGuard запоминает nonce подписанных метрик, пока они не выйдут из окна
+type replayGuard interface {
+	// claim возвращает false, если nonce уже встречался
+	claim(ctx context.Context, nonce string, expires time.Time) (bool, error)
+	// claimAll занимает nonce батча за один вызов, ответ - по одному
+	// значению на nonce. Повторы внутри nonces не допускаются.
+	claimAll(ctx context.Context, nonces []string, expires []time.Time) ([]bool, error)
+}
+
+// checkReplay отклоняет метрики без подписи или отметки времени,
+// вне окна REPLAY_WINDOW или с повторным nonce. ts и nonce принимаются
+// только под подписью HashV2, остальные форматы их не покрывают.
+// Без проверки подписи отброшенный hash обходил бы защиту от повтора.
+func checkReplay(ctx context.Context, g replayGuard, window time.Duration, m metrics.Metric) error {
+	nonce, expires, err := replayStamp(time.Now(), window, m)
+	if err != nil || nonce == "" {
+		return err
+	}
+
+	ok, err := g.claim(ctx, nonce, expires)
+	if err != nil {
+		return err
+	}
+	if !ok {
+		return metrics.ThrowReplayError("duplicate nonce " + nonce)
+	}
+
+	return nil
+}
+
+// checkReplayBatch делает то же, что checkReplay, для метрик батча без
+// ошибок в errs, но занимает их nonce одним вызовом guard.
+// Ошибка guard возвращается отдельно как сбой хранилища.
+func checkReplayBatch(ctx context.Context, g replayGuard, window time.Duration, ms []metrics.Metric, errs []error) error {
+	now := time.Now()
+	var (
+		idx     []int
+		nonces  []string
+		expires []time.Time
+	)
+	seen := make(map[string]bool)
+	for i, m := range ms {
+		if errs[i] != nil {
+			continue
+		}
+
+		nonce, exp, err := replayStamp(now, window, m)
+		switch {
+		case err != nil:
+			errs[i] = err
+		case nonce == "":
+		case seen[nonce]:
+			errs[i] = metrics.ThrowReplayError("duplicate nonce " + nonce)
+		default:
+			seen[nonce] = true
+			idx = append(idx, i)
+			nonces = append(nonces, nonce)
+			expires = append(expires, exp)
+		}
+	}
+	if len(nonces) == 0 {
+		return nil
+	}
+
+	claimed, err := g.claimAll(ctx, nonces, expires)
+	if err != nil {
+		return err
+	}
+	for j, i := range idx {
+		if !claimed[j] {
+			errs[i] = metrics.ThrowReplayError("duplicate nonce " + nonces[j])
+		}
+	}
+
+	return nil
+}
+
+// replayWindow выключает проверку повторов без ключей: подпись тогда
+// не проверяется, и ts с nonce ничем не защищены
+func replayWindow(keys *metrics.KeyRing, window time.Duration) time.Duration {
+	if keys.Empty() {
+		return 0
+	}
+	return window
+}
+
+// maxNonceLength совпадает с размером metric_nonces.nonce: более длинный
+// nonce postgres не сохранит, и батч упал бы целиком
+const maxNonceLength = 64
+
+// replayStamp проверяет отметку времени метрики и возвращает ее nonce
+// со сроком хранения; пустой nonce - проверка повторов выключена
+func replayStamp(now time.Time, window time.Duration, m metrics.Metric) (string, time.Time, error) {
+	if window == 0 {
+		return "", time.Time{}, nil
+	}
+	if !m.IsSigned() {
+		return "", time.Time{}, metrics.ThrowReplayError("metric is not signed")
+	}
+	if m.HashVersion() != metrics.HashV2 {
+		return "", time.Time{}, metrics.ThrowReplayError("signature does not cover timestamp and nonce")
+	}
+
+	ts, nonce := m.Stamp()
+	if ts == 0 || nonce == "" {
+		return "", time.Time{}, metrics.ThrowReplayError("missing timestamp or nonce")
+	}
+	if utf8.RuneCountInString(nonce) > maxNonceLength {
+		return "", time.Time{}, metrics.ThrowReplayError("nonce is too long")
+	}
+
+	t := time.UnixMilli(ts)
+	if now.Sub(t) > window || t.Sub(now) > window {
+		return "", time.Time{}, metrics.ThrowReplayError("timestamp is out of window")
+	}
+
+	return nonce, t.Add(window), nil
+}
+
+type memoryGuard struct {
+	mtx   sync.Mutex
+	seen  map[string]time.Time
+	swept time.Time
+	every time.Duration
+}
+
+func newMemoryGuard(window time.Duration) *memoryGuard {
+	return &memoryGuard{
+		seen:  make(map[string]time.Time),
+		swept: time.Now(),
+		every: window,
+	}
+}
+
+func (g *memoryGuard) claim(ctx context.Context, nonce string, expires time.Time) (bool, error) {
+	ok, err := g.claimAll(ctx, []string{nonce}, []time.Time{expires})
+	if err != nil {
+		return false, err
+	}
+
+	return ok[0], nil
+}
+
+func (g *memoryGuard) claimAll(_ context.Context, nonces []string, expires []time.Time) ([]bool, error) {
+	g.mtx.Lock()
+	defer g.mtx.Unlock()
+
+	now := time.Now()
+	if now.Sub(g.swept) > g.every {
+		for n, exp := range g.seen {
+			if exp.Before(now) {
+				delete(g.seen, n)
+			}
+		}
+		g.swept = now
+	}
+
+	ret := make([]bool, len(nonces))
+	for i, nonce := range nonces {
+		if _, ok := g.seen[nonce]; ok {
+			continue
+		}
+		g.seen[nonce] = expires[i]
+		ret[i] = true
+	}
+
+	return ret, nil
+}
+
+const (
+	claimNonceQuery string = `INSERT INTO metric_nonces (nonce, expires_at)
+							  VALUES ($1, $2)
+							  ON CONFLICT (nonce) DO NOTHING;`
+
+	// claimNoncesQuery вставляет nonce батча одним запросом
+	// и возвращает только те, что были свободны
+	claimNoncesQuery string = `INSERT INTO metric_nonces (nonce, expires_at)
+							   SELECT * FROM unnest($1::VARCHAR[], $2::TIMESTAMP[])
+							   ON CONFLICT (nonce) DO NOTHING
+							   RETURNING nonce;`
+
+	sweepNoncesQuery string = `DELETE FROM metric_nonces
+							   WHERE expires_at < $1;`
+)
+
+// postgresGuard хранит nonce в таблице metric_nonces,
+// чтобы повтор отклонялся любым экземпляром сервера.
+// Пока база не готова или соединение потеряно, guard отвечает
+// ErrUnavailable, как и остальные запросы к postgres.
+type postgresGuard struct {
+	db    *sql.DB
+	ready func() bool
+	mtx   sync.Mutex
+	swept time.Time
+	every time.Duration
+}
+
+// newPostgresGuard ожидает таблицу metric_nonces из миграций
+func newPostgresGuard(db *sql.DB, ready func() bool, window time.Duration) *postgresGuard {
+	return &postgresGuard{
+		db:    db,
+		ready: ready,
+		swept: time.Now(),
+		every: window,
+	}
+}
+
+// unavailable сводит временные сбои соединения к ErrUnavailable,
+// остальные ошибки возвращаются как есть
+func unavailable(err error) error {
+	if isRetryable(err) {
+		return fmt.Errorf("%w: %v", ErrUnavailable, err)
+	}
+	return err
+}
+
+func (g *postgresGuard) claim(ctx context.Context, nonce string, expires time.Time) (bool, error) {
+	if !g.ready() {
+		return false, ErrUnavailable
+	}
+	if err := g.sweep(ctx); err != nil {
+		return false, err
+	}
+
+	res, err := g.db.ExecContext(ctx, claimNonceQuery, nonce, expires.UTC())
+	if err != nil {
+		return false, unavailable(err)
+	}
+
+	n, err := res.RowsAffected()
+	if err != nil {
+		return false, unavailable(err)
+	}
+
+	return n == 1, nil
+}
+
+func (g *postgresGuard) claimAll(ctx context.Context, nonces []string, expires []time.Time) ([]bool, error) {
+	if !g.ready() {
+		return nil, ErrUnavailable
+	}
+	if err := g.sweep(ctx); err != nil {
+		return nil, err
+	}
+
+	utc := make([]time.Time, len(expires))
+	for i, t := range expires {
+		utc[i] = t.UTC()
+	}
+
+	rows, err := g.db.QueryContext(ctx, claimNoncesQuery, nonces, utc)
+	if err != nil {
+		return nil, unavailable(err)
+	}
+	defer rows.Close()
+
+	claimed := make(map[string]bool, len(nonces))
+	for rows.Next() {
+		var nonce string
+		if err = rows.Scan(&nonce); err != nil {
+			return nil, unavailable(err)
+		}
+		claimed[nonce] = true
+	}
+	if err = rows.Err(); err != nil {
+		return nil, unavailable(err)
+	}
+
+	ret := make([]bool, len(nonces))
+	for i, nonce := range nonces {
+		ret[i] = claimed[nonce]
+	}
+
+	return ret, nil
+}
+
+func (g *postgresGuard) sweep(ctx context.Context) error {
+	g.mtx.Lock()
+	defer g.mtx.Unlock()
+
+	now := time.Now()
+	if now.Sub(g.swept) <= g.every {
+		return nil
+	}
+
+	if _, err := g.db.ExecContext(ctx, sweepNoncesQuery, now.UTC()); err != nil {
+		return unavailable(err)
+	}
+	g.swept = now
+
+	return nil
+}
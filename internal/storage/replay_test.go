@@ -0,0 +1,236 @@
+package storage
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/fedoroko/practicum_go/internal/config"
+	"github.com/fedoroko/practicum_go/internal/metrics"
+)
+
+func Test_repo_replay(t *testing.T) {
+	ctx := context.Background()
+	cfg := config.NewServerConfig()
+	cfg.StoreFile = t.TempDir() + "/db.json"
+	cfg.Key = "secret"
+	cfg.ReplayWindow = time.Minute
+	r := repoInterface(cfg, config.TestLogger())
+	defer r.Close()
+
+	signed := func(ts time.Time, nonce string) metrics.Metric {
+		m := metrics.NewOmitEmpty("PollCount", metrics.CounterType, nil, metrics.PointerFromInt64(5))
+		if !ts.IsZero() {
+			m.SetStamp(ts.UnixMilli(), nonce)
+		}
+		require.NoError(t, m.SetHash("secret"))
+		return m
+	}
+	now := time.Now()
+
+	tests := []struct {
+		name    string
+		metric  metrics.Metric
+		wantErr bool
+	}{
+		{
+			name:   "fresh",
+			metric: signed(now, "a"),
+		},
+		{
+			name:    "duplicate nonce",
+			metric:  signed(now, "a"),
+			wantErr: true,
+		},
+		{
+			name:   "another nonce",
+			metric: signed(now.Add(-time.Second), "b"),
+		},
+		{
+			name:    "stale",
+			metric:  signed(now.Add(-2*time.Minute), "c"),
+			wantErr: true,
+		},
+		{
+			name:    "from the future",
+			metric:  signed(now.Add(2*time.Minute), "d"),
+			wantErr: true,
+		},
+		{
+			name:    "no stamp",
+			metric:  signed(time.Time{}, ""),
+			wantErr: true,
+		},
+		{
+			name:   "longest nonce",
+			metric: signed(now, strings.Repeat("f", maxNonceLength)),
+		},
+		{
+			name:    "nonce too long",
+			metric:  signed(now, strings.Repeat("g", maxNonceLength+1)),
+			wantErr: true,
+		},
+		{
+			// перехваченная метрика с вырезанным hash
+			name:    "unsigned",
+			metric:  metrics.NewOmitEmpty("PollCount", metrics.CounterType, nil, metrics.PointerFromInt64(5)),
+			wantErr: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := r.Set(ctx, tt.metric)
+			if tt.wantErr {
+				assert.ErrorAs(t, err, &metrics.Replay)
+			} else {
+				assert.NoError(t, err)
+			}
+		})
+	}
+	assert.Equal(t, counter(15), r.C["PollCount"])
+
+	// подмена времени ломает подпись
+	m := signed(now, "e")
+	m.SetStamp(now.Add(time.Second).UnixMilli(), "e")
+	assert.ErrorAs(t, r.Set(ctx, m), &metrics.InvalidHash)
+}
+
+// без ключей подпись не проверяется, и окно повторов не действует
+func Test_repo_replay_noKey(t *testing.T) {
+	ctx := context.Background()
+	cfg := config.NewServerConfig()
+	cfg.StoreFile = t.TempDir() + "/db.json"
+	cfg.ReplayWindow = time.Minute
+	r := repoInterface(cfg, config.TestLogger())
+	defer r.Close()
+
+	m := metrics.NewOmitEmpty("PollCount", metrics.CounterType, nil, metrics.PointerFromInt64(5))
+	assert.NoError(t, r.Set(ctx, m))
+
+	errs, err := r.SetBatch(ctx, []metrics.Metric{m}, false)
+	require.NoError(t, err)
+	assert.Equal(t, []error{nil}, errs)
+}
+
+// checkReplay не доверяет ts и nonce, которые подпись не покрывает
+func Test_checkReplay_legacy(t *testing.T) {
+	ctx := context.Background()
+	g := newMemoryGuard(time.Minute)
+
+	for _, nonce := range []string{"a", "b"} {
+		m := metrics.NewOmitEmpty("PollCount", metrics.CounterType, nil, metrics.PointerFromInt64(5))
+		require.NoError(t, m.SetLegacyHash("secret"))
+		m.SetStamp(time.Now().UnixMilli(), nonce)
+
+		assert.ErrorAs(t, checkReplay(ctx, g, time.Minute, m), &metrics.Replay)
+	}
+}
+
+func Test_repo_SetBatch_replay(t *testing.T) {
+	ctx := context.Background()
+	cfg := config.NewServerConfig()
+	cfg.StoreFile = t.TempDir() + "/db.json"
+	cfg.Key = "secret"
+	cfg.ReplayWindow = time.Minute
+	r := repoInterface(cfg, config.TestLogger())
+	defer r.Close()
+
+	m := metrics.NewOmitEmpty("PollCount", metrics.CounterType, nil, metrics.PointerFromInt64(5))
+	m.SetStamp(time.Now().UnixMilli(), "a")
+	require.NoError(t, m.SetHash("secret"))
+
+	errs, err := r.SetBatch(ctx, []metrics.Metric{m}, true)
+	require.NoError(t, err)
+	assert.Equal(t, []error{nil}, errs)
+
+	// повтор атомарного батча не применяется даже частично
+	fresh := metrics.NewOmitEmpty("Alloc", metrics.GaugeType, metrics.PointerFromFloat64(1), nil)
+	fresh.SetStamp(time.Now().UnixMilli(), "b")
+	require.NoError(t, fresh.SetHash("secret"))
+	errs, err = r.SetBatch(ctx, []metrics.Metric{fresh, m}, true)
+	require.NoError(t, err)
+	assert.ErrorIs(t, errs[0], ErrNotApplied)
+	assert.ErrorAs(t, errs[1], &metrics.Replay)
+	assert.Equal(t, counter(5), r.C["PollCount"])
+	assert.NotContains(t, r.G, "Alloc")
+}
+
+// countingGuard считает обращения к guard
+type countingGuard struct {
+	replayGuard
+	calls int
+	err   error
+}
+
+func (g *countingGuard) claimAll(ctx context.Context, nonces []string, expires []time.Time) ([]bool, error) {
+	g.calls++
+	if g.err != nil {
+		return nil, g.err
+	}
+	return g.replayGuard.claimAll(ctx, nonces, expires)
+}
+
+func Test_checkReplayBatch(t *testing.T) {
+	ctx := context.Background()
+	now := time.Now()
+	signed := func(ts time.Time, nonce string) metrics.Metric {
+		m := metrics.NewOmitEmpty("PollCount", metrics.CounterType, nil, metrics.PointerFromInt64(5))
+		m.SetStamp(ts.UnixMilli(), nonce)
+		require.NoError(t, m.SetHash("secret"))
+		return m
+	}
+
+	g := &countingGuard{replayGuard: newMemoryGuard(time.Minute)}
+	_, err := g.claim(ctx, "claimed", now.Add(time.Minute))
+	require.NoError(t, err)
+
+	ms := []metrics.Metric{
+		signed(now, "a"),
+		signed(now, "b"),
+		signed(now, "a"),
+		signed(now.Add(-2*time.Minute), "c"),
+		signed(now, "claimed"),
+		metrics.NewOmitEmpty("Alloc", metrics.GaugeType, metrics.PointerFromFloat64(1), nil),
+		signed(now, "d"),
+		signed(now, strings.Repeat("e", maxNonceLength+1)),
+	}
+	errs := make([]error, len(ms))
+	errs[6] = errors.New("bad hash")
+
+	require.NoError(t, checkReplayBatch(ctx, g, time.Minute, ms, errs))
+	assert.Equal(t, 1, g.calls)
+	assert.NoError(t, errs[0])
+	assert.NoError(t, errs[1])
+	assert.ErrorAs(t, errs[2], &metrics.Replay)
+	assert.ErrorAs(t, errs[3], &metrics.Replay)
+	assert.ErrorAs(t, errs[4], &metrics.Replay)
+	assert.ErrorAs(t, errs[5], &metrics.Replay)
+	// длинный nonce отклоняется до обращения к guard
+	assert.ErrorAs(t, errs[7], &metrics.Replay)
+	// метрика с ошибкой не занимает nonce
+	assert.NotContains(t, g.replayGuard.(*memoryGuard).seen, "d")
+
+	// сбой guard - ошибка всего батча
+	g.err = errors.New("connection refused")
+	assert.Error(t, checkReplayBatch(ctx, g, time.Minute, []metrics.Metric{signed(now, "e")}, make([]error, 1)))
+}
+
+func Test_memoryGuard_sweep(t *testing.T) {
+	ctx := context.Background()
+	g := newMemoryGuard(time.Millisecond)
+	ok, err := g.claim(ctx, "a", time.Now())
+	require.NoError(t, err)
+	assert.True(t, ok)
+
+	time.Sleep(5 * time.Millisecond)
+	ok, err = g.claim(ctx, "b", time.Now().Add(time.Minute))
+	require.NoError(t, err)
+	assert.True(t, ok)
+	assert.NotContains(t, g.seen, "a")
+	assert.Contains(t, g.seen, "b")
+}
@@ -0,0 +1,118 @@
+package storage
+
+import (
+	"context"
+	"database/sql/driver"
+	"errors"
+	"io"
+	"net"
+	"strings"
+	"time"
+)
+
+// ErrUnavailable - сервер запущен без базы и еще не смог к ней подключиться
+var ErrUnavailable = errors.New("database is unavailable")
+
+// isRetryable отделяет временные сбои, после которых можно повторить
+// чтение: потерю соединения, конфликт сериализации и deadlock
+func isRetryable(err error) bool {
+	if err == nil {
+		return false
+	}
+
+	var state interface{ SQLState() string }
+	if errors.As(err, &state) {
+		code := state.SQLState()
+		switch {
+		case strings.HasPrefix(code, "08"):
+			// connection exception
+			return true
+		case code == "40001", code == "40P01":
+			// serialization_failure, deadlock_detected
+			return true
+		case code == "57P01", code == "57P02", code == "57P03":
+			// сервер перезапускается
+			return true
+		}
+		return false
+	}
+
+	var netErr net.Error
+	return errors.As(err, &netErr) ||
+		errors.Is(err, driver.ErrBadConn) ||
+		errors.Is(err, io.EOF) ||
+		errors.Is(err, io.ErrUnexpectedEOF)
+}
+
+// isRetryableWrite не повторяет запись, если соединение оборвалось после
+// отправки: сервер мог ее применить, и дельта счетчика прибавится дважды.
+// Повторяются только откаты сервером и ошибки до отправки запроса.
+func isRetryableWrite(err error) bool {
+	if err == nil {
+		return false
+	}
+
+	var state interface{ SQLState() string }
+	if errors.As(err, &state) {
+		code := state.SQLState()
+		return code == "40001" || code == "40P01"
+	}
+
+	var safe interface{ SafeToRetry() bool }
+	if errors.As(err, &safe) && safe.SafeToRetry() {
+		return true
+	}
+
+	var opErr *net.OpError
+	if errors.As(err, &opErr) && opErr.Op == "dial" {
+		return true
+	}
+
+	// database/sql требует от драйвера ErrBadConn, только если запрос не ушел
+	return errors.Is(err, driver.ErrBadConn)
+}
+
+// commitError - сбой COMMIT: транзакция могла примениться
+type commitError struct {
+	err error
+}
+
+func (e *commitError) Error() string {
+	return "commit: " + e.err.Error()
+}
+
+func (e *commitError) Unwrap() error {
+	return e.err
+}
+
+// isRetryableTx повторяет транзакцию при любом временном сбое до COMMIT:
+// незавершенную транзакцию сервер откатит. Сбой самого COMMIT проверяется
+// как запись.
+func isRetryableTx(err error) bool {
+	var commit *commitError
+	if errors.As(err, &commit) {
+		return isRetryableWrite(commit.err)
+	}
+
+	return isRetryable(err)
+}
+
+// retry повторяет fn при ошибках, которые retryable считает временными,
+// не больше DBRetries раз, удваивая паузу начиная с DBRetryBackoff
+func (p *postgres) retry(ctx context.Context, retryable func(error) bool, fn func() error) error {
+	backoff := p.cfg.DBRetryBackoff
+	for attempt := 1; ; attempt++ {
+		err := fn()
+		if err == nil || attempt > p.cfg.DBRetries || !retryable(err) {
+			return err
+		}
+
+		p.logger.Warn().Err(err).Int("attempt", attempt).Msg("DB: retrying")
+		select {
+		case <-ctx.Done():
+			return err
+		case <-time.After(backoff):
+		}
+		backoff *= 2
+	}
+}
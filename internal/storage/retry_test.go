@@ -0,0 +1,419 @@
+package storage
+
+import (
+	"context"
+	"database/sql"
+	"database/sql/driver"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/fedoroko/practicum_go/internal/config"
+	"github.com/fedoroko/practicum_go/internal/metrics"
+)
+
+// pgErr повторяет интерфейс ошибки pgconn
+type pgErr struct {
+	code string
+}
+
+func (e *pgErr) Error() string {
+	return "pg error " + e.code
+}
+
+func (e *pgErr) SQLState() string {
+	return e.code
+}
+
+var errRefused = &net.OpError{Op: "dial", Net: "tcp", Err: errors.New("connection refused")}
+
+// fakeDB - драйвер без базы: отдает ошибки из failures по одной на
+// каждый INSERT в metrics и не подключается, пока down.
+// Ошибки commits возвращаются из COMMIT уже примененной транзакции.
+type fakeDB struct {
+	mtx      sync.Mutex
+	down     bool
+	failures []error
+	commits  []error
+	inserts  int
+}
+
+func (d *fakeDB) setDown(down bool) {
+	d.mtx.Lock()
+	defer d.mtx.Unlock()
+	d.down = down
+}
+
+func (d *fakeDB) fail(errs ...error) {
+	d.mtx.Lock()
+	defer d.mtx.Unlock()
+	d.failures = append(d.failures, errs...)
+}
+
+func (d *fakeDB) failCommit(errs ...error) {
+	d.mtx.Lock()
+	defer d.mtx.Unlock()
+	d.commits = append(d.commits, errs...)
+}
+
+func (d *fakeDB) commit() error {
+	d.mtx.Lock()
+	defer d.mtx.Unlock()
+	if len(d.commits) == 0 {
+		return nil
+	}
+	err := d.commits[0]
+	d.commits = d.commits[1:]
+	return err
+}
+
+func (d *fakeDB) insertCount() int {
+	d.mtx.Lock()
+	defer d.mtx.Unlock()
+	return d.inserts
+}
+
+func (d *fakeDB) exec(query string) error {
+	d.mtx.Lock()
+	defer d.mtx.Unlock()
+	if d.down {
+		return driver.ErrBadConn
+	}
+	if !strings.Contains(query, "INSERT INTO metrics") {
+		return nil
+	}
+
+	d.inserts++
+	if len(d.failures) == 0 {
+		return nil
+	}
+	err := d.failures[0]
+	d.failures = d.failures[1:]
+	return err
+}
+
+func (d *fakeDB) Connect(context.Context) (driver.Conn, error) {
+	d.mtx.Lock()
+	defer d.mtx.Unlock()
+	if d.down {
+		return nil, errRefused
+	}
+	return &fakeConn{db: d}, nil
+}
+
+func (d *fakeDB) Driver() driver.Driver {
+	return fakeDriver{d}
+}
+
+type fakeDriver struct {
+	db *fakeDB
+}
+
+func (f fakeDriver) Open(string) (driver.Conn, error) {
+	return f.db.Connect(context.Background())
+}
+
+type fakeConn struct {
+	db *fakeDB
+}
+
+func (c *fakeConn) Prepare(query string) (driver.Stmt, error) {
+	return &fakeStmt{db: c.db, query: query}, nil
+}
+
+func (c *fakeConn) Close() error {
+	return nil
+}
+
+func (c *fakeConn) Begin() (driver.Tx, error) {
+	return fakeTx{db: c.db}, nil
+}
+
+func (c *fakeConn) Ping(context.Context) error {
+	return c.db.exec("")
+}
+
+type fakeStmt struct {
+	db    *fakeDB
+	query string
+}
+
+func (s *fakeStmt) Close() error {
+	return nil
+}
+
+func (s *fakeStmt) NumInput() int {
+	return -1
+}
+
+func (s *fakeStmt) Exec([]driver.Value) (driver.Result, error) {
+	if err := s.db.exec(s.query); err != nil {
+		return nil, err
+	}
+	return driver.RowsAffected(1), nil
+}
+
+// Query отвечает true на SELECT EXISTS, чтобы миграции считались примененными
+func (s *fakeStmt) Query([]driver.Value) (driver.Rows, error) {
+	if err := s.db.exec(s.query); err != nil {
+		return nil, err
+	}
+	if strings.Contains(s.query, "SELECT EXISTS") {
+		return &fakeRows{cols: []string{"exists"}, rows: [][]driver.Value{{true}}}, nil
+	}
+	return &fakeRows{cols: []string{"name", "type", "value", "delta"}}, nil
+}
+
+type fakeTx struct {
+	db *fakeDB
+}
+
+func (tx fakeTx) Commit() error { return tx.db.commit() }
+func (fakeTx) Rollback() error  { return nil }
+
+type fakeRows struct {
+	cols []string
+	rows [][]driver.Value
+}
+
+func (r *fakeRows) Columns() []string {
+	return r.cols
+}
+
+func (r *fakeRows) Close() error {
+	return nil
+}
+
+func (r *fakeRows) Next(dest []driver.Value) error {
+	if len(r.rows) == 0 {
+		return io.EOF
+	}
+	copy(dest, r.rows[0])
+	r.rows = r.rows[1:]
+	return nil
+}
+
+func testPostgres(t *testing.T, d *fakeDB) *postgres {
+	cfg := config.NewServerConfig()
+	cfg.DBRetries = 2
+	cfg.DBRetryBackoff = time.Millisecond
+	cfg.DBReconnectInterval = time.Millisecond * 10
+
+	p := newPostgres(sql.OpenDB(d), cfg, config.TestLogger())
+	t.Cleanup(func() {
+		p.Close()
+	})
+	return p
+}
+
+func Test_isRetryable(t *testing.T) {
+	tests := []struct {
+		name string
+		err  error
+		want bool
+	}{
+		{"nil", nil, false},
+		{"bad conn", driver.ErrBadConn, true},
+		{"net", errRefused, true},
+		{"eof", fmt.Errorf("read: %w", io.ErrUnexpectedEOF), true},
+		{"connection failure", &pgErr{"08006"}, true},
+		{"serialization", &pgErr{"40001"}, true},
+		{"deadlock", &pgErr{"40P01"}, true},
+		{"admin shutdown", &pgErr{"57P01"}, true},
+		{"unique violation", &pgErr{"23505"}, false},
+		{"no rows", sql.ErrNoRows, false},
+		{"other", errors.New("syntax"), false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			assert.Equal(t, tt.want, isRetryable(tt.err))
+		})
+	}
+}
+
+func Test_isRetryableWrite(t *testing.T) {
+	tests := []struct {
+		name string
+		err  error
+		want bool
+	}{
+		{"nil", nil, false},
+		{"dial", errRefused, true},
+		{"bad conn", driver.ErrBadConn, true},
+		{"serialization", &pgErr{"40001"}, true},
+		{"deadlock", &pgErr{"40P01"}, true},
+		{"connection lost", io.ErrUnexpectedEOF, false},
+		{"read timeout", &net.OpError{Op: "read", Net: "tcp", Err: errors.New("i/o timeout")}, false},
+		{"connection failure", &pgErr{"08006"}, false},
+		{"admin shutdown", &pgErr{"57P01"}, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			assert.Equal(t, tt.want, isRetryableWrite(tt.err))
+			assert.Equal(t, tt.want, isRetryableTx(&commitError{err: tt.err}))
+		})
+	}
+}
+
+func Test_postgres_retry(t *testing.T) {
+	tests := []struct {
+		name     string
+		failures []error
+		wantErr  bool
+		inserts  int
+	}{
+		{
+			name:    "no failures",
+			inserts: 1,
+		},
+		{
+			name:     "transient failures",
+			failures: []error{&pgErr{"40001"}, &pgErr{"40P01"}},
+			inserts:  3,
+		},
+		{
+			name:     "retries exhausted",
+			failures: []error{&pgErr{"40001"}, &pgErr{"40001"}, &pgErr{"40001"}},
+			wantErr:  true,
+			inserts:  3,
+		},
+		{
+			name:     "not retryable",
+			failures: []error{&pgErr{"23505"}},
+			wantErr:  true,
+			inserts:  1,
+		},
+		{
+			name:     "connection lost after send",
+			failures: []error{io.ErrUnexpectedEOF},
+			wantErr:  true,
+			inserts:  1,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ctx := context.Background()
+			d := &fakeDB{}
+			p := testPostgres(t, d)
+			d.fail(tt.failures...)
+
+			err := p.Set(ctx, metrics.New("Alloc", metrics.GaugeType, 1, 0))
+			assert.Equal(t, tt.wantErr, err != nil)
+			assert.Equal(t, tt.inserts, d.insertCount())
+		})
+	}
+}
+
+func Test_postgres_SetBatch_retry(t *testing.T) {
+	ctx := context.Background()
+	d := &fakeDB{}
+	p := testPostgres(t, d)
+
+	// первая попытка падает на второй метрике, повтор пишет обе заново
+	d.fail(nil, &pgErr{"40P01"})
+	errs, err := p.SetBatch(ctx, []metrics.Metric{
+		metrics.New("Alloc", metrics.GaugeType, 1, 0),
+		metrics.New("PollCount", metrics.CounterType, 0, 1),
+	}, false)
+	require.NoError(t, err)
+	assert.Equal(t, []error{nil, nil}, errs)
+	assert.Equal(t, 4, d.insertCount())
+}
+
+// COMMIT, оборвавшийся после применения, не повторяется:
+// иначе дельты счетчиков прибавились бы дважды
+func Test_postgres_SetBatch_commit(t *testing.T) {
+	tests := []struct {
+		name    string
+		commit  error
+		wantErr bool
+		inserts int
+	}{
+		{
+			name:    "connection lost on commit",
+			commit:  io.ErrUnexpectedEOF,
+			wantErr: true,
+			inserts: 1,
+		},
+		{
+			name:    "serialization failure on commit",
+			commit:  &pgErr{"40001"},
+			inserts: 2,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ctx := context.Background()
+			d := &fakeDB{}
+			p := testPostgres(t, d)
+			d.failCommit(tt.commit)
+
+			_, err := p.SetBatch(ctx, []metrics.Metric{
+				metrics.New("PollCount", metrics.CounterType, 0, 1),
+			}, false)
+			assert.Equal(t, tt.wantErr, err != nil)
+			assert.Equal(t, tt.inserts, d.insertCount())
+		})
+	}
+}
+
+func Test_postgres_degraded(t *testing.T) {
+	ctx := context.Background()
+	d := &fakeDB{down: true}
+	p := testPostgres(t, d)
+
+	assert.ErrorIs(t, p.Ping(ctx), ErrUnavailable)
+	assert.ErrorIs(t, p.Set(ctx, metrics.New("Alloc", metrics.GaugeType, 1, 0)), ErrUnavailable)
+	_, err := p.List(ctx)
+	assert.ErrorIs(t, err, ErrUnavailable)
+
+	d.setDown(false)
+	assert.Eventually(t, func() bool {
+		return p.Ping(ctx) == nil
+	}, time.Second, time.Millisecond*10)
+	assert.NoError(t, p.Set(ctx, metrics.New("Alloc", metrics.GaugeType, 1, 0)))
+}
+
+// без базы проверка nonce не должна превращаться в 500:
+// кэш отвечает ErrUnavailable, пока postgres недоступен
+func Test_cache_replay_unavailable(t *testing.T) {
+	ctx := context.Background()
+	cfg := config.NewServerConfig()
+	cfg.Key = "secret"
+	cfg.ReplayWindow = time.Minute
+	cfg.DBRetries = 0
+	cfg.DBReconnectInterval = time.Millisecond * 10
+
+	signed := func(nonce string) metrics.Metric {
+		m := metrics.NewOmitEmpty("PollCount", metrics.CounterType, nil, metrics.PointerFromInt64(5))
+		m.SetStamp(time.Now().UnixMilli(), nonce)
+		require.NoError(t, m.SetHash("secret"))
+		return m
+	}
+
+	// база не готова с самого старта
+	d := &fakeDB{down: true}
+	p := newPostgres(sql.OpenDB(d), cfg, config.TestLogger())
+	// Close кэша закрывает и postgres
+	c := newCache(p, cfg, config.TestLogger())
+	defer c.Close()
+
+	assert.ErrorIs(t, c.Set(ctx, signed("a")), ErrUnavailable)
+
+	// соединение потеряно после подключения
+	d.setDown(false)
+	require.Eventually(t, p.isReady, time.Second, time.Millisecond*10)
+	d.setDown(true)
+
+	assert.ErrorIs(t, c.Set(ctx, signed("b")), ErrUnavailable)
+	_, err := c.SetBatch(ctx, []metrics.Metric{signed("c")}, false)
+	assert.ErrorIs(t, err, ErrUnavailable)
+}
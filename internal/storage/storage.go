@@ -1,9 +1,11 @@
 package storage
 
 import (
+	"context"
 	"errors"
 	"io"
 	"os"
+	"strings"
 	"sync"
 	"time"
 
@@ -13,16 +15,26 @@ import (
 	"github.com/fedoroko/practicum_go/internal/metrics"
 )
 
-type Repository interface {
-	Get(metrics.Metric) (metrics.Metric, error)
-	Set(metrics.Metric) error
-	SetBatch([]metrics.Metric) error
-	List() ([]metrics.Metric, error)
+//go:generate go run github.com/golang/mock/mockgen -destination ../mocks/mock_doer.go -package mocks github.com/fedoroko/practicum_go/internal/storage Repository
 
-	Ping() error
+// Repository получает контекст запроса, чтобы запросы к базе
+// отменялись вместе с ним
+type Repository interface {
+	Get(ctx context.Context, m metrics.Metric) (metrics.Metric, error)
+	Set(ctx context.Context, m metrics.Metric) error
+	// SetBatch возвращает результат для каждой метрики, nil - метрика принята.
+	// Без atomic принимаются все корректные метрики, с atomic - все или ни одной.
+	// Ошибка вторым значением означает сбой хранилища для всего батча.
+	SetBatch(ctx context.Context, ms []metrics.Metric, atomic bool) ([]error, error)
+	List(ctx context.Context) ([]metrics.Metric, error)
+
+	Ping(ctx context.Context) error
 	Close() error
 }
 
+// ErrNotFound - метрики нет в хранилище
+var ErrNotFound = errors.New("not found")
+
 type gauge float64
 
 type counter int64
@@ -33,19 +45,21 @@ type repo struct {
 	C        map[string]counter `json:"counter"`
 	cMtx     sync.RWMutex
 	cfg      *config.ServerConfig
+	keys     *metrics.KeyRing
+	replay   replayGuard
 	producer *producer
 	consumer *consumer
 	logger   *config.Logger
 }
 
-func (r *repo) Get(m metrics.Metric) (metrics.Metric, error) {
+func (r *repo) Get(_ context.Context, m metrics.Metric) (metrics.Metric, error) {
 	switch m.Type() {
 	case metrics.GaugeType:
 		r.gMtx.RLock()
 		defer r.gMtx.RUnlock()
 		v, ok := r.G[m.Name()]
 		if !ok {
-			return m, errors.New("not found")
+			return m, ErrNotFound
 		}
 		m.SetFloat64(float64(v))
 
@@ -54,7 +68,7 @@ func (r *repo) Get(m metrics.Metric) (metrics.Metric, error) {
 		defer r.cMtx.RUnlock()
 		v, ok := r.C[m.Name()]
 		if !ok {
-			return m, errors.New("not found")
+			return m, ErrNotFound
 		}
 		m.SetInt64(int64(v))
 
@@ -62,18 +76,59 @@ func (r *repo) Get(m metrics.Metric) (metrics.Metric, error) {
 		return m, metrics.ThrowInvalidTypeError(m.Type())
 	}
 
-	if err := m.SetHash(r.cfg.Key); err != nil {
+	if err := r.keys.Sign(m); err != nil {
 		return m, err
 	}
 
 	return m, nil
 }
 
-func (r *repo) Set(m metrics.Metric) error {
-	if ok, _ := m.CheckHash(r.cfg.Key); !ok {
-		return metrics.ThrowInvalidHashError()
+func (r *repo) Set(ctx context.Context, m metrics.Metric) error {
+	if err := r.check(ctx, m); err != nil {
+		return err
 	}
 
+	return r.store(m)
+}
+
+// SetBatch сначала проверяет весь батч: после проверок запись в память
+// не может упасть, поэтому атомарный батч применяется целиком
+func (r *repo) SetBatch(ctx context.Context, ms []metrics.Metric, atomic bool) ([]error, error) {
+	errs, failed, err := r.checkBatch(ctx, ms)
+	if err != nil {
+		return nil, err
+	}
+	if atomic && failed {
+		notApplied(errs)
+		return errs, nil
+	}
+
+	for i, m := range ms {
+		if errs[i] != nil {
+			continue
+		}
+		errs[i] = r.store(m)
+	}
+
+	return errs, nil
+}
+
+func (r *repo) check(ctx context.Context, m metrics.Metric) error {
+	if err := checkName(m); err != nil {
+		return err
+	}
+	if err := r.keys.Check(m); err != nil {
+		return err
+	}
+
+	return checkReplay(ctx, r.replay, replayWindow(r.keys, r.cfg.ReplayWindow), m)
+}
+
+func (r *repo) checkBatch(ctx context.Context, ms []metrics.Metric) ([]error, bool, error) {
+	return checkBatch(ctx, ms, r.keys, r.replay, r.cfg.ReplayWindow)
+}
+
+func (r *repo) store(m metrics.Metric) error {
 	if r.cfg.StoreInterval == 0 {
 		defer r.producer.write(r)
 	}
@@ -89,7 +144,7 @@ func (r *repo) Set(m metrics.Metric) error {
 		r.cMtx.Lock()
 		defer r.cMtx.Unlock()
 
-		if cur, ok := r.C[m.Name()]; ok {
+		if cur, ok := r.C[m.Name()]; ok && !m.IsCumulative() {
 			r.C[m.Name()] = cur + counter(m.Int64Value())
 		} else {
 			r.C[m.Name()] = counter(m.Int64Value())
@@ -102,25 +157,7 @@ func (r *repo) Set(m metrics.Metric) error {
 	return nil
 }
 
-func (r *repo) SetBatch(ms []metrics.Metric) error {
-	for _, m := range ms {
-		if err := m.CheckType(); err != nil {
-			return err
-		}
-
-		if ok, _ := m.CheckHash(r.cfg.Key); !ok {
-			return metrics.ThrowInvalidHashError()
-		}
-
-		if err := r.Set(m); err != nil {
-			return err
-		}
-	}
-
-	return nil
-}
-
-func (r *repo) List() ([]metrics.Metric, error) {
+func (r *repo) List(_ context.Context) ([]metrics.Metric, error) {
 	var ret []metrics.Metric
 
 	r.gMtx.RLock()
@@ -172,7 +209,7 @@ func (r *repo) listenAndWrite() {
 	}
 }
 
-func (r *repo) Ping() error {
+func (r *repo) Ping(_ context.Context) error {
 	return nil
 }
 
@@ -197,6 +234,11 @@ func repoInterface(cfg *config.ServerConfig, logger *config.Logger) *repo {
 		panic(err)
 	}
 
+	keys, err := newKeyRing(cfg)
+	if err != nil {
+		panic(err)
+	}
+
 	subLogger := logger.With().Str("Component", "DUMMY-DB").Logger()
 	return &repo{
 		G:        make(map[string]gauge),
@@ -204,16 +246,39 @@ func repoInterface(cfg *config.ServerConfig, logger *config.Logger) *repo {
 		C:        make(map[string]counter),
 		cMtx:     sync.RWMutex{},
 		cfg:      cfg,
+		keys:     keys,
+		replay:   newMemoryGuard(cfg.ReplayWindow),
 		producer: p,
 		consumer: c,
 		logger:   config.NewLogger(&subLogger),
 	}
 }
 
+// newKeyRing собирает ключи подписи из KEY, KEYS и SIGNING_KEY_ID.
+// Старая подпись не покрывает ts и nonce, поэтому с защитой от повтора
+// она несовместима.
+func newKeyRing(cfg *config.ServerConfig) (*metrics.KeyRing, error) {
+	if cfg.LegacyHash && cfg.ReplayWindow > 0 {
+		return nil, errors.New("LEGACY_HASH cannot be combined with REPLAY_WINDOW")
+	}
+
+	return metrics.NewKeyRing(cfg.Key, cfg.Keys, cfg.SigningKeyID, cfg.LegacyHash)
+}
+
 func New(cfg *config.ServerConfig, logger *config.Logger) Repository {
+	if strings.HasPrefix(cfg.Database, boltScheme+"://") {
+		logger.Info().Msg("DB: bolt")
+		return boltInterface(cfg, logger)
+	}
+
 	if cfg.Database != "" {
 		logger.Info().Msg("DB: postgres")
-		return postgresInterface(cfg, logger)
+		p := postgresInterface(cfg, logger)
+		if cfg.Cache {
+			logger.Info().Msg("DB: write-behind cache")
+			return newCache(p, cfg, logger)
+		}
+		return p
 	}
 
 	log.Info().Msg("DB: dummy")
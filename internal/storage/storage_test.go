@@ -1,8 +1,11 @@
 package storage
 
 import (
+	"context"
+	"strings"
 	"sync"
 	"testing"
+	"time"
 
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/require"
@@ -61,6 +64,7 @@ func Test_repoInterface(t *testing.T) {
 }
 
 func Test_repo_Get(t *testing.T) {
+	ctx := context.Background()
 	type fields struct {
 		g    map[string]gauge
 		gMtx *sync.RWMutex
@@ -123,7 +127,7 @@ func Test_repo_Get(t *testing.T) {
 					Key: "",
 				},
 			}
-			got, err := r.Get(tt.metric)
+			got, err := r.Get(ctx, tt.metric)
 			if tt.wantErr {
 				require.Error(t, err)
 			} else {
@@ -137,6 +141,7 @@ func Test_repo_Get(t *testing.T) {
 }
 
 func Test_repo_List(t *testing.T) {
+	ctx := context.Background()
 	tests := []struct {
 		name string
 	}{
@@ -148,13 +153,14 @@ func Test_repo_List(t *testing.T) {
 		t.Run(tt.name, func(t *testing.T) {
 			logger := config.TestLogger()
 			r := New(config.NewServerConfig(), logger)
-			got, _ := r.List()
+			got, _ := r.List(ctx)
 			assert.NotEqual(t, "", got)
 		})
 	}
 }
 
 func Test_repo_Set(t *testing.T) {
+	ctx := context.Background()
 	tests := []struct {
 		name    string
 		metric  metrics.Metric
@@ -176,7 +182,7 @@ func Test_repo_Set(t *testing.T) {
 	defer r.Close()
 	for _, tt := range tests {
 		t.Run(tt.name, func(t *testing.T) {
-			err := r.Set(tt.metric)
+			err := r.Set(ctx, tt.metric)
 			if tt.wantErr {
 				assert.Error(t, err)
 			} else {
@@ -185,3 +191,233 @@ func Test_repo_Set(t *testing.T) {
 		})
 	}
 }
+
+func Test_repo_Set_counter(t *testing.T) {
+	ctx := context.Background()
+	cfg := config.NewServerConfig()
+	cfg.StoreFile = t.TempDir() + "/db.json"
+	r := repoInterface(cfg, config.TestLogger())
+	defer r.Close()
+
+	add := metrics.NewOmitEmpty("PollCount", metrics.CounterType, nil, metrics.PointerFromInt64(5))
+	require.NoError(t, r.Set(ctx, add))
+	require.NoError(t, r.Set(ctx, add))
+	assert.Equal(t, counter(10), r.C["PollCount"])
+
+	set := metrics.NewOmitEmpty("PollCount", metrics.CounterType, nil, metrics.PointerFromInt64(7))
+	set.SetCumulative(true)
+	require.NoError(t, r.Set(ctx, set))
+	assert.Equal(t, counter(7), r.C["PollCount"])
+}
+
+func Test_repo_keyRotation(t *testing.T) {
+	ctx := context.Background()
+	cfg := config.NewServerConfig()
+	cfg.StoreFile = t.TempDir() + "/db.json"
+	cfg.Key = "old"
+	cfg.Keys = []string{"k2=new"}
+	cfg.SigningKeyID = "k2"
+	r := repoInterface(cfg, config.TestLogger())
+	defer r.Close()
+
+	signed := func(id, key string) metrics.Metric {
+		m := metrics.NewOmitEmpty("Alloc", metrics.GaugeType, metrics.PointerFromFloat64(1), nil)
+		m.SetKeyID(id)
+		require.NoError(t, m.SetHash(key))
+		return m
+	}
+
+	tests := []struct {
+		name    string
+		metric  metrics.Metric
+		wantErr string
+	}{
+		{
+			name:   "legacy key",
+			metric: signed("", "old"),
+		},
+		{
+			name:   "new key",
+			metric: signed("k2", "new"),
+		},
+		{
+			name:    "wrong secret",
+			metric:  signed("k2", "old"),
+			wantErr: `hash mismatch, expected key id "k2"`,
+		},
+		{
+			name:    "unknown key id",
+			metric:  signed("k3", "new"),
+			wantErr: `unknown key id "k3", expected key id "k2"`,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := r.Set(ctx, tt.metric)
+			if tt.wantErr == "" {
+				assert.NoError(t, err)
+				return
+			}
+			require.ErrorAs(t, err, &metrics.InvalidHash)
+			assert.Contains(t, err.Error(), tt.wantErr)
+		})
+	}
+
+	got, err := r.Get(ctx, metrics.NewOmitEmpty("Alloc", metrics.GaugeType, nil, nil))
+	require.NoError(t, err)
+	assert.Equal(t, "k2", got.KeyID())
+	ok, err := got.CheckHash("new")
+	require.NoError(t, err)
+	assert.True(t, ok)
+}
+
+func Test_newKeyRing(t *testing.T) {
+	tests := []struct {
+		name    string
+		key     string
+		keys    []string
+		signing string
+		legacy  bool
+		window  time.Duration
+		wantErr bool
+	}{
+		{
+			name: "no keys",
+		},
+		{
+			name:   "legacy hash",
+			key:    "old",
+			legacy: true,
+		},
+		{
+			name:    "legacy hash with replay window",
+			key:     "old",
+			legacy:  true,
+			window:  time.Minute,
+			wantErr: true,
+		},
+		{
+			name: "legacy only",
+			key:  "old",
+		},
+		{
+			name:    "signing key",
+			keys:    []string{"k1=a", "k2=b"},
+			signing: "k2",
+		},
+		{
+			name:    "unknown signing key",
+			keys:    []string{"k1=a"},
+			wantErr: true,
+		},
+		{
+			name:    "bad entry",
+			keys:    []string{"k1"},
+			signing: "k1",
+			wantErr: true,
+		},
+		{
+			name:    "duplicate id",
+			keys:    []string{"k1=a", "k1=b"},
+			signing: "k1",
+			wantErr: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := newKeyRing(&config.ServerConfig{
+				Key:          tt.key,
+				Keys:         tt.keys,
+				SigningKeyID: tt.signing,
+				LegacyHash:   tt.legacy,
+				ReplayWindow: tt.window,
+			})
+			if tt.wantErr {
+				assert.Error(t, err)
+			} else {
+				assert.NoError(t, err)
+			}
+		})
+	}
+}
+
+func Test_checkName(t *testing.T) {
+	tests := []struct {
+		name    string
+		metric  string
+		wantErr bool
+	}{
+		{name: "ok", metric: "Alloc"},
+		{name: "max length", metric: strings.Repeat("я", maxNameLength)},
+		{name: "empty", metric: "", wantErr: true},
+		{name: "too long", metric: strings.Repeat("x", maxNameLength+1), wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := checkName(metrics.NewOmitEmpty(tt.metric, metrics.GaugeType, nil, nil))
+			if tt.wantErr {
+				assert.ErrorAs(t, err, &metrics.InvalidName)
+			} else {
+				assert.NoError(t, err)
+			}
+		})
+	}
+}
+
+func Test_repo_SetBatch(t *testing.T) {
+	ctx := context.Background()
+	bad := metrics.NewOmitEmpty("PollCount", metrics.CounterType, nil, metrics.PointerFromInt64(1))
+	require.NoError(t, bad.SetHash("wrong"))
+
+	tests := []struct {
+		name      string
+		atomic    bool
+		wantErrs  []interface{}
+		wantAlloc bool
+		wantCount counter
+	}{
+		{
+			name:      "partial",
+			wantErrs:  []interface{}{nil, &metrics.InvalidType, &metrics.InvalidHash, nil},
+			wantAlloc: true,
+			wantCount: 2,
+		},
+		{
+			name:     "atomic",
+			atomic:   true,
+			wantErrs: []interface{}{ErrNotApplied, &metrics.InvalidType, &metrics.InvalidHash, ErrNotApplied},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg := config.NewServerConfig()
+			cfg.StoreFile = t.TempDir() + "/db.json"
+			cfg.Key = "secret"
+			r := repoInterface(cfg, config.TestLogger())
+			defer r.Close()
+
+			errs, err := r.SetBatch(ctx, []metrics.Metric{
+				metrics.NewOmitEmpty("Alloc", metrics.GaugeType, metrics.PointerFromFloat64(1), nil),
+				metrics.NewOmitEmpty("Alloc", "int", nil, nil),
+				bad,
+				metrics.NewOmitEmpty("PollCount", metrics.CounterType, nil, metrics.PointerFromInt64(2)),
+			}, tt.atomic)
+			require.NoError(t, err)
+			require.Len(t, errs, len(tt.wantErrs))
+			for i, want := range tt.wantErrs {
+				switch w := want.(type) {
+				case nil:
+					assert.NoError(t, errs[i])
+				case error:
+					assert.ErrorIs(t, errs[i], w)
+				default:
+					assert.ErrorAs(t, errs[i], w)
+				}
+			}
+
+			_, ok := r.G["Alloc"]
+			assert.Equal(t, tt.wantAlloc, ok)
+			assert.Equal(t, tt.wantCount, r.C["PollCount"])
+		})
+	}
+}